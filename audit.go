@@ -0,0 +1,580 @@
+package knocknock
+
+/*
+ * audit.go содержит журнал аудита аутентификации: создание, истечение, отзыв и перевыпуск сессий и отказы в доступе.
+ * Запись несёт время, пользователя, отпечаток токена, IP-адрес и User-Agent клиента. Сам токен в журнал не попадает:
+ * отпечаток -- это префикс SHA-256 ключа сессии в хранилище, по нему можно связать записи об одной сессии, но нельзя
+ * восстановить токен.
+ *
+ * Записи сцеплены хешами: каждая хранит хеш предыдущей и свой, посчитанный по всем полям. Исправленная, удалённая
+ * или вставленная запись рвёт цепочку, что находит VerifyAuditLog. Без ключа хеш -- обычный SHA-256, и тот, кто может
+ * писать в журнал, может и пересчитать цепочку после правки: такая цепочка ловит только случайную порчу. Защиту от
+ * подделки даёт ключ (WithAuditKey): хеш становится HMAC-SHA-256, и без ключа согласованную цепочку не собрать.
+ *
+ * Даже с ключом цепочка не замечает, что у журнала отрезали хвост: укороченный журнал -- это тоже верная цепочка.
+ * Против этого последнюю запись (AuditLog.Head) нужно регулярно отправлять туда, куда приложение не может писать, и
+ * сверять с ней журнал опцией WithAuditAnchor. Ключ тоже стоит держать отдельно от журнала.
+ *
+ * Журнал пишется через AuditSink. Встроенные приёмники -- файл JSON Lines (JSONLinesSink) и log/slog (SlogSink)
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Действие, записанное в журнал аудита
+type AuditAction string
+
+const (
+	AuditSessionCreate     AuditAction = "session.create"     // Сессия создана
+	AuditAccessDenied      AuditAction = "access.denied"      // Запрос отклонён: нет сессии, не хватает прав, неверный CSRF-токен
+	AuditSessionExpire     AuditAction = "session.expire"     // Обнаружена протухшая сессия или refresh-токен
+	AuditSessionRevoke     AuditAction = "session.revoke"     // Сессия удалена: выход, отзыв, вытеснение по лимиту
+	AuditSessionRegenerate AuditAction = "session.regenerate" // Сессии выдан новый токен (см. RegenerateSession)
+)
+
+// Запись журнала аудита. Seq, PrevHash и Hash заполняет AuditLog
+type AuditRecord struct {
+	Seq                 uint64      `json:"seq"`                           // Номер записи в цепочке, начиная с 1
+	Time                time.Time   `json:"time"`                          // Время события в UTC
+	Action              AuditAction `json:"action"`                        // Что произошло
+	Subject             string      `json:"subject,omitempty"`             // Пользователь (Session.Subject), если известен
+	TokenFingerprint    string      `json:"tokenFingerprint,omitempty"`    // Отпечаток токена, если он есть
+	PreviousFingerprint string      `json:"previousFingerprint,omitempty"` // Отпечаток заменённого токена при перевыпуске
+	ClientIP            string      `json:"clientIp,omitempty"`            // IP-адрес клиента
+	UserAgent           string      `json:"userAgent,omitempty"`           // User-Agent клиента
+	Reason              string      `json:"reason,omitempty"`              // Причина отказа в доступе
+	PrevHash            string      `json:"prevHash"`                      // Hash предыдущей записи. Пустой у первой записи цепочки
+	Hash                string      `json:"hash"`                          // SHA-256 или HMAC-SHA-256 записи со всеми полями, кроме самого Hash
+}
+
+// Считает хеш записи: SHA-256 её JSON-представления с пустым Hash, а с ключом -- HMAC-SHA-256. PrevHash входит
+// в хешируемые поля, поэтому хеш зависит от всей цепочки до записи
+func (r *AuditRecord) digest(key []byte) (string, error) {
+	unsealed := *r
+	unsealed.Hash = ""
+	data, err := json.Marshal(&unsealed)
+	if err != nil {
+		return "", err
+	}
+	if len(key) == 0 {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:]), nil
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Приёмник журнала аудита. Write вызывается последовательно, по одной записи, в порядке цепочки. Если Write
+// вернул ошибку, запись считается непринятой и цепочка продолжается с предыдущей
+type AuditSink interface {
+	Write(ctx context.Context, record *AuditRecord) error
+}
+
+// Приёмник журнала аудита из обычной функции
+type AuditSinkFunc func(ctx context.Context, record *AuditRecord) error
+
+func (f AuditSinkFunc) Write(ctx context.Context, record *AuditRecord) error {
+	return f(ctx, record)
+}
+
+// Необязательная возможность приёмника: вернуть последнюю записанную запись, чтобы после перезапуска цепочка
+// продолжилась с неё. Возвращает nil, если записей ещё нет
+type AuditResumer interface {
+	LastRecord() (*AuditRecord, error)
+}
+
+// Структура настроек AuditLog через функциональные опции
+type AuditOptions struct {
+	ClientIP     func(r *http.Request) string // Как определить IP-адрес клиента. nil -- адрес TCP-соединения
+	ErrorHandler func(err error)              // Куда сообщать об ошибках записи. nil -- в slog.Default()
+	Key          []byte                       // Ключ HMAC для хешей цепочки. Пустой -- обычный SHA-256
+	AnchorSeq    uint64                       // Номер записи, сохранённой вне журнала. Только для VerifyAuditLog
+	AnchorHash   string                       // Hash этой записи. Только для VerifyAuditLog
+}
+
+type AuditOption func(*AuditOptions)
+
+// Функциональная опция для установки способа определения IP-адреса клиента. Нужна за обратным прокси, где адрес
+// соединения -- это адрес прокси. Заголовкам вроде X-Forwarded-For можно доверять, только если их ставит свой прокси.
+//
+// Пример:
+//
+//	knocknock.WithAuditClientIP(func(r *http.Request) string {
+//	    return r.Header.Get("X-Real-IP")
+//	})
+func WithAuditClientIP(clientIP func(r *http.Request) string) AuditOption {
+	return func(o *AuditOptions) {
+		o.ClientIP = clientIP
+	}
+}
+
+// Функциональная опция для установки обработчика ошибок записи. Auth не прерывает вход или выход из-за сбоя журнала,
+// поэтому об ошибке можно узнать только здесь
+func WithAuditErrorHandler(handler func(err error)) AuditOption {
+	return func(o *AuditOptions) {
+		o.ErrorHandler = handler
+	}
+}
+
+// Функциональная опция для установки ключа HMAC, которым подписывается цепочка. Без ключа цепочку может пересчитать
+// любой, кто может писать в журнал. Тот же ключ передаётся в VerifyAuditLog. Смена ключа рвёт цепочку, поэтому
+// после неё журнал стоит начинать с нового файла.
+//
+// Пример:
+//
+//	audit, err := knocknock.HandleAuditLog(sink, knocknock.WithAuditKey([]byte(os.Getenv("AUDIT_KEY"))))
+func WithAuditKey(key []byte) AuditOption {
+	return func(o *AuditOptions) {
+		o.Key = key
+	}
+}
+
+// Функциональная опция VerifyAuditLog: журнал должен содержать запись seq с хешем hash, сохранённую вне журнала
+// (см. AuditLog.Head). Так находится отрезанный хвост журнала, который сама цепочка не замечает
+func WithAuditAnchor(seq uint64, hash string) AuditOption {
+	return func(o *AuditOptions) {
+		o.AnchorSeq, o.AnchorHash = seq, hash
+	}
+}
+
+// Создаёт и возвращает конфигурацию AuditLog по умолчанию
+func defaultAuditOptions() *AuditOptions {
+	return &AuditOptions{
+		ClientIP: remoteIP,
+		ErrorHandler: func(err error) {
+			slog.Default().Error("knocknock: audit write failed", slog.String("error", err.Error()))
+		},
+	}
+}
+
+// Журнал аудита: сцепляет записи хешами и отдаёт их приёмнику
+type AuditLog struct {
+	mu   sync.Mutex
+	sink AuditSink
+	opts *AuditOptions
+	seq  uint64
+	last string
+}
+
+// Конструктор журнала аудита. Если приёмник реализует AuditResumer, цепочка продолжается с его последней записи.
+// Подключается к Auth опцией WithAudit.
+//
+// Пример:
+//
+//	sink, err := knocknock.HandleJSONLinesSink("/var/log/app/audit.jsonl")
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	audit, err := knocknock.HandleAuditLog(sink)
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	auth := knocknock.HandleAuth(store, knocknock.WithAudit(audit))
+func HandleAuditLog(sink AuditSink, auditOptions ...AuditOption) (*AuditLog, error) {
+	opts := defaultAuditOptions()
+	for _, opt := range auditOptions {
+		opt(opts)
+	}
+
+	l := &AuditLog{sink: sink, opts: opts}
+	if resumer, ok := sink.(AuditResumer); ok {
+		last, err := resumer.LastRecord()
+		if err != nil {
+			return nil, err
+		}
+		if last != nil {
+			l.seq, l.last = last.Seq, last.Hash
+		}
+	}
+	return l, nil
+}
+
+// Дописывает запись в журнал. Время, IP-адрес и User-Agent берутся из контекста (см. AuditContext), если не заданы.
+// Нужна для событий, о которых Auth не знает, например, неверного пароля на странице входа.
+//
+// Пример:
+//
+//	audit.Record(knocknock.AuditContext(r.Context(), r), &knocknock.AuditRecord{
+//	    Action:  knocknock.AuditAccessDenied,
+//	    Subject: login,
+//	    Reason:  "invalid password",
+//	})
+func (l *AuditLog) Record(ctx context.Context, record *AuditRecord) error {
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	record.Time = record.Time.UTC()
+	if r := auditRequest(ctx); r != nil {
+		if record.ClientIP == "" {
+			record.ClientIP = l.opts.ClientIP(r)
+		}
+		if record.UserAgent == "" {
+			record.UserAgent = r.UserAgent()
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	record.Seq = l.seq + 1
+	record.PrevHash = l.last
+	hash, err := record.digest(l.opts.Key)
+	if err != nil {
+		return err
+	}
+	record.Hash = hash
+
+	if err := l.sink.Write(ctx, record); err != nil {
+		return err
+	}
+	l.seq, l.last = record.Seq, record.Hash
+	return nil
+}
+
+// Возвращает номер и хеш последней записи журнала. Их стоит регулярно сохранять туда, куда приложение не может
+// писать, и передавать в VerifyAuditLog через WithAuditAnchor.
+//
+// Пример:
+//
+//	seq, hash := audit.Head()
+//	anchors.Put(ctx, seq, hash)
+func (l *AuditLog) Head() (seq uint64, hash string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.seq, l.last
+}
+
+// Проверяет цепочку записей журнала в формате JSON Lines (см. JSONLinesSink): хеш каждой записи, ссылку на
+// предыдущую и непрерывность номеров. Первая запись может ссылаться на запись вне журнала, например, после ротации
+// файла. Если журнал подписан ключом, тот же ключ передаётся через WithAuditKey. С WithAuditAnchor журнал ещё и
+// должен содержать сохранённую вне его запись: иначе у него отрезан хвост. Остальные опции не используются.
+// Возвращает AuditChainBrokenError с номером первой неверной строки.
+//
+// Пример:
+//
+//	file, _ := os.Open("/var/log/app/audit.jsonl")
+//	defer file.Close()
+//	seq, hash := anchors.Last(ctx)
+//	err := knocknock.VerifyAuditLog(file, knocknock.WithAuditKey(key), knocknock.WithAuditAnchor(seq, hash))
+//	if err != nil {
+//	    log.Printf("audit log was tampered with: %v", err)
+//	}
+func VerifyAuditLog(r io.Reader, auditOptions ...AuditOption) error {
+	opts := defaultAuditOptions()
+	for _, opt := range auditOptions {
+		opt(opts)
+	}
+
+	// Строки читаются целиком, без предела длины токена bufio.Scanner: запись с длинным UserAgent или Reason не должна
+	// ломать проверку
+	reader := bufio.NewReader(r)
+
+	var prev *AuditRecord
+	anchored := opts.AnchorSeq == 0
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(data) == 0 {
+			break
+		} else if err != nil && err != io.EOF {
+			return err
+		}
+
+		var record AuditRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return fmt.Errorf("%w: line %d: %v", AuditChainBrokenError, line, err)
+		}
+
+		hash, err := record.digest(opts.Key)
+		if err != nil {
+			return err
+		}
+		switch {
+		case hash != record.Hash:
+			return fmt.Errorf("%w: line %d: hash mismatch", AuditChainBrokenError, line)
+		case prev != nil && record.PrevHash != prev.Hash:
+			return fmt.Errorf("%w: line %d: previous hash mismatch", AuditChainBrokenError, line)
+		case prev != nil && record.Seq != prev.Seq+1:
+			return fmt.Errorf("%w: line %d: sequence gap", AuditChainBrokenError, line)
+		case record.Seq == opts.AnchorSeq && record.Hash != opts.AnchorHash:
+			return fmt.Errorf("%w: line %d: anchor mismatch", AuditChainBrokenError, line)
+		}
+		anchored = anchored || record.Seq == opts.AnchorSeq
+		prev = &record
+	}
+	if !anchored {
+		return fmt.Errorf("%w: anchored record %d is missing", AuditChainBrokenError, opts.AnchorSeq)
+	}
+	return nil
+}
+
+// Функциональная опция для подключения журнала аудита
+func WithAudit(audit *AuditLog) AuthOption {
+	return func(o *AuthOptions) {
+		o.Audit = audit
+	}
+}
+
+// Ключ контекста, под которым лежит запрос для журнала аудита
+const auditRequestContextKey ContextKey = "auditRequest"
+
+// Возвращает контекст, из которого журнал аудита возьмёт IP-адрес и User-Agent клиента. Middleware, RequireAuth,
+// Login, Logout и Regenerate делают это сами; вызывать явно нужно, только если методы Auth вызываются с контекстом
+// запроса в обход них.
+//
+// Пример:
+//
+//	session, err := auth.CreateSession(knocknock.AuditContext(r.Context(), r), user)
+func AuditContext(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, auditRequestContextKey, r)
+}
+
+func auditRequest(ctx context.Context) *http.Request {
+	if r, ok := ctx.Value(auditRequestContextKey).(*http.Request); ok {
+		return r
+	}
+	return nil
+}
+
+// Кладёт запрос в его собственный контекст для журнала аудита, если журнал подключён
+func (a *Auth) auditContext(r *http.Request) *http.Request {
+	if a.AuthOptions.Audit == nil || auditRequest(r.Context()) != nil {
+		return r
+	}
+	return r.WithContext(AuditContext(r.Context(), r))
+}
+
+// Адрес TCP-соединения без порта
+func remoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// Записывает событие сессии в журнал аудита. fingerprint -- отпечаток её токена
+func (a *Auth) audit(ctx context.Context, action AuditAction, session *Session, fingerprint string) {
+	if a.AuthOptions.Audit == nil {
+		return
+	}
+	a.writeAudit(ctx, &AuditRecord{Action: action, Subject: session.Subject, TokenFingerprint: fingerprint})
+}
+
+// Учитывает отказ в доступе со стороны middleware: пишет его в журнал аудита и в метрики
+func (a *Auth) deny(r *http.Request, middleware string, session *Session, denied error) {
+	a.auditDenied(r, session, denied)
+	a.AuthOptions.Metrics.rejection(middleware, denied)
+}
+
+// Записывает в журнал аудита отказ в доступе. session -- сессия запроса, если она нашлась
+func (a *Auth) auditDenied(r *http.Request, session *Session, denied error) {
+	if a.AuthOptions.Audit == nil {
+		return
+	}
+
+	record := &AuditRecord{Action: AuditAccessDenied, Reason: denied.Error()}
+	if session != nil {
+		record.Subject = session.Subject
+		record.TokenFingerprint = a.tokenFingerprint(session.Token)
+	} else if token, _, _ := a.lookupToken(r); token != "" {
+		record.TokenFingerprint = a.tokenFingerprint(token)
+	}
+	a.writeAudit(AuditContext(r.Context(), r), record)
+}
+
+func (a *Auth) writeAudit(ctx context.Context, record *AuditRecord) {
+	audit := a.AuthOptions.Audit
+	if err := audit.Record(ctx, record); err != nil {
+		audit.opts.ErrorHandler(err)
+	}
+}
+
+// Отпечаток токена: отпечаток ключа, под которым сессия хранится, а для подписанного токена -- самого токена
+func (a *Auth) tokenFingerprint(token string) string {
+	if token == "" {
+		return ""
+	}
+	if a.signedToken(token) {
+		return keyFingerprint(token)
+	}
+	return keyFingerprint(a.storeKey(token))
+}
+
+// Отпечаток ключа сессии в хранилище: первые 16 байт SHA-256 в hex
+func keyFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Приёмник журнала аудита, дописывающий записи в файл по одной JSON-записи на строку. Каждая запись сбрасывается
+// на диск до возврата из Write. Реализует AuditResumer
+type JSONLinesSink struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// Конструктор приёмника JSON Lines. Открывает файл на дозапись, создавая его при необходимости.
+//
+// Пример:
+//
+//	sink, err := knocknock.HandleJSONLinesSink("/var/log/app/audit.jsonl")
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	defer sink.Close()
+func HandleJSONLinesSink(path string) (*JSONLinesSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONLinesSink{path: path, file: file}, nil
+}
+
+func (s *JSONLinesSink) Write(ctx context.Context, record *AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return os.ErrClosed
+	}
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// Возвращает последнюю запись файла. Оборванная последняя строка -- ошибка: продолжать цепочку после неё нельзя,
+// файл нужно разобрать вручную
+func (s *JSONLinesSink) LastRecord() (*AuditRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := lastLine(file)
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+
+	var record AuditRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("%w: last line: %v", AuditChainBrokenError, err)
+	}
+	return &record, nil
+}
+
+// Читает последнюю непустую строку файла блоками с конца, не загружая весь журнал в память
+func lastLine(file *os.File) ([]byte, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	const block = 4096
+	buf := make([]byte, block)
+	var line []byte
+	trailing := true // Ещё идут завершающие переводы строки
+	for end := info.Size(); end > 0; {
+		start := max(end-block, 0)
+		part := buf[:end-start]
+		if _, err := file.ReadAt(part, start); err != nil {
+			return nil, err
+		}
+		end = start
+
+		if trailing {
+			if part = bytes.TrimRight(part, "\n"); len(part) == 0 {
+				continue
+			}
+			trailing = false
+		}
+		if i := bytes.LastIndexByte(part, '\n'); i >= 0 {
+			return append(bytes.Clone(part[i+1:]), line...), nil
+		}
+		line = append(bytes.Clone(part), line...)
+	}
+	return line, nil
+}
+
+// Закрывает файл. После закрытия Write возвращает os.ErrClosed
+func (s *JSONLinesSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// Приёмник журнала аудита, пишущий записи в log/slog сообщением "knocknock: audit" с уровнем Info. Поля записи
+// передаются атрибутами, так что цепочку можно проверить и по собранным логам
+type SlogSink struct {
+	logger *slog.Logger
+}
+
+// Конструктор приёмника slog. nil -- slog.Default().
+//
+// Пример:
+//
+//	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+//	audit, _ := knocknock.HandleAuditLog(knocknock.HandleSlogSink(logger))
+func HandleSlogSink(logger *slog.Logger) *SlogSink {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &SlogSink{logger: logger}
+}
+
+func (s *SlogSink) Write(ctx context.Context, record *AuditRecord) error {
+	attrs := []slog.Attr{
+		slog.Uint64("seq", record.Seq),
+		slog.Time("time", record.Time),
+		slog.String("action", string(record.Action)),
+	}
+	optional := []struct{ key, value string }{
+		{"subject", record.Subject},
+		{"tokenFingerprint", record.TokenFingerprint},
+		{"previousFingerprint", record.PreviousFingerprint},
+		{"clientIp", record.ClientIP},
+		{"userAgent", record.UserAgent},
+		{"reason", record.Reason},
+	}
+	for _, attr := range optional {
+		if attr.value != "" {
+			attrs = append(attrs, slog.String(attr.key, attr.value))
+		}
+	}
+	attrs = append(attrs, slog.String("prevHash", record.PrevHash), slog.String("hash", record.Hash))
+
+	s.logger.LogAttrs(ctx, slog.LevelInfo, "knocknock: audit", slog.Attr{Key: "audit", Value: slog.GroupValue(attrs...)})
+	return nil
+}
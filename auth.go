@@ -9,16 +9,45 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
 	"time"
 )
 
 // Структура настроек Auth через функциональные опции
 type AuthOptions struct {
-	TokenSize      int           // Длина токена в байтах
-	DefaultExpiry  time.Duration // Время жизни сессии по умолчанию
-	CookieName     string        // Имя cookie для токена
-	HeaderName     string        // Имя HTTP-заголовка для токена
-	QueryParamName string        // Имя query-параметра для токена
+	TokenSize            int                // Длина токена в байтах
+	DefaultExpiry        time.Duration      // Время жизни сессии по умолчанию
+	CookieName           string             // Имя cookie для токена
+	HeaderName           string             // Имя HTTP-заголовка для токена
+	QueryParamName       string             // Имя query-параметра для токена
+	IdleTimeout          time.Duration      // Время бездействия, после которого сессия истекает. 0 отключает скользящее истечение
+	MaxLifetime          time.Duration      // Абсолютный предел жизни сессии при скользящем истечении. 0 -- без предела
+	TouchInterval        time.Duration      // Минимальный шаг продления сессии, чтобы не писать в хранилище на каждый запрос
+	AccessExpiry         time.Duration      // Время жизни сессии из пары, выданной CreateSessionPair
+	RefreshExpiry        time.Duration      // Время жизни refresh-токена из пары
+	SessionLimit         int                // Максимум активных сессий на пользователя. 0 -- без ограничения
+	LimitPolicy          SessionLimitPolicy // Что делать при превышении SessionLimit
+	TokenHashKey         string             // Ключ HMAC для хранения токенов в виде хешей. Пустой -- токены хранятся как есть
+	PreviousTokenHashKey string             // Предыдущий ключ HMAC, принимаемый после ротации
+	PreviousKeyExpiresAt time.Time          // Конец льготного периода для PreviousTokenHashKey
+	SplitTokens          bool               // Выдавать токены вида "селектор.верификатор" (см. tokens.go)
+	TokenGenerator       TokenGenerator     // Генератор токенов. nil -- hex длиной TokenSize байт
+	JWTKey               JWTKey             // Ключ подписи токенов. nil -- сессии хранятся в Store (см. jwt.go)
+	RoleHierarchy        *RoleHierarchy     // Иерархия ролей для проверки прав (см. authorize.go)
+	CookieDomain         string             // Атрибут Domain cookie сессии. Пустой -- только текущий хост
+	CookiePath           string             // Атрибут Path cookie сессии
+	CookieSecure         bool               // Всегда ставить Secure (по умолчанию). false -- только для запросов по TLS
+	CookieSameSite       http.SameSite      // Атрибут SameSite cookie сессии
+	CookiePartitioned    bool               // Атрибут Partitioned (CHIPS) cookie сессии
+	CookieHostPrefix     bool               // Требовать у имени cookie префикс __Host- (см. cookie.go)
+	TokenSource          TokenSource        // Откуда брать токен запроса. nil -- заголовок, query-параметр, cookie (см. source.go)
+	StrictTokenSources   bool               // Отклонять запросы, в которых источники дают разные токены
+	Audit                *AuditLog          // Журнал аудита. nil -- события не записываются (см. audit.go)
+	Logger               *slog.Logger       // Лог отказов, истечений и ошибок хранилища. nil -- не писать (см. log.go)
+	Metrics              *Metrics           // Метрики Auth. nil -- не собирать (см. metrics.go)
+	Tracer               Tracer             // Трассировка операций Auth. nil -- не трассировать (см. trace.go)
 }
 
 type AuthOption func(*AuthOptions)
@@ -58,6 +87,42 @@ func WithQueryParamName(name string) AuthOption {
 	}
 }
 
+// Функциональная опция для включения скользящего истечения: каждое успешное обращение к сессии продлевает её на
+// idle от текущего момента
+func WithIdleTimeout(idle time.Duration) AuthOption {
+	return func(o *AuthOptions) {
+		o.IdleTimeout = idle
+	}
+}
+
+// Функциональная опция для установки абсолютного предела жизни сессии, дальше которого её не продлить
+func WithMaxLifetime(lifetime time.Duration) AuthOption {
+	return func(o *AuthOptions) {
+		o.MaxLifetime = lifetime
+	}
+}
+
+// Функциональная опция для установки минимального шага продления сессии
+func WithTouchInterval(interval time.Duration) AuthOption {
+	return func(o *AuthOptions) {
+		o.TouchInterval = interval
+	}
+}
+
+// Функциональная опция для установки времени жизни сессии из пары
+func WithAccessExpiry(expiry time.Duration) AuthOption {
+	return func(o *AuthOptions) {
+		o.AccessExpiry = expiry
+	}
+}
+
+// Функциональная опция для установки времени жизни refresh-токена
+func WithRefreshExpiry(expiry time.Duration) AuthOption {
+	return func(o *AuthOptions) {
+		o.RefreshExpiry = expiry
+	}
+}
+
 // Создаёт и возвращает конфигурацию Auth по умолчанию
 func defaultAuthOptions() *AuthOptions {
 	return &AuthOptions{
@@ -66,6 +131,12 @@ func defaultAuthOptions() *AuthOptions {
 		CookieName:     "session_token",
 		HeaderName:     "Authorization",
 		QueryParamName: "token",
+		CookiePath:     "/",
+		CookieSecure:   true,
+		CookieSameSite: http.SameSiteLaxMode,
+		TouchInterval:  time.Minute,
+		AccessExpiry:   15 * time.Minute,
+		RefreshExpiry:  30 * 24 * time.Hour,
 	}
 }
 
@@ -73,9 +144,13 @@ func defaultAuthOptions() *AuthOptions {
 type Auth struct {
 	store       Store
 	AuthOptions *AuthOptions
+	hooks       *hooks
+	unnotify    func() // Снимает обработчик ExpiryNotifier, см. Close
 }
 
-// Конструктор структуры Auth. Обязательно принимает хранилище, опционально -- набор функциональных опций
+// Конструктор структуры Auth. Обязательно принимает хранилище, опционально -- набор функциональных опций. Если
+// настройки противоречат друг другу (см. AuthOptions.Validate), Auth всё равно создаётся с ними, а ошибка пишется
+// в лог (WithLogger, иначе slog.Default()). Строгая проверка -- в HandleCheckedAuth
 //
 // Пример:
 //
@@ -86,51 +161,376 @@ func HandleAuth(store Store, authOptions ...AuthOption) *Auth {
 	for _, opt := range authOptions {
 		opt(opts)
 	}
-	return &Auth{store, opts}
+	if err := opts.prepare(); err != nil {
+		opts.warnInvalid(err)
+	}
+	return newAuth(store, opts)
+}
+
+// Конструктор структуры Auth, который отказывается работать с противоречивыми настройками. Ошибка оборачивает
+// InvalidCookieOptionsError.
+//
+// Пример:
+//
+//	auth, err := knocknock.HandleCheckedAuth(store, knocknock.WithCookieDomain(cfg.CookieDomain))
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+func HandleCheckedAuth(store Store, authOptions ...AuthOption) (*Auth, error) {
+	opts := defaultAuthOptions()
+	for _, opt := range authOptions {
+		opt(opts)
+	}
+	if err := opts.prepare(); err != nil {
+		return nil, err
+	}
+	return newAuth(store, opts), nil
 }
 
-// Конструктор для обновления опций Auth. Принимает набор функциональных опций
+// Создаёт Auth с подготовленными настройками и подписывается на истечения в хранилище
+func newAuth(store Store, opts *AuthOptions) *Auth {
+	a := &Auth{store: store, AuthOptions: opts, hooks: newHooks()}
+	a.shareLogger()
+	if notifier, ok := storeAs[ExpiryNotifier](store); ok {
+		a.unnotify = notifier.NotifyExpired(func(session *Session) {
+			if session.Kind == SessionKindAccess || session.Kind == SessionKindRefresh {
+				a.emitStored(context.Background(), EventExpire, session)
+			}
+		})
+	}
+	return a
+}
+
+// Отвязывает Auth от хранилища: снимает обработчик истечения, зарегистрированный в HandleAuth. Нужен, если Auth
+// создаются и выбрасываются над долгоживущим хранилищем, например в тестах или при перечитывании конфигурации:
+// иначе каждое хранилище держит все когда-либо созданные над ним Auth. Само хранилище не закрывается. Повторный
+// вызов ничего не делает. Реализует io.Closer
+//
+// Пример:
+//
+//	auth := knocknock.HandleAuth(store)
+//	defer auth.Close()
+func (a *Auth) Close() error {
+	if a.unnotify != nil {
+		a.unnotify()
+	}
+	return nil
+}
+
+// Конструктор для обновления опций Auth. Принимает набор функциональных опций. Как и HandleAuth, противоречивые
+// настройки применяет, а ошибку пишет в лог. Строгая проверка -- в UpdateCheckedAuthOptions
 func (a *Auth) UpdateAuthOptions(authOptions ...AuthOption) {
 	for _, opt := range authOptions {
 		opt(a.AuthOptions)
 	}
+	if err := a.AuthOptions.prepare(); err != nil {
+		a.AuthOptions.warnInvalid(err)
+	}
+	a.shareLogger()
+}
+
+// То же, что UpdateAuthOptions, но противоречивые настройки не применяются: возвращается ошибка, как в
+// HandleCheckedAuth, и остаются прежние настройки.
+//
+// Пример:
+//
+//	if err := auth.UpdateCheckedAuthOptions(knocknock.WithCookieDomain(cfg.CookieDomain)); err != nil {
+//	    log.Printf("config reload rejected: %v", err)
+//	}
+func (a *Auth) UpdateCheckedAuthOptions(authOptions ...AuthOption) error {
+	opts := *a.AuthOptions
+	for _, opt := range authOptions {
+		opt(&opts)
+	}
+	if err := opts.prepare(); err != nil {
+		return err
+	}
+	*a.AuthOptions = opts
+	a.shareLogger()
+	return nil
 }
 
 // Создаёт новую сессию для указанных данных. Автоматически генерирует токен сессии и устанавливает время истечения.
 // Конфигурируется через опции сессии в session.go
-func (a *Auth) CreateSession(ctx context.Context, userData UserData) (*Session, error) {
-	token, err := generateToken(a.AuthOptions.TokenSize)
+//
+// Пример:
+//
+//	session, err := auth.CreateSession(ctx, user, knocknock.WithSubject(strconv.Itoa(user.ID)))
+func (a *Auth) CreateSession(ctx context.Context, userData UserData, sessionOptions ...SessionOption) (*Session, error) {
+	ctx, span := a.startSpan(ctx, "CreateSession")
+	session, err := a.newSession(ctx, userData, a.initialExpiry(), sessionOptions)
+	if err != nil {
+		endSpan(span, lookupError, err)
+		return nil, err
+	}
+	endSpan(span, "created", nil)
+	return session, nil
+}
+
+// Возвращает сессию по токену. Автоматически удаляет сессию если она истекла и возвращает SessionExpiredError. При
+// включённом скользящем истечении (WithIdleTimeout) продлевает сессию. Подписанный токен (WithJWT) проверяется без
+// чтения сессии из хранилища
+func (a *Auth) GetSession(ctx context.Context, token string) (*Session, error) {
+	ctx, span := a.startSpan(ctx, "GetSession")
+	session, err := a.loadSession(ctx, token)
+	outcome := lookupOutcome(err)
+	a.AuthOptions.Metrics.sessionLookup(outcome)
+	endSpan(span, outcome, err)
 	if err != nil {
 		return nil, err
 	}
+	a.emit(ctx, EventAccess, session)
+	return session, nil
+}
 
-	session := MakeSession(token, userData, a.AuthOptions.DefaultExpiry)
+// Находит и проверяет сессию по токену. Общая часть GetSession для всех режимов
+func (a *Auth) loadSession(ctx context.Context, token string) (*Session, error) {
+	if a.signedToken(token) {
+		return a.getSignedSession(ctx, token)
+	}
+	if store := a.cookieStore(); store != nil {
+		return a.getSealedSession(ctx, store, token)
+	}
 
-	if err := a.store.Save(ctx, session); err != nil {
+	session, err := a.storedSession(ctx, token)
+	if err != nil {
 		return nil, err
 	}
 
-	return session, nil
+	if a.AuthOptions.IdleTimeout > 0 || a.AuthOptions.LimitPolicy == SessionLimitEvictLRU {
+		// Ошибка записи не делает сессию невалидной: она просто истечёт по прежнему ExpiresAt
+		if touched, err := a.touchSession(ctx, session); err == nil {
+			session = touched
+		} else {
+			a.logStoreError(ctx, "failed to touch session", err)
+		}
+	}
+
+	return a.withToken(session, token), nil
 }
 
-// Возвращает сессию по токену. Автоматически удаляет сессию если она истекла и возвращает SessionExpiredError
-func (a *Auth) GetSession(ctx context.Context, token string) (*Session, error) {
-	session, err := a.store.Get(ctx, token)
+// Находит в хранилище действующую сессию доступа по токену. Протухшая сессия удаляется. Session.Token -- ключ
+// в хранилище
+func (a *Auth) storedSession(ctx context.Context, token string) (*Session, error) {
+	session, err := a.findSession(ctx, token)
 	if err != nil {
 		return nil, err
 	}
 
+	if session.Kind != SessionKindAccess {
+		return nil, SessionNotFoundError
+	}
+
 	if session.IsExpired() {
-		_ = a.DeleteSession(ctx, token)
+		if err := a.deleteStoredSession(ctx, session); err != nil {
+			a.logStoreError(ctx, "failed to delete expired session", err)
+		}
+		a.emit(ctx, EventExpire, a.withToken(session, token))
 		return nil, SessionExpiredError
 	}
-
 	return session, nil
 }
 
-// Удаляет сессию по токену
+// Удаляет сессию по токену. Если передан refresh-токен, вместе с ним удаляется и выданная с ним сессия, а если сессия
+// из пары -- её refresh-токен: выход не должен оставлять способа получить новую пару. Подписанный токен заносится
+// в список отозванных
 func (a *Auth) DeleteSession(ctx context.Context, token string) error {
-	return a.store.Delete(ctx, token)
+	if a.signedToken(token) {
+		return a.revokeSignedSession(ctx, token)
+	}
+
+	session, err := a.findSession(ctx, token)
+	if errors.Is(err, SessionNotFoundError) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := a.deleteStoredSession(ctx, session); err != nil {
+		return err
+	}
+	// Истёкшая сессия пары удаляется без refresh-токена (см. storedSession), а явно удалённая -- вместе с ним
+	if session.Kind == SessionKindAccess && session.Pair != "" {
+		if err := a.store.Delete(ctx, session.Pair); err != nil {
+			return err
+		}
+	}
+	a.emit(ctx, EventDelete, a.withToken(session, token))
+	return nil
+}
+
+// Возвращает активные сессии пользователя, например, чтобы показать ему список устройств. Refresh-токены и протухшие
+// сессии не возвращаются. Хранилище должно реализовывать SubjectIndexer, иначе возвращается StoreUnsupportedError.
+// При хешировании токенов (WithTokenHashing) в Session.Token лежит хеш, а не сам токен
+func (a *Auth) ListSessions(ctx context.Context, subject string) ([]*Session, error) {
+	all, err := a.listBySubject(ctx, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	active := make([]*Session, 0, len(all))
+	for _, session := range all {
+		if session.Kind == SessionKindAccess && !session.IsExpired() {
+			active = append(active, session)
+		}
+	}
+	return active, nil
+}
+
+// Удаляет все сессии и refresh-токены пользователя ("выйти на всех устройствах"). Хранилище должно реализовывать
+// SubjectIndexer, иначе возвращается StoreUnsupportedError
+func (a *Auth) RevokeAllSessions(ctx context.Context, subject string) error {
+	all, err := a.listBySubject(ctx, subject)
+	if err != nil {
+		return err
+	}
+
+	for _, session := range all {
+		if err := a.store.Delete(ctx, session.Token); err != nil {
+			return err
+		}
+		if session.Kind == SessionKindAccess {
+			a.emitStored(ctx, EventDelete, session)
+		}
+	}
+	return nil
+}
+
+// Удаляет сохранённую сессию, а если это refresh-токен, то и выданную с ним сессию
+func (a *Auth) deleteStoredSession(ctx context.Context, session *Session) error {
+	if session.Kind == SessionKindRefresh && session.Pair != "" {
+		if err := a.store.Delete(ctx, session.Pair); err != nil {
+			return err
+		}
+	}
+	return a.store.Delete(ctx, session.Token)
+}
+
+// Ищет сессии пользователя в хранилище
+func (a *Auth) listBySubject(ctx context.Context, subject string) ([]*Session, error) {
+	indexer, ok := storeAs[SubjectIndexer](a.store)
+	if !ok {
+		return nil, StoreUnsupportedError
+	}
+	return indexer.ListBySubject(ctx, subject)
+}
+
+// Создаёт и сохраняет сессию с новым токеном
+func (a *Auth) newSession(ctx context.Context, userData UserData, expiresIn time.Duration, sessionOptions []SessionOption) (*Session, error) {
+	session, err := a.issueSession(ctx, userData, expiresIn, sessionOptions)
+	if err != nil {
+		return nil, err
+	}
+	a.AuthOptions.Metrics.sessionCreated()
+	a.emit(ctx, EventCreate, session)
+	return session, nil
+}
+
+// Выпускает сессию в режиме, в котором работает Auth: подписанный токен, запечатанная cookie или запись в хранилище
+func (a *Auth) issueSession(ctx context.Context, userData UserData, expiresIn time.Duration, sessionOptions []SessionOption) (*Session, error) {
+	if a.AuthOptions.JWTKey != nil {
+		return a.newSignedSession(userData, expiresIn, sessionOptions)
+	}
+	if store := a.cookieStore(); store != nil {
+		return a.newSealedSession(store, userData, expiresIn, sessionOptions)
+	}
+
+	token, err := a.newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	session := MakeSession(a.storeKey(token), userData, expiresIn)
+	session.Verifier = verifierHash(token)
+	for _, opt := range sessionOptions {
+		opt(session)
+	}
+
+	if err := a.enforceSessionLimit(ctx, session); err != nil {
+		return nil, err
+	}
+
+	if err := a.store.Save(ctx, session); err != nil {
+		return nil, err
+	}
+
+	return a.withToken(session, token), nil
+}
+
+// Время жизни новой сессии. При скользящем истечении это IdleTimeout, но не больше MaxLifetime
+func (a *Auth) initialExpiry() time.Duration {
+	if a.AuthOptions.IdleTimeout <= 0 {
+		return a.AuthOptions.DefaultExpiry
+	}
+	if a.AuthOptions.MaxLifetime > 0 {
+		return min(a.AuthOptions.IdleTimeout, a.AuthOptions.MaxLifetime)
+	}
+	return a.AuthOptions.IdleTimeout
+}
+
+// Отмечает обращение к сессии: при скользящем истечении продлевает её на IdleTimeout от текущего момента, не выходя
+// за MaxLifetime, а для сессии из пары -- за AccessExpiry от создания, и обновляет LastAccessedAt. Если ни то, ни другое не сдвинулось хотя бы на TouchInterval, хранилище
+// не трогается. Сохранённая сессия не мутируется: возвращается обновлённая копия
+func (a *Auth) touchSession(ctx context.Context, session *Session) (*Session, error) {
+	touched, changed := a.touch(session)
+	if !changed {
+		return session, nil
+	}
+	if err := a.updateSession(ctx, touched); err != nil {
+		return nil, err
+	}
+	return touched, nil
+}
+
+// Вычисляет, как изменится сессия при обращении, не записывая её. См. touchSession
+func (a *Auth) touch(session *Session) (*Session, bool) {
+	now := time.Now()
+	step := max(a.AuthOptions.TouchInterval, 1)
+	touched := *session
+	changed := false
+
+	if a.AuthOptions.IdleTimeout > 0 {
+		expiresAt := now.Add(a.AuthOptions.IdleTimeout)
+		if a.AuthOptions.MaxLifetime > 0 {
+			if limit := session.CreatedAt.Add(a.AuthOptions.MaxLifetime); expiresAt.After(limit) {
+				expiresAt = limit
+			}
+		}
+		// Сессия из пары должна оставаться короткой: дольше её продлевает только Refresh
+		if session.Kind == SessionKindAccess && session.Pair != "" {
+			if limit := session.CreatedAt.Add(a.AuthOptions.AccessExpiry); expiresAt.After(limit) {
+				expiresAt = limit
+			}
+		}
+		if expiresAt.Sub(session.ExpiresAt) >= step {
+			touched.ExpiresAt = expiresAt
+			changed = true
+		}
+	}
+
+	if now.Sub(session.LastAccessedAt) >= step {
+		touched.LastAccessedAt = now
+		changed = true
+	}
+
+	return &touched, changed
+}
+
+// Перезаписывает сессию в хранилище. Если хранилище не реализует Updater, сессия удаляется и сохраняется заново, но
+// только если она ещё есть: иначе продление, совпавшее с выходом, вернуло бы удалённую сессию. Окно между Get и Save
+// всё же остаётся, и DeleteSession, попавший в него, может не сработать. Полностью гонку закрывает только Updater
+func (a *Auth) updateSession(ctx context.Context, session *Session) error {
+	if updater, ok := storeAs[Updater](a.store); ok {
+		return updater.Update(ctx, session)
+	}
+
+	if _, err := a.store.Get(ctx, session.Token); err != nil {
+		return err
+	}
+	if err := a.store.Delete(ctx, session.Token); err != nil {
+		return err
+	}
+	return a.store.Save(ctx, session)
 }
 
 // Генерирует криптографически безопасный случайный токен
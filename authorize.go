@@ -0,0 +1,189 @@
+package knocknock
+
+/*
+ * authorize.go содержит проверку ролей и прав доступа сессии. Правила (Rule) собираются из AllRoles, AnyRole,
+ * AllScopes, AnyScope и комбинируются через And и Or. Роли учитывают иерархию из WithRoleHierarchy: если admin
+ * включает editor, сессия с ролью admin проходит правило AllRoles("editor"). Права доступа иерархии не имеют
+ */
+
+import (
+	"net/http"
+	"slices"
+)
+
+// Иерархия ролей: для каждой роли -- все роли, которые она включает, в том числе косвенно
+type RoleHierarchy struct {
+	implied map[string]map[string]struct{}
+}
+
+// Функциональная опция для установки иерархии ролей. Ключ -- роль, значение -- роли, которые она непосредственно
+// включает. Вложенность учитывается: admin -> editor -> viewer даёт admin роль viewer.
+//
+// Пример:
+//
+//	auth := knocknock.HandleAuth(store, knocknock.WithRoleHierarchy(map[string][]string{
+//	    "admin":  {"editor"},
+//	    "editor": {"viewer"},
+//	}))
+func WithRoleHierarchy(parents map[string][]string) AuthOption {
+	hierarchy := &RoleHierarchy{make(map[string]map[string]struct{}, len(parents))}
+	for role := range parents {
+		implied := make(map[string]struct{})
+		stack := slices.Clone(parents[role])
+		for len(stack) > 0 {
+			child := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if _, seen := implied[child]; seen {
+				continue
+			}
+			implied[child] = struct{}{}
+			stack = append(stack, parents[child]...)
+		}
+		hierarchy.implied[role] = implied
+	}
+
+	return func(o *AuthOptions) {
+		o.RoleHierarchy = hierarchy
+	}
+}
+
+// Включает ли роль role роль required
+func (h *RoleHierarchy) Implies(role, required string) bool {
+	if role == required {
+		return true
+	}
+	if h == nil {
+		return false
+	}
+	_, ok := h.implied[role][required]
+	return ok
+}
+
+// Есть ли у сессии роль с учётом иерархии ролей
+func (a *Auth) HasRole(session *Session, role string) bool {
+	return slices.ContainsFunc(session.Roles, func(granted string) bool {
+		return a.AuthOptions.RoleHierarchy.Implies(granted, role)
+	})
+}
+
+// Есть ли у сессии право доступа
+func (s *TypedSession[T]) HasScope(scope string) bool {
+	return slices.Contains(s.Scopes, scope)
+}
+
+// Правило доступа. Собирается функциями AllRoles, AnyRole, AllScopes, AnyScope, And и Or
+type Rule struct {
+	check func(a *Auth, session *Session) bool
+	scope []string // Права, упомянутые в правиле. Попадают в параметр scope вызова insufficient_scope
+}
+
+// Правило: у сессии есть все перечисленные роли
+func AllRoles(roles ...string) Rule {
+	return Rule{check: func(a *Auth, session *Session) bool {
+		for _, role := range roles {
+			if !a.HasRole(session, role) {
+				return false
+			}
+		}
+		return true
+	}}
+}
+
+// Правило: у сессии есть хотя бы одна из перечисленных ролей
+func AnyRole(roles ...string) Rule {
+	return Rule{check: func(a *Auth, session *Session) bool {
+		return slices.ContainsFunc(roles, func(role string) bool {
+			return a.HasRole(session, role)
+		})
+	}}
+}
+
+// Правило: у сессии есть все перечисленные права
+func AllScopes(scopes ...string) Rule {
+	return Rule{scope: scopes, check: func(a *Auth, session *Session) bool {
+		for _, scope := range scopes {
+			if !session.HasScope(scope) {
+				return false
+			}
+		}
+		return true
+	}}
+}
+
+// Правило: у сессии есть хотя бы одно из перечисленных прав
+func AnyScope(scopes ...string) Rule {
+	return Rule{scope: scopes, check: func(a *Auth, session *Session) bool {
+		return slices.ContainsFunc(scopes, session.HasScope)
+	}}
+}
+
+// Правило: выполняются все правила
+func And(rules ...Rule) Rule {
+	return Rule{scope: collectScopes(rules), check: func(a *Auth, session *Session) bool {
+		for _, rule := range rules {
+			if !rule.allows(a, session) {
+				return false
+			}
+		}
+		return true
+	}}
+}
+
+// Правило: выполняется хотя бы одно из правил
+func Or(rules ...Rule) Rule {
+	return Rule{scope: collectScopes(rules), check: func(a *Auth, session *Session) bool {
+		for _, rule := range rules {
+			if rule.allows(a, session) {
+				return true
+			}
+		}
+		return false
+	}}
+}
+
+// Проверяет, пропускает ли правило сессию. Пустое правило пропускает любую сессию
+func (r *Rule) allows(a *Auth, session *Session) bool {
+	return r.check == nil || r.check(a, session)
+}
+
+// Собирает права из вложенных правил без повторов
+func collectScopes(rules []Rule) []string {
+	var scopes []string
+	for _, rule := range rules {
+		for _, scope := range rule.scope {
+			if !slices.Contains(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	return scopes
+}
+
+// Создаёт HTTP middleware, которое пропускает только сессии, удовлетворяющие правилу. Запросы без сессии получают
+// 401, как в RequireAuth, а сессии без нужных ролей или прав -- 403 с вызовом insufficient_scope. Принимает те же
+// опции, что и RequireAuth.
+//
+// Пример:
+//
+//	mux.Handle("/orders", auth.Authorize(knocknock.Or(knocknock.AllRoles("admin"), knocknock.AllScopes("orders:write")))(h))
+func (a *Auth) Authorize(rule Rule, requireAuthOptions ...RequireAuthOption) func(http.Handler) http.Handler {
+	return a.guard(&rule, requireAuthOptions)
+}
+
+// Создаёт HTTP middleware, которое пропускает только сессии со всеми перечисленными ролями. См. Authorize
+//
+// Пример:
+//
+//	mux.Handle("/admin/", auth.RequireRoles("admin")(adminHandler))
+func (a *Auth) RequireRoles(roles ...string) func(http.Handler) http.Handler {
+	return a.Authorize(AllRoles(roles...))
+}
+
+// Создаёт HTTP middleware, которое пропускает только сессии со всеми перечисленными правами. См. Authorize
+//
+// Пример:
+//
+//	mux.Handle("POST /orders", auth.RequireScopes("orders:write")(createOrder))
+func (a *Auth) RequireScopes(scopes ...string) func(http.Handler) http.Handler {
+	return a.Authorize(AllScopes(scopes...))
+}
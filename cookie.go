@@ -0,0 +1,187 @@
+package knocknock
+
+/*
+ * cookie.go содержит настройки cookie сессии и помощники входа и выхода. Login создаёт сессию и сразу ставит cookie,
+ * Logout удаляет сессию и стирает cookie, так что обработчикам не нужно собирать http.Cookie вручную.
+ *
+ * Настройки проверяются при создании Auth. Префиксы имён соблюдаются так же, как их проверяют браузеры: cookie
+ * с префиксом __Secure- требует Secure, а с префиксом __Host- ещё и Path "/" без Domain. SameSite=None и Partitioned
+ * тоже требуют Secure
+ */
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	hostCookiePrefix   = "__Host-"
+	secureCookiePrefix = "__Secure-"
+)
+
+// Функциональная опция для установки атрибута Domain cookie сессии
+func WithCookieDomain(domain string) AuthOption {
+	return func(o *AuthOptions) {
+		o.CookieDomain = domain
+	}
+}
+
+// Функциональная опция для установки атрибута Path cookie сессии
+func WithCookiePath(path string) AuthOption {
+	return func(o *AuthOptions) {
+		o.CookiePath = path
+	}
+}
+
+// Функциональная опция для атрибута Secure. По умолчанию Secure ставится всегда, в том числе когда TLS завершается на
+// прокси перед сервисом. WithCookieSecure(false) оставляет Secure только для запросов по TLS: это нужно лишь для
+// разработки по обычному HTTP на хосте, отличном от localhost
+func WithCookieSecure(secure bool) AuthOption {
+	return func(o *AuthOptions) {
+		o.CookieSecure = secure
+	}
+}
+
+// Функциональная опция для установки атрибута SameSite cookie сессии
+func WithCookieSameSite(sameSite http.SameSite) AuthOption {
+	return func(o *AuthOptions) {
+		o.CookieSameSite = sameSite
+	}
+}
+
+// Функциональная опция для установки атрибута Partitioned: cookie в стороннем контексте хранится отдельно для каждого
+// сайта верхнего уровня (CHIPS)
+func WithCookiePartitioned() AuthOption {
+	return func(o *AuthOptions) {
+		o.CookiePartitioned = true
+	}
+}
+
+// Функциональная опция, требующая cookie с префиксом __Host-: Secure, Path "/" и без Domain. Такую cookie нельзя
+// подменить с поддомена. Имя без префикса дополняется им при создании Auth.
+//
+// Пример:
+//
+//	auth := knocknock.HandleAuth(store, knocknock.WithHostPrefix()) // Cookie "__Host-session_token"
+func WithHostPrefix() AuthOption {
+	return func(o *AuthOptions) {
+		o.CookieHostPrefix = true
+		o.CookieSecure = true
+		o.CookiePath = "/"
+		o.CookieDomain = ""
+	}
+}
+
+// Дополняет имя cookie префиксом __Host-, если он затребован, и проверяет настройки cookie и ключ подписи.
+// Вызывается HandleAuth и UpdateAuthOptions, поэтому порядок WithHostPrefix и WithCookieName не важен
+func (o *AuthOptions) prepare() error {
+	if o.CookieHostPrefix && !strings.HasPrefix(o.CookieName, hostCookiePrefix) {
+		o.CookieName = hostCookiePrefix + o.CookieName
+	}
+	if err := o.Validate(); err != nil {
+		return err
+	}
+	return validateJWTKey(o.JWTKey)
+}
+
+// Сообщает о противоречивых настройках, с которыми Auth всё же работает (HandleAuth, UpdateAuthOptions)
+func (o *AuthOptions) warnInvalid(err error) {
+	logger := o.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger.Warn("knocknock: inconsistent auth options", slog.String("error", err.Error()))
+}
+
+// Проверяет, что настройки cookie сессии не противоречат друг другу и правилам браузеров. Возвращает ошибку,
+// оборачивающую InvalidCookieOptionsError
+func (o *AuthOptions) Validate() error {
+	if o.CookieHostPrefix && !strings.HasPrefix(o.CookieName, hostCookiePrefix) {
+		return fmt.Errorf("%w: cookie name must start with %s", InvalidCookieOptionsError, hostCookiePrefix)
+	}
+
+	cookie := &http.Cookie{Name: o.CookieName, Value: "x", Domain: o.CookieDomain, Path: o.CookiePath}
+	if err := cookie.Valid(); err != nil {
+		return fmt.Errorf("%w: %v", InvalidCookieOptionsError, err)
+	}
+	if !strings.HasPrefix(o.CookiePath, "/") {
+		return fmt.Errorf("%w: path must start with /", InvalidCookieOptionsError)
+	}
+
+	switch {
+	case strings.HasPrefix(o.CookieName, hostCookiePrefix):
+		if !o.CookieSecure || o.CookiePath != "/" || o.CookieDomain != "" {
+			return fmt.Errorf("%w: %s cookie requires Secure, Path \"/\" and no Domain", InvalidCookieOptionsError, hostCookiePrefix)
+		}
+	case strings.HasPrefix(o.CookieName, secureCookiePrefix):
+		if !o.CookieSecure {
+			return fmt.Errorf("%w: %s cookie requires Secure", InvalidCookieOptionsError, secureCookiePrefix)
+		}
+	}
+
+	if o.CookieSameSite == http.SameSiteNoneMode && !o.CookieSecure {
+		return fmt.Errorf("%w: SameSite=None requires Secure", InvalidCookieOptionsError)
+	}
+	if o.CookiePartitioned && !o.CookieSecure {
+		return fmt.Errorf("%w: Partitioned requires Secure", InvalidCookieOptionsError)
+	}
+	return nil
+}
+
+// Создаёт сессию и ставит её cookie. Прежняя сессия из cookie запроса, если она есть, удаляется: так сессия,
+// подброшенная до входа, не переживает его.
+//
+// Пример:
+//
+//	mux.HandleFunc("POST /login", func(w http.ResponseWriter, r *http.Request) {
+//	    user := checkPassword(r)
+//	    if _, err := auth.Login(w, r, user, knocknock.WithSubject(user.ID)); err != nil {
+//	        http.Error(w, "Failed to create session", http.StatusInternalServerError)
+//	    }
+//	})
+func (a *Auth) Login(w http.ResponseWriter, r *http.Request, userData UserData, sessionOptions ...SessionOption) (*Session, error) {
+	r = a.auditContext(r)
+	if previous := a.readSessionCookie(r); previous != "" {
+		if err := a.DeleteSession(r.Context(), previous); err != nil {
+			a.logStoreError(r.Context(), "failed to delete previous session", err)
+		}
+	}
+
+	session, err := a.CreateSession(r.Context(), userData, sessionOptions...)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.SetSessionCookie(w, r, session); err != nil {
+		return nil, err
+	}
+	skipReseal(w)
+	return session, nil
+}
+
+// Удаляет сессию запроса и стирает её cookie. Токен ищется там же, где его ищет Middleware. Запрос без сессии не
+// считается ошибкой: cookie стирается в любом случае
+func (a *Auth) Logout(w http.ResponseWriter, r *http.Request) error {
+	r = a.auditContext(r)
+	var err error
+	if token := a.extractToken(r); token != "" {
+		err = a.DeleteSession(r.Context(), token)
+	}
+	a.clearSessionCookie(w, r)
+	skipReseal(w)
+	return err
+}
+
+// Стирает cookie сессии и все её части
+func (a *Auth) clearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, a.sessionCookie(a.AuthOptions.CookieName, "", time.Unix(0, 0), r))
+	for i := 1; ; i++ {
+		name := cookieChunkName(a.AuthOptions.CookieName, i)
+		if _, err := r.Cookie(name); err != nil {
+			return
+		}
+		http.SetCookie(w, a.sessionCookie(name, "", time.Unix(0, 0), r))
+	}
+}
@@ -0,0 +1,298 @@
+package knocknock
+
+/*
+ * csrf.go содержит защиту от CSRF для запросов, авторизованных cookie. Браузер сам прикладывает cookie к запросам
+ * с чужих сайтов, поэтому небезопасные методы (POST, PUT, PATCH, DELETE) должны дополнительно нести CSRF-токен
+ * в заголовке X-CSRF-Token или поле формы csrf_token. Запросы с токеном в заголовке Authorization или query-параметре
+ * от CSRF не страдают и не проверяются: проверяются только токены, найденные CookieSource (см. source.go).
+ *
+ * Режимов два. Синхронизирующий токен (по умолчанию) хранится в сессии и выдаётся ей один раз: подходит для Store
+ * и CookieStore. Двойная отправка cookie (WithCSRFDoubleSubmit) хранит токен в отдельной cookie, доступной скриптам,
+ * и сверяет её с присланным значением: подходит для подписанных токенов (см. jwt.go), которые нельзя изменить.
+ *
+ * Токен двойной отправки подписан: "nonce.HMAC(ключ, nonce и токен сессии)". Одного совпадения cookie и присланного
+ * значения мало, ведь cookie может подбросить поддомен, родительский домен или посредник на обычном HTTP. Подделать
+ * подпись без ключа нельзя, а токен, выданный для другой сессии, не подходит. Cookie по возможности получает префикс
+ * __Host-, чтобы её нельзя было перезаписать с поддомена
+ */
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Структура настроек CSRF через функциональные опции
+type CSRFOptions struct {
+	DoubleSubmit   bool                // Сверять токен с cookie CookieName, а не с сессией
+	HeaderName     string              // Имя HTTP-заголовка с токеном
+	FieldName      string              // Имя поля формы с токеном
+	CookieName     string              // Имя cookie с токеном в режиме двойной отправки. При Secure дополняется префиксом __Host-
+	Key            []byte              // Ключ подписи токенов двойной отправки. nil -- случайный ключ для каждого CSRF
+	FailureHandler UnauthorizedHandler // Свой ответ на отказ. nil -- 403
+}
+
+type CSRFOption func(*CSRFOptions)
+
+// Функциональная опция для режима двойной отправки cookie
+func WithCSRFDoubleSubmit() CSRFOption {
+	return func(o *CSRFOptions) {
+		o.DoubleSubmit = true
+	}
+}
+
+// Функциональная опция для установки имени HTTP-заголовка с токеном
+func WithCSRFHeader(name string) CSRFOption {
+	return func(o *CSRFOptions) {
+		o.HeaderName = name
+	}
+}
+
+// Функциональная опция для установки имени поля формы с токеном
+func WithCSRFField(name string) CSRFOption {
+	return func(o *CSRFOptions) {
+		o.FieldName = name
+	}
+}
+
+// Функциональная опция для установки имени cookie с токеном в режиме двойной отправки
+func WithCSRFCookieName(name string) CSRFOption {
+	return func(o *CSRFOptions) {
+		o.CookieName = name
+	}
+}
+
+// Функциональная опция для установки ключа подписи токенов двойной отправки. Ключ должен быть случайным и длиной не
+// меньше 32 байт. Без него каждый CSRF создаёт свой ключ, и токены не переживают перезапуск и не подходят другим
+// экземплярам сервиса
+func WithCSRFKey(key []byte) CSRFOption {
+	return func(o *CSRFOptions) {
+		o.Key = key
+	}
+}
+
+// Функциональная опция для установки своего ответа на отказ. В обработчик передаётся CSRFTokenInvalidError
+func WithCSRFFailureHandler(handler UnauthorizedHandler) CSRFOption {
+	return func(o *CSRFOptions) {
+		o.FailureHandler = handler
+	}
+}
+
+// Создаёт и возвращает конфигурацию CSRF по умолчанию
+func defaultCSRFOptions() *CSRFOptions {
+	return &CSRFOptions{
+		HeaderName: "X-CSRF-Token",
+		FieldName:  "csrf_token",
+		CookieName: "csrf_token",
+	}
+}
+
+// Защита от CSRF
+type CSRF struct {
+	auth *Auth
+	opts *CSRFOptions
+}
+
+// Создаёт защиту от CSRF. Токен для форм и скриптов выдаёт CSRF.Token, проверяет его CSRF.Middleware.
+//
+// Пример:
+//
+//	csrf := auth.CSRF()
+//	handler := auth.Middleware()(csrf.Middleware()(mux))
+//
+//	mux.HandleFunc("GET /profile", func(w http.ResponseWriter, r *http.Request) {
+//	    token, r, err := csrf.Token(w, r)
+//	    // token -- в скрытое поле csrf_token формы
+//	})
+func (a *Auth) CSRF(csrfOptions ...CSRFOption) *CSRF {
+	opts := defaultCSRFOptions()
+	for _, opt := range csrfOptions {
+		opt(opts)
+	}
+	if len(opts.Key) == 0 {
+		opts.Key = make([]byte, 32)
+		rand.Read(opts.Key)
+	}
+	return &CSRF{a, opts}
+}
+
+// Имя cookie с токеном в режиме двойной отправки. Если cookie сессии всегда ставится с Secure, а у имени нет префикса,
+// оно дополняется префиксом __Host-: такую cookie браузер принимает только с Secure, Path "/" и без Domain
+func (c *CSRF) CookieName() string {
+	name := c.opts.CookieName
+	if c.auth.AuthOptions.CookieSecure && !strings.HasPrefix(name, hostCookiePrefix) && !strings.HasPrefix(name, secureCookiePrefix) {
+		return hostCookiePrefix + name
+	}
+	return name
+}
+
+// Возвращает CSRF-токен запроса и запрос, с которым стоит работать дальше. В синхронизирующем режиме токен берётся
+// из сессии в контексте (см. Auth.Middleware) и при первом обращении создаётся и сохраняется; сессия в контексте
+// исходного запроса при этом не меняется, копия с токеном кладётся в контекст возвращённого запроса. Без сессии
+// возвращается SessionNotFoundError, для подписанных токенов -- StoreUnsupportedError. В режиме двойной отправки
+// токен берётся из cookie, если он подписан для токена сессии запроса, а иначе выдаётся новый и cookie выставляется
+// в w. Поэтому после входа или смены токена сессии Token нужно вызвать снова
+func (c *CSRF) Token(w http.ResponseWriter, r *http.Request) (string, *http.Request, error) {
+	if c.opts.DoubleSubmit {
+		sessionToken, _, _ := c.auth.lookupToken(r)
+		if cookie, err := r.Cookie(c.CookieName()); err == nil && c.signed(cookie.Value, sessionToken) {
+			return cookie.Value, r, nil
+		}
+		nonce, err := generateToken(32)
+		if err != nil {
+			return "", r, err
+		}
+		token := nonce + "." + c.sign(nonce, sessionToken)
+		// SameSite, Secure и Partitioned те же, что у cookie сессии, но cookie доступна скриптам: они переносят токен
+		// в заголовок. Domain не ставится, а Path -- "/", чтобы подходил префикс __Host-
+		cookie := c.auth.sessionCookie(c.CookieName(), token, time.Time{}, r)
+		cookie.Domain = ""
+		cookie.Path = "/"
+		cookie.HttpOnly = false
+		http.SetCookie(w, cookie)
+		return token, r, nil
+	}
+
+	session := GetSession(r.Context())
+	if session == nil {
+		return "", r, SessionNotFoundError
+	}
+	if session.CSRFToken != "" {
+		return session.CSRFToken, r, nil
+	}
+
+	issued, err := c.auth.issueCSRFToken(r.Context(), session)
+	if err != nil {
+		return "", r, err
+	}
+	// В CookieStore токен попадёт в cookie, когда Middleware перезапечатает сессию
+	if sealing := findSealingWriter(w); sealing != nil {
+		sealing.session = issued
+	}
+	return issued.CSRFToken, r.WithContext(context.WithValue(r.Context(), SessionContextKey, issued)), nil
+}
+
+// Возвращает копию сессии с новым CSRF-токеном и сохраняет её. Сама session не меняется: её могут держать другие
+func (a *Auth) issueCSRFToken(ctx context.Context, session *Session) (*Session, error) {
+	if a.signedToken(session.Token) {
+		return nil, StoreUnsupportedError
+	}
+
+	token, err := generateToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	issued := *session
+	issued.CSRFToken = token
+	if a.cookieStore() == nil {
+		stored := issued
+		stored.Token = a.storeKey(session.Token)
+		if err := a.updateSession(ctx, &stored); err != nil {
+			return nil, err
+		}
+	}
+	return &issued, nil
+}
+
+// Создаёт HTTP middleware, которое отклоняет небезопасные запросы, авторизованные cookie, без верного CSRF-токена.
+// Ставится после Auth.Middleware, но работает и без него. Запросы без cookie сессии пропускаются
+func (c *CSRF) Middleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if safeMethod(r.Method) || !c.auth.cookieAuthenticated(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var expected string
+			if c.opts.DoubleSubmit {
+				// Cookie принимается, только если подпись сделана нашим ключом для токена сессии этого запроса
+				sessionToken, _, _ := c.auth.lookupToken(r)
+				if cookie, err := r.Cookie(c.CookieName()); err == nil && c.signed(cookie.Value, sessionToken) {
+					expected = cookie.Value
+				}
+			} else {
+				session, sessionRequest, err := c.auth.requestSession(r)
+				if err != nil {
+					// Без сессии защищать нечего: запрос дойдёт до обработчика анонимным
+					next.ServeHTTP(w, r)
+					return
+				}
+				r = sessionRequest
+				expected = session.CSRFToken
+			}
+
+			if !c.valid(expected, c.submitted(r)) {
+				c.auth.deny(r, "csrf", GetSession(r.Context()), CSRFTokenInvalidError)
+				c.fail(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Токен, присланный в заголовке или поле формы
+func (c *CSRF) submitted(r *http.Request) string {
+	if token := r.Header.Get(c.opts.HeaderName); token != "" {
+		return token
+	}
+	return r.PostFormValue(c.opts.FieldName)
+}
+
+// Сравнивает токены за постоянное время. Пустой ожидаемый токен не совпадает ни с чем
+func (c *CSRF) valid(expected, submitted string) bool {
+	return expected != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(submitted)) == 1
+}
+
+// Подпись nonce токена двойной отправки, привязанная к токену сессии. Пустой токен сессии -- токен выдан до входа
+func (c *CSRF) sign(nonce, sessionToken string) string {
+	mac := hmac.New(sha256.New, c.opts.Key)
+	mac.Write([]byte(nonce))
+	mac.Write([]byte{0})
+	mac.Write([]byte(sessionToken))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Подписан ли токен двойной отправки нашим ключом для токена сессии sessionToken
+func (c *CSRF) signed(token, sessionToken string) bool {
+	nonce, signature, ok := strings.Cut(token, ".")
+	if !ok || nonce == "" {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(c.sign(nonce, sessionToken)))
+}
+
+// Отвечает на запрос без верного CSRF-токена
+func (c *CSRF) fail(w http.ResponseWriter, r *http.Request) {
+	if c.opts.FailureHandler != nil {
+		c.opts.FailureHandler(w, r, CSRFTokenInvalidError)
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+}
+
+// Пришёл ли токен сессии из cookie (см. CookieSource). Токен из заголовка или query-параметра браузер сам не
+// подставит, такие запросы от CSRF не страдают
+func (a *Auth) cookieAuthenticated(r *http.Request) bool {
+	_, source, err := a.lookupToken(r)
+	_, cookie := source.(cookieSource)
+	return err == nil && cookie
+}
+
+// Безопасные методы по RFC 9110 не должны менять состояние и не проверяются
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
@@ -13,4 +13,37 @@ var (
 	SessionNotFoundError = errors.New("Session not found")
 	// Возвращается если данный токен уже занят
 	SessionExistsError = errors.New("Session with given token already exists")
+	// Возвращается, если у пользователя уже максимум сессий, а политика ограничения запрещает новые входы
+	SessionLimitExceededError = errors.New("Session limit exceeded")
+	// Возвращается, если переданный токен не является refresh-токеном
+	InvalidRefreshTokenError = errors.New("Token is not a refresh token")
+	// Возвращается при повторном использовании уже заменённого refresh-токена. Всё семейство токенов при этом отзывается
+	RefreshTokenReusedError = errors.New("Refresh token reuse detected")
+	// Возвращается, если хранилище не поддерживает необязательную возможность, нужную для операции
+	StoreUnsupportedError = errors.New("Store does not support this operation")
+	// Возвращается, если данные сессии не приводятся к запрошенному типу
+	UserDataTypeError = errors.New("Session user data has unexpected type")
+	// Передаётся в UnauthorizedHandler, если в запросе нет токена
+	TokenMissingError = errors.New("Request has no token")
+	// Передаётся в ForbiddenHandler, если сессии не хватает ролей или прав
+	InsufficientScopeError = errors.New("Session lacks required roles or scopes")
+	// Возвращается, если токен повреждён: не прошёл проверку формата (см. WithTokenGenerator) или подписи (см. WithJWT)
+	InvalidTokenError = errors.New("Token is malformed or its signature is invalid")
+	// Возвращается при попытке выдать токен ключом, который умеет только проверять подпись
+	JWTSigningUnsupportedError = errors.New("Key can only verify token signatures")
+	// Возвращается, если токен не помещается в допустимое число cookie (см. CookieStore)
+	CookieTooLargeError = errors.New("Session does not fit into cookies")
+	// Возвращается FileStore, если лог повреждён не в последней записи и восстановить его автоматически нельзя
+	FileStoreCorruptedError = errors.New("File store log is corrupted")
+	// Передаётся в обработчик отказа CSRF, если CSRF-токена в запросе нет или он не совпадает
+	CSRFTokenInvalidError = errors.New("CSRF token is missing or invalid")
+	// Возвращается AuthOptions.Validate, если настройки cookie сессии противоречат друг другу
+	InvalidCookieOptionsError = errors.New("Invalid session cookie options")
+	// Передаётся в UnauthorizedHandler, если в строгом режиме (см. WithStrictTokenSources) запрос несёт разные токены
+	// из нескольких источников
+	TokenConflictError = errors.New("Request has conflicting tokens")
+	// Возвращается VerifyAuditLog и HandleAuditLog, если цепочка хешей журнала аудита нарушена
+	AuditChainBrokenError = errors.New("Audit log hash chain is broken")
+	// Возвращается HandleCheckedAuth и UpdateCheckedAuthOptions, если секрет HS256 короче 32 байт
+	WeakJWTKeyError = errors.New("JWT signing key is too short")
 )
@@ -9,7 +9,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"time"
 
 	"github.com/tolstovrob/knocknock"
 )
@@ -21,12 +20,12 @@ type User struct {
 }
 
 var (
-	auth *knocknock.Auth
+	auth *knocknock.TypedAuth[User]
 )
 
 func main() {
 	store := knocknock.HandleMemoryStore()
-	auth = knocknock.HandleAuth(store)
+	auth = knocknock.HandleTypedAuth[User](store)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/login", loginHandler)
@@ -51,20 +50,12 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		Email:    "test@example.com",
 	}
 
-	session, err := auth.CreateSession(r.Context(), user)
+	session, err := auth.Login(w, r, user)
 	if err != nil {
 		http.Error(w, "Failed to create session", http.StatusInternalServerError)
 		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     auth.AuthOptions.CookieName,
-		Value:    session.Token,
-		Expires:  session.ExpiresAt,
-		HttpOnly: true,
-		Path:     "/",
-	})
-
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "Logged in successfully. Token: %s. Do not tell anyone", session.Token)
 }
@@ -75,36 +66,22 @@ func logoutHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	session := knocknock.GetSession(r.Context())
-	if session != nil {
-		auth.DeleteSession(r.Context(), session.Token)
+	if err := auth.Logout(w, r); err != nil {
+		http.Error(w, "Failed to delete session", http.StatusInternalServerError)
+		return
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     auth.AuthOptions.CookieName,
-		Value:    "",
-		Expires:  time.Now().Add(-1 * time.Hour),
-		HttpOnly: true,
-		Path:     "/",
-	})
-
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "Logged out successfully")
 }
 
 func profileHandler(w http.ResponseWriter, r *http.Request) {
-	session := knocknock.GetSession(r.Context())
+	session := knocknock.GetSessionAs[User](r.Context())
 	if session == nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	user, ok := session.UserData.(User)
-	if !ok {
-		http.Error(w, "Invalid session data", http.StatusInternalServerError)
-		return
-	}
-
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(user)
+	json.NewEncoder(w).Encode(session.UserData)
 }
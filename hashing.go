@@ -0,0 +1,105 @@
+package knocknock
+
+/*
+ * hashing.go содержит хранение токенов в виде HMAC-SHA256. В этом режиме хранилище видит только хеш токена: он
+ * служит ключом сессии (Session.Token) и ссылкой в Pair и ReplacedBy. Исходный токен возвращается вызывающему коду
+ * один раз, из CreateSession или CreateSessionPair, и больше нигде не сохраняется, поэтому дамп хранилища не позволяет
+ * войти под чужой сессией.
+ *
+ * Ключ HMAC можно ротировать: сессии, созданные под предыдущим ключом, принимаются до конца льготного периода, а новые
+ * создаются под текущим. Сессии не перехешируются: по истечении льготного периода старые сессии просто перестают
+ * находиться, поэтому льготный период стоит делать не короче времени жизни сессий
+ */
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Функциональная опция для включения хеширования токенов ключом key. Ключ должен быть случайным и длиной не меньше
+// 32 байт. Сессии, созданные до включения режима, перестают находиться.
+//
+// Пример:
+//
+//	auth := knocknock.HandleAuth(store, knocknock.WithTokenHashing(key))
+func WithTokenHashing(key []byte) AuthOption {
+	return func(o *AuthOptions) {
+		o.TokenHashKey = string(key)
+	}
+}
+
+// Функциональная опция для ротации ключа HMAC: новые сессии хешируются ключом key, а сессии, созданные под ключом
+// previous, принимаются ещё grace от момента применения опции.
+//
+// Пример:
+//
+//	auth.UpdateAuthOptions(knocknock.WithTokenHashKeyRotation(newKey, oldKey, 24*time.Hour))
+func WithTokenHashKeyRotation(key, previous []byte, grace time.Duration) AuthOption {
+	return func(o *AuthOptions) {
+		o.TokenHashKey = string(key)
+		o.PreviousTokenHashKey = string(previous)
+		o.PreviousKeyExpiresAt = time.Now().Add(grace)
+	}
+}
+
+// Возвращает ключ, под которым сессия с данным токеном хранится в Store. Без хеширования это сам токен, а для токена
+// "селектор.верификатор" -- селектор
+func (a *Auth) storeKey(token string) string {
+	selector, _, _ := strings.Cut(token, ".")
+	if a.AuthOptions.TokenHashKey == "" {
+		return selector
+	}
+	return hashToken(a.AuthOptions.TokenHashKey, selector)
+}
+
+// Ищет сохранённую сессию по исходному токену и сверяет верификатор. В течение льготного периода после ротации
+// пробует и предыдущий ключ. Служебные записи (список отозванных токенов, отметки о ротации) лежат в том же
+// хранилище, поэтому токен с их префиксом отвергается без обращения к хранилищу, а найденная служебная запись
+// сессией не считается
+func (a *Auth) findSession(ctx context.Context, token string) (*Session, error) {
+	if strings.HasPrefix(token, revokedKeyPrefix) || strings.HasPrefix(token, rotatedKeyPrefix) {
+		return nil, SessionNotFoundError
+	}
+
+	session, err := a.store.Get(ctx, a.storeKey(token))
+	if errors.Is(err, SessionNotFoundError) && a.previousKeyValid() {
+		selector, _, _ := strings.Cut(token, ".")
+		session, err = a.store.Get(ctx, hashToken(a.AuthOptions.PreviousTokenHashKey, selector))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if session.Kind == SessionKindRevoked || !verifyToken(session, token) {
+		return nil, SessionNotFoundError
+	}
+	return session, nil
+}
+
+// Возвращает копию сохранённой сессии с исходным токеном вместо хеша
+func (a *Auth) withToken(session *Session, token string) *Session {
+	if session.Token == token {
+		return session
+	}
+	restored := *session
+	restored.Token = token
+	return &restored
+}
+
+// Принимаются ли ещё сессии, созданные под предыдущим ключом HMAC
+func (a *Auth) previousKeyValid() bool {
+	return a.AuthOptions.TokenHashKey != "" && a.AuthOptions.PreviousTokenHashKey != "" &&
+		time.Now().Before(a.AuthOptions.PreviousKeyExpiresAt)
+}
+
+// Вычисляет HMAC-SHA256 токена
+func hashToken(key, token string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
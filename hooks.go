@@ -0,0 +1,176 @@
+package knocknock
+
+/*
+ * hooks.go содержит обработчики событий жизненного цикла сессий и поток событий поверх них. Обработчики (OnCreate,
+ * OnAccess, OnExpire, OnDelete, OnRefresh) вызываются синхронно в той же горутине, что и метод Auth, поэтому долгую
+ * работу (письма, аналитику) стоит уносить в свою горутину или читать события через Subscribe.
+ *
+ * Истечение замечается лениво: в GetSession и Refresh, когда протухшая сессия попадается на глаза, и в фоне, если
+ * хранилище реализует ExpiryNotifier (MemoryStore сообщает об удалённых в Cleanup). Подписку на хранилище снимает
+ * Auth.Close
+ */
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Вид события жизненного цикла сессии
+type EventKind string
+
+const (
+	EventCreate  EventKind = "create"  // Сессия создана: CreateSession, Login, CreateSessionPair, Refresh, RegenerateSession
+	EventAccess  EventKind = "access"  // Сессия найдена по токену в GetSession
+	EventExpire  EventKind = "expire"  // Обнаружена протухшая сессия или refresh-токен. Для подписанных токенов не возникает
+	EventDelete  EventKind = "delete"  // Сессия удалена: DeleteSession, Logout, RevokeAllSessions, вытеснение по лимиту
+	EventRefresh EventKind = "refresh" // Пара ротирована в Refresh. Session -- новая сессия
+)
+
+// Событие жизненного цикла сессии. Session.Token -- сам токен, если он известен. Для сессий, удалённых хранилищем
+// в фоне, это ключ в хранилище (при WithTokenHashing -- хеш). Сессию менять нельзя
+type Event struct {
+	Kind    EventKind
+	Session *Session
+	Time    time.Time
+}
+
+// Обработчик события жизненного цикла сессии
+type SessionHook func(ctx context.Context, session *Session)
+
+// Зарегистрированные обработчики и подписчики
+type hooks struct {
+	mu          sync.RWMutex
+	handlers    map[EventKind][]SessionHook
+	subscribers map[chan Event]struct{}
+}
+
+func newHooks() *hooks {
+	return &hooks{
+		handlers:    make(map[EventKind][]SessionHook),
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+// Регистрирует обработчик создания сессии.
+//
+// Пример:
+//
+//	auth.OnCreate(func(ctx context.Context, session *knocknock.Session) {
+//	    go sendWelcomeEmail(session.Subject)
+//	})
+func (a *Auth) OnCreate(hook SessionHook) {
+	a.on(EventCreate, hook)
+}
+
+// Регистрирует обработчик обращения к сессии. Вызывается на каждый успешный GetSession, то есть на каждый
+// авторизованный запрос
+func (a *Auth) OnAccess(hook SessionHook) {
+	a.on(EventAccess, hook)
+}
+
+// Регистрирует обработчик истечения сессии. Истёкшие подписанные токены (см. jwt.go) его не вызывают: их нельзя
+// удалить, и событие повторялось бы на каждый запрос со старым токеном
+func (a *Auth) OnExpire(hook SessionHook) {
+	a.on(EventExpire, hook)
+}
+
+// Регистрирует обработчик удаления сессии
+func (a *Auth) OnDelete(hook SessionHook) {
+	a.on(EventDelete, hook)
+}
+
+// Регистрирует обработчик ротации пары в Refresh. В обработчик передаётся новая сессия
+func (a *Auth) OnRefresh(hook SessionHook) {
+	a.on(EventRefresh, hook)
+}
+
+func (a *Auth) on(kind EventKind, hook SessionHook) {
+	a.hooks.mu.Lock()
+	defer a.hooks.mu.Unlock()
+
+	a.hooks.handlers[kind] = append(a.hooks.handlers[kind], hook)
+}
+
+// Подписывается на все события. Канал буферизован на buffer событий; если подписчик не успевает их читать, новые
+// события для него отбрасываются, а Auth не блокируется. Функция отписки закрывает канал.
+//
+// Пример:
+//
+//	events, unsubscribe := auth.Subscribe(64)
+//	defer unsubscribe()
+//	for event := range events {
+//	    analytics.Track(string(event.Kind), event.Session.Subject)
+//	}
+func (a *Auth) Subscribe(buffer int) (<-chan Event, func()) {
+	events := make(chan Event, buffer)
+
+	a.hooks.mu.Lock()
+	a.hooks.subscribers[events] = struct{}{}
+	a.hooks.mu.Unlock()
+
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			a.hooks.mu.Lock()
+			defer a.hooks.mu.Unlock()
+
+			delete(a.hooks.subscribers, events)
+			close(events)
+		})
+	}
+}
+
+// Вызывает обработчики события, рассылает его подписчикам и пишет в журнал аудита. Session.Token -- сам токен
+func (a *Auth) emit(ctx context.Context, kind EventKind, session *Session) {
+	a.notify(ctx, kind, session)
+	if action, ok := auditActions[kind]; ok {
+		a.audit(ctx, action, session, a.tokenFingerprint(session.Token))
+	}
+}
+
+// То же, что emit, для сессии, прочитанной из хранилища: Session.Token -- ключ в хранилище, а не токен
+func (a *Auth) emitStored(ctx context.Context, kind EventKind, session *Session) {
+	a.notify(ctx, kind, session)
+	if action, ok := auditActions[kind]; ok {
+		a.audit(ctx, action, session, keyFingerprint(session.Token))
+	}
+}
+
+// События, которые попадают в журнал аудита. Обращения к сессии не пишутся: их столько же, сколько запросов
+var auditActions = map[EventKind]AuditAction{
+	EventCreate: AuditSessionCreate,
+	EventExpire: AuditSessionExpire,
+	EventDelete: AuditSessionRevoke,
+}
+
+// Вызывает обработчики события и рассылает его подписчикам. Истечение заодно пишется в лог
+func (a *Auth) notify(ctx context.Context, kind EventKind, session *Session) {
+	if kind == EventExpire {
+		a.logger().LogAttrs(ctx, slog.LevelInfo, "knocknock: session expired", slog.Any("session", session))
+	}
+
+	// Обработчики вызываются без блокировки, чтобы они могли регистрировать новые
+	a.hooks.mu.RLock()
+	handlers := a.hooks.handlers[kind]
+	a.hooks.mu.RUnlock()
+
+	for _, hook := range handlers {
+		hook(ctx, session)
+	}
+
+	a.hooks.mu.RLock()
+	defer a.hooks.mu.RUnlock()
+
+	if len(a.hooks.subscribers) == 0 {
+		return
+	}
+	event := Event{Kind: kind, Session: session, Time: time.Now()}
+	for events := range a.hooks.subscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
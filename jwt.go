@@ -0,0 +1,324 @@
+package knocknock
+
+/*
+ * jwt.go содержит режим самодостаточных подписанных токенов, совместимых с JWT (RFC 7519). Сессия целиком лежит в
+ * claims токена: jti -- идентификатор, sub -- Session.Subject, iat и exp -- CreatedAt и ExpiresAt (с точностью до
+ * секунды), roles и scope -- Roles и Scopes, data -- UserData. GetSession проверяет подпись и срок без чтения сессии из хранилища.
+ *
+ * Store служит только списком отозванных токенов: DeleteSession кладёт в него запись с ключом "revoked:<jti>" и
+ * сроком жизни до exp токена, а GetSession проверяет, нет ли такой записи. Найти, а значит и удалить, такую запись по
+ * токену из запроса нельзя (см. findSession). Подписи делаются только стандартной библиотекой: HS256, EdDSA (Ed25519)
+ * и ES256 (ECDSA P-256)
+ */
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Префикс ключей списка отозванных токенов в хранилище
+const revokedKeyPrefix = "revoked:"
+
+// Интерфейс ключа подписи. Встроенные реализации создаются HS256Key, EdDSAKey, ES256Key и их вариантами с открытым
+// ключом, которые умеют только проверять подпись
+type JWTKey interface {
+	Algorithm() string                          // Значение alg в заголовке токена
+	Sign(signingInput []byte) ([]byte, error)   // Подписывает "заголовок.claims"
+	Verify(signingInput, signature []byte) bool // Проверяет подпись
+}
+
+// Функциональная опция для выдачи подписанных токенов вместо хранимых сессий. Скользящее истечение, лимиты сессий и
+// RevokeAllSessions к таким токенам не применяются: они не хранятся и не индексируются. Refresh-токены из
+// CreateSessionPair по-прежнему хранятся в Store.
+//
+// Пример:
+//
+//	auth := knocknock.HandleAuth(store, knocknock.WithJWT(knocknock.EdDSAKey(privateKey)))
+func WithJWT(key JWTKey) AuthOption {
+	return func(o *AuthOptions) {
+		o.JWTKey = key
+	}
+}
+
+type hs256Key struct{ secret []byte }
+
+// Наименьшая длина секрета HS256: короче выхода SHA-256 секрет подбирается проще подписи
+const minHS256SecretSize = 32
+
+// Ключ HS256 (HMAC-SHA256) с общим секретом длиной не меньше 32 байт. Более короткий секрет HandleCheckedAuth
+// отклоняет с WeakJWTKeyError, а HandleAuth принимает с предупреждением в лог
+func HS256Key(secret []byte) JWTKey {
+	return &hs256Key{secret}
+}
+
+// Проверяет встроенные ключи подписи. Свои реализации JWTKey проверяют себя сами
+func validateJWTKey(key JWTKey) error {
+	if k, ok := key.(*hs256Key); ok && len(k.secret) < minHS256SecretSize {
+		return fmt.Errorf("%w: HS256 secret is %d bytes, need at least %d", WeakJWTKeyError, len(k.secret), minHS256SecretSize)
+	}
+	return nil
+}
+
+func (k *hs256Key) Algorithm() string { return "HS256" }
+
+func (k *hs256Key) Sign(signingInput []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write(signingInput)
+	return mac.Sum(nil), nil
+}
+
+func (k *hs256Key) Verify(signingInput, signature []byte) bool {
+	expected, _ := k.Sign(signingInput)
+	return hmac.Equal(expected, signature)
+}
+
+type eddsaKey struct {
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+// Ключ EdDSA (Ed25519) для подписи и проверки
+func EdDSAKey(private ed25519.PrivateKey) JWTKey {
+	return &eddsaKey{private, private.Public().(ed25519.PublicKey)}
+}
+
+// Ключ EdDSA (Ed25519), который только проверяет подпись
+func EdDSAPublicKey(public ed25519.PublicKey) JWTKey {
+	return &eddsaKey{nil, public}
+}
+
+func (k *eddsaKey) Algorithm() string { return "EdDSA" }
+
+func (k *eddsaKey) Sign(signingInput []byte) ([]byte, error) {
+	if k.private == nil {
+		return nil, JWTSigningUnsupportedError
+	}
+	return ed25519.Sign(k.private, signingInput), nil
+}
+
+func (k *eddsaKey) Verify(signingInput, signature []byte) bool {
+	return len(k.public) == ed25519.PublicKeySize && ed25519.Verify(k.public, signingInput, signature)
+}
+
+type es256Key struct {
+	private *ecdsa.PrivateKey
+	public  *ecdsa.PublicKey
+}
+
+// Ключ ES256 (ECDSA P-256 с SHA-256) для подписи и проверки
+func ES256Key(private *ecdsa.PrivateKey) JWTKey {
+	return &es256Key{private, &private.PublicKey}
+}
+
+// Ключ ES256 (ECDSA P-256 с SHA-256), который только проверяет подпись
+func ES256PublicKey(public *ecdsa.PublicKey) JWTKey {
+	return &es256Key{nil, public}
+}
+
+func (k *es256Key) Algorithm() string { return "ES256" }
+
+// Подпись в формате JWS: r и s по 32 байта big-endian, а не ASN.1
+func (k *es256Key) Sign(signingInput []byte) ([]byte, error) {
+	if k.private == nil || k.private.Curve != elliptic.P256() {
+		return nil, JWTSigningUnsupportedError
+	}
+
+	digest := sha256.Sum256(signingInput)
+	r, s, err := ecdsa.Sign(rand.Reader, k.private, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signature, nil
+}
+
+func (k *es256Key) Verify(signingInput, signature []byte) bool {
+	if k.public == nil || k.public.Curve != elliptic.P256() || len(signature) != 64 {
+		return false
+	}
+	digest := sha256.Sum256(signingInput)
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	return ecdsa.Verify(k.public, digest[:], r, s)
+}
+
+// Заголовок токена
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+}
+
+// Claims токена. Повторяют поля Session
+type jwtClaims struct {
+	ID        string   `json:"jti"`
+	Subject   string   `json:"sub,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+	Scope     string   `json:"scope,omitempty"` // Права через пробел, как в RFC 8693
+	IssuedAt  int64    `json:"iat"`
+	ExpiresAt int64    `json:"exp"`
+	UserData  UserData `json:"data"`
+}
+
+// Создаёт сессию с подписанным токеном. В хранилище ничего не пишется
+func (a *Auth) newSignedSession(userData UserData, expiresIn time.Duration, sessionOptions []SessionOption) (*Session, error) {
+	id, err := generateToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	session := MakeSession("", userData, expiresIn)
+	session.CreatedAt = session.CreatedAt.Truncate(time.Second)
+	session.ExpiresAt = session.ExpiresAt.Truncate(time.Second)
+	for _, opt := range sessionOptions {
+		opt(session)
+	}
+
+	header, err := json.Marshal(jwtHeader{a.AuthOptions.JWTKey.Algorithm(), "JWT"})
+	if err != nil {
+		return nil, err
+	}
+	claims, err := json.Marshal(jwtClaims{
+		ID:        id,
+		Subject:   session.Subject,
+		Roles:     session.Roles,
+		Scope:     strings.Join(session.Scopes, " "),
+		IssuedAt:  session.CreatedAt.Unix(),
+		ExpiresAt: session.ExpiresAt.Unix(),
+		UserData:  session.UserData,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	signature, err := a.AuthOptions.JWTKey.Sign([]byte(signingInput))
+	if err != nil {
+		return nil, err
+	}
+
+	session.Token = signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+	return session, nil
+}
+
+// Проверяет подписанный токен и восстанавливает из него сессию. Хранилище читается только для проверки по списку
+// отозванных токенов. Истёкший токен не порождает EventExpire: удалить его нельзя, и клиент, повторяющий запрос
+// со старым токеном, иначе засыпал бы подписчиков и журнал аудита одинаковыми событиями
+func (a *Auth) getSignedSession(ctx context.Context, token string) (*Session, error) {
+	claims, err := a.parseSignedToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	session := claims.session(token)
+	if session.IsExpired() {
+		return nil, SessionExpiredError
+	}
+
+	_, err = a.store.Get(ctx, revokedKeyPrefix+claims.ID)
+	if err == nil {
+		return nil, SessionNotFoundError
+	}
+	if !errors.Is(err, SessionNotFoundError) {
+		return nil, err
+	}
+	return session, nil
+}
+
+// Отзывает подписанный токен: заносит его jti в список отозванных до истечения токена
+func (a *Auth) revokeSignedSession(ctx context.Context, token string) error {
+	claims, err := a.parseSignedToken(token)
+	if err != nil {
+		return err
+	}
+
+	err = a.saveRevocation(ctx, claims)
+	if errors.Is(err, SessionExistsError) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	a.emit(ctx, EventDelete, claims.session(token))
+	return nil
+}
+
+// Восстанавливает сессию из утверждений токена
+func (c *jwtClaims) session(token string) *Session {
+	return &Session{
+		Token:     token,
+		UserData:  c.UserData,
+		Subject:   c.Subject,
+		Roles:     c.Roles,
+		Scopes:    strings.Fields(c.Scope),
+		CreatedAt: time.Unix(c.IssuedAt, 0),
+		ExpiresAt: time.Unix(c.ExpiresAt, 0),
+	}
+}
+
+// Заносит токен в список отозванных. Если он уже там, возвращает SessionExistsError
+func (a *Auth) saveRevocation(ctx context.Context, claims *jwtClaims) error {
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+	if time.Now().After(expiresAt) {
+		return nil
+	}
+
+	return a.store.Save(ctx, &Session{
+		Token:     revokedKeyPrefix + claims.ID,
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+		Kind:      SessionKindRevoked,
+	})
+}
+
+// Разбирает токен и проверяет подпись. Алгоритм из заголовка должен совпадать с алгоритмом ключа, поэтому подмена
+// на "none" или на HS256 с открытым ключом в качестве секрета не пройдёт
+func (a *Auth) parseSignedToken(token string) (*jwtClaims, error) {
+	headerPart, rest, _ := strings.Cut(token, ".")
+	claimsPart, signaturePart, _ := strings.Cut(rest, ".")
+
+	var header jwtHeader
+	if err := decodeSegment(headerPart, &header); err != nil || header.Algorithm != a.AuthOptions.JWTKey.Algorithm() {
+		return nil, InvalidTokenError
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(signaturePart)
+	if err != nil || !a.AuthOptions.JWTKey.Verify([]byte(headerPart+"."+claimsPart), signature) {
+		return nil, InvalidTokenError
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(claimsPart, &claims); err != nil || claims.ID == "" {
+		return nil, InvalidTokenError
+	}
+	return &claims, nil
+}
+
+// Является ли токен подписанным в режиме WithJWT. Токен JWT состоит из трёх частей через точку, а токены
+// "селектор.верификатор" -- из двух
+func (a *Auth) signedToken(token string) bool {
+	return a.AuthOptions.JWTKey != nil && strings.Count(token, ".") == 2
+}
+
+// Раскодирует часть токена из base64url и JSON
+func decodeSegment(segment string, v any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
@@ -0,0 +1,97 @@
+package knocknock
+
+/*
+ * limits.go содержит ограничение числа одновременных сессий одного пользователя (Session.Subject). Ограничение
+ * проверяется в Auth.CreateSession и при выдаче пар, поэтому хранилище должно реализовывать SubjectIndexer.
+ *
+ * Проверка не атомарна относительно хранилища: при одновременных входах одного пользователя лимит может быть ненадолго
+ * превышен. Следующий вход приведёт число сессий обратно к лимиту
+ */
+
+import (
+	"context"
+	"slices"
+	"time"
+)
+
+// Политика, применяемая, когда у пользователя уже SessionLimit активных сессий
+type SessionLimitPolicy int
+
+const (
+	SessionLimitReject      SessionLimitPolicy = iota // Отклонить новый вход с SessionLimitExceededError
+	SessionLimitEvictOldest                           // Удалить самую старую сессию по CreatedAt
+	SessionLimitEvictLRU                              // Удалить сессию, к которой дольше всего не обращались
+)
+
+// Функциональная опция для ограничения числа активных сессий пользователя. Сессии без Subject не ограничиваются.
+// Для SessionLimitEvictLRU время последнего обращения обновляется не чаще раза в TouchInterval (см. WithTouchInterval)
+//
+// Пример:
+//
+//	auth := knocknock.HandleAuth(store, knocknock.WithSessionLimit(5, knocknock.SessionLimitEvictOldest))
+func WithSessionLimit(limit int, policy SessionLimitPolicy) AuthOption {
+	return func(o *AuthOptions) {
+		o.SessionLimit = limit
+		o.LimitPolicy = policy
+	}
+}
+
+// Освобождает место под новую сессию пользователя согласно LimitPolicy или возвращает SessionLimitExceededError
+func (a *Auth) enforceSessionLimit(ctx context.Context, session *Session) error {
+	limit := a.AuthOptions.SessionLimit
+	if limit <= 0 || session.Subject == "" {
+		return nil
+	}
+
+	all, err := a.listBySubject(ctx, session.Subject)
+	if err != nil {
+		return err
+	}
+
+	active := make([]*Session, 0, len(all))
+	for _, s := range all {
+		if s.Kind == SessionKindAccess && !s.IsExpired() {
+			active = append(active, s)
+		}
+	}
+
+	excess := len(active) - limit + 1
+	if excess <= 0 {
+		return nil
+	}
+	if a.AuthOptions.LimitPolicy == SessionLimitReject {
+		return SessionLimitExceededError
+	}
+
+	slices.SortFunc(active, func(x, y *Session) int {
+		return a.evictionTime(x).Compare(a.evictionTime(y))
+	})
+
+	evicted := make(map[string]struct{}, excess)
+	for _, s := range active[:excess] {
+		if err := a.store.Delete(ctx, s.Token); err != nil {
+			return err
+		}
+		evicted[s.Token] = struct{}{}
+		a.emitStored(ctx, EventDelete, s)
+	}
+
+	// Refresh-токены вытесненных сессий отзываются вместе с ними, иначе по ним можно было бы войти снова в обход лимита
+	for _, s := range all {
+		if _, ok := evicted[s.Pair]; ok && s.Kind == SessionKindRefresh {
+			if err := a.store.Delete(ctx, s.Token); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Момент, по которому сессии упорядочиваются при вытеснении. Сессия, к которой ещё не обращались, считается
+// использованной в момент создания
+func (a *Auth) evictionTime(session *Session) time.Time {
+	if a.AuthOptions.LimitPolicy == SessionLimitEvictLRU && session.LastAccessedAt.After(session.CreatedAt) {
+		return session.LastAccessedAt
+	}
+	return session.CreatedAt
+}
@@ -0,0 +1,132 @@
+package knocknock
+
+/*
+ * log.go содержит интеграцию с log/slog. Сессия реализует slog.LogValuer и fmt.Formatter, поэтому токены (сам токен,
+ * Pair, ReplacedBy, Verifier и CSRF-токен) в логах и fmt-выводе всегда замаскированы: видно только несколько первых
+ * символов. Данные пользователя (UserData) в slog не пишутся вовсе: в них бывают персональные данные.
+ *
+ * С WithLogger Auth пишет в лог, почему запрос остался без сессии, истечения сессий и ошибки хранилища, которые он
+ * проглатывает, чтобы не ломать запрос (например, неудачное удаление протухшей сессии). Без WithLogger Auth молчит
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// Необязательная возможность хранилища: писать в лог ошибки своей фоновой работы. HandleAuth и UpdateAuthOptions
+// передают хранилищу логгер из WithLogger. Реализуется FileStore (ошибки фонового сжатия лога)
+type LogReceiver interface {
+	SetLogger(logger *slog.Logger)
+}
+
+// Функциональная опция для установки логгера. Auth пишет:
+//   - Info: истечение сессии, запрос с токеном неизвестной сессии;
+//   - Warn: повреждённый токен или конфликт источников токена (см. WithStrictTokenSources);
+//   - Error: ошибки хранилища.
+//
+// Пример:
+//
+//	logger := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+//	auth := knocknock.HandleAuth(store, knocknock.WithLogger(logger))
+func WithLogger(logger *slog.Logger) AuthOption {
+	return func(o *AuthOptions) {
+		o.Logger = logger
+	}
+}
+
+// Логгер, которым Auth пишет в лог. Без WithLogger записи отбрасываются
+func (a *Auth) logger() *slog.Logger {
+	if a.AuthOptions.Logger != nil {
+		return a.AuthOptions.Logger
+	}
+	return discardLogger
+}
+
+var discardLogger = slog.New(slog.DiscardHandler)
+
+// Передаёт логгер хранилищу, если оно умеет его принять
+func (a *Auth) shareLogger() {
+	if receiver, ok := storeAs[LogReceiver](a.store); ok && a.AuthOptions.Logger != nil {
+		receiver.SetLogger(a.AuthOptions.Logger)
+	}
+}
+
+// Пишет в лог, почему токен запроса не дал сессии
+func (a *Auth) logRejected(r *http.Request, token string, err error) {
+	level := slog.LevelError
+	switch {
+	case errors.Is(err, SessionExpiredError):
+		level = slog.LevelDebug // Само истечение уже записано с уровнем Info
+	case errors.Is(err, SessionNotFoundError):
+		level = slog.LevelInfo
+	case errors.Is(err, InvalidTokenError), errors.Is(err, TokenConflictError):
+		level = slog.LevelWarn
+	}
+
+	a.logger().LogAttrs(r.Context(), level, "knocknock: request token rejected",
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.String("token", redactToken(token)),
+		slog.String("reason", err.Error()),
+	)
+}
+
+// Пишет в лог ошибку хранилища, которую Auth не возвращает вызывающему коду
+func (a *Auth) logStoreError(ctx context.Context, msg string, err error) {
+	a.logger().LogAttrs(ctx, slog.LevelError, "knocknock: "+msg, slog.String("error", err.Error()))
+}
+
+// Маскирует токен: оставляет первые 6 символов. Короткие значения скрываются целиком
+func redactToken(token string) string {
+	const visible = 6
+	switch {
+	case token == "":
+		return ""
+	case len(token) < 2*visible:
+		return "****"
+	}
+	return token[:visible] + "****"
+}
+
+// Копия сессии с замаскированными токенами
+func (s TypedSession[T]) redacted() TypedSession[T] {
+	s.Token = redactToken(s.Token)
+	s.Pair = redactToken(s.Pair)
+	s.ReplacedBy = redactToken(s.ReplacedBy)
+	s.Verifier = redactToken(s.Verifier)
+	s.CSRFToken = redactToken(s.CSRFToken)
+	return s
+}
+
+// Представление сессии для log/slog: замаскированный токен, пользователь, вид, роли, права и сроки. UserData не
+// пишется
+func (s TypedSession[T]) LogValue() slog.Value {
+	attrs := []slog.Attr{slog.String("token", redactToken(s.Token))}
+	if s.Subject != "" {
+		attrs = append(attrs, slog.String("subject", s.Subject))
+	}
+	if s.Kind != SessionKindAccess {
+		attrs = append(attrs, slog.String("kind", string(s.Kind)))
+	}
+	if len(s.Roles) > 0 {
+		attrs = append(attrs, slog.Any("roles", s.Roles))
+	}
+	if len(s.Scopes) > 0 {
+		attrs = append(attrs, slog.Any("scopes", s.Scopes))
+	}
+	attrs = append(attrs, slog.Time("createdAt", s.CreatedAt), slog.Time("expiresAt", s.ExpiresAt))
+	return slog.GroupValue(attrs...)
+}
+
+// Тот же набор полей без методов, чтобы Format не вызывал сам себя
+type plainSession[T any] TypedSession[T]
+
+// Печатает сессию в fmt как обычную структуру, но с замаскированными токенами. Работает с любым глаголом и
+// флагами: %v, %+v, %s и т. д.
+func (s TypedSession[T]) Format(f fmt.State, verb rune) {
+	fmt.Fprintf(f, fmt.FormatString(f, verb), plainSession[T](s.redacted()))
+}
@@ -0,0 +1,422 @@
+package knocknock
+
+/*
+ * metrics.go содержит метрики в текстовом формате Prometheus без зависимости от клиентской библиотеки. Metrics
+ * копит счётчики и гистограммы и сам служит http.Handler для эндпоинта /metrics. Данные собираются в двух местах:
+ * Auth считает созданные сессии, поиски сессий и отказы middleware (опция WithMetrics), а InstrumentStore
+ * оборачивает любое хранилище и измеряет время его методов.
+ *
+ * Метрики (префикс по умолчанию knocknock_):
+ *   - sessions_created_total -- созданные сессии;
+ *   - sessions_regenerated_total -- сессии, которым выдан новый токен (RegenerateSession). В созданные не входят;
+ *   - session_lookups_total{outcome} -- поиски сессии по токену: hit, miss, expired, error;
+ *   - middleware_rejections_total{middleware, reason} -- отказы Middleware, RequireAuth, PolicyRouter и CSRF;
+ *   - store_operation_duration_seconds{store, method} -- время методов хранилища;
+ *   - store_errors_total{store, method} -- ошибки хранилища, кроме "сессия не найдена" и "сессия уже есть";
+ *   - active_sessions{store} -- активные сессии в хранилищах, реализующих SessionCounter (MemoryStore). Хранилища
+ *     одного типа складываются в одну серию, как и их store_operation_duration_seconds
+ */
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Структура настроек Metrics через функциональные опции
+type MetricsOptions struct {
+	Namespace string    // Префикс имён метрик
+	Buckets   []float64 // Границы корзин гистограммы времени хранилища в секундах, по возрастанию
+}
+
+type MetricsOption func(*MetricsOptions)
+
+// Функциональная опция для установки префикса имён метрик. Пустой префикс убирает его вовсе
+func WithMetricsNamespace(namespace string) MetricsOption {
+	return func(o *MetricsOptions) {
+		o.Namespace = namespace
+	}
+}
+
+// Функциональная опция для установки корзин гистограммы времени хранилища. Границы можно передать в любом порядке:
+// HandleMetrics сортирует их и убирает повторы, NaN и +Inf (последняя корзина +Inf есть всегда)
+func WithMetricsBuckets(buckets ...float64) MetricsOption {
+	return func(o *MetricsOptions) {
+		o.Buckets = buckets
+	}
+}
+
+// Создаёт и возвращает конфигурацию Metrics по умолчанию. Корзины рассчитаны и на хранилище в памяти
+// (микросекунды), и на сетевое (десятки миллисекунд)
+func defaultMetricsOptions() *MetricsOptions {
+	return &MetricsOptions{
+		Namespace: "knocknock",
+		Buckets:   []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1},
+	}
+}
+
+// Исходы поиска сессии по токену
+const (
+	lookupHit     = "hit"
+	lookupMiss    = "miss"
+	lookupExpired = "expired"
+	lookupError   = "error"
+)
+
+// Гистограмма с накопленными значениями по корзинам
+type histogram struct {
+	counts []uint64 // По числу корзин, без +Inf
+	count  uint64
+	sum    float64
+}
+
+// Метка хранилища и его метода
+type storeMethod struct {
+	store, method string
+}
+
+// Источник значения active_sessions для хранилища. base -- само хранилище без обёрток: по нему одно хранилище,
+// обёрнутое несколько раз, считается один раз
+type sessionGauge struct {
+	store   string
+	base    Store
+	counter SessionCounter
+}
+
+// Набор метрик Auth и хранилищ. Безопасен для одновременного использования, может быть общим для нескольких Auth.
+// Методы nil-указателя ничего не делают
+type Metrics struct {
+	mu          sync.Mutex
+	opts        *MetricsOptions
+	created     uint64
+	regenerated uint64
+	lookups     map[string]uint64
+	rejections  map[[2]string]uint64 // middleware, reason
+	durations   map[storeMethod]*histogram
+	storeErrs   map[storeMethod]uint64
+	gauges      []sessionGauge
+}
+
+// Конструктор набора метрик. Подключается к Auth опцией WithMetrics, к хранилищу -- через InstrumentStore, и
+// отдаётся Prometheus как обычный http.Handler.
+//
+// Пример:
+//
+//	metrics := knocknock.HandleMetrics()
+//	store := knocknock.InstrumentStore(knocknock.HandleMemoryStore(), metrics)
+//	auth := knocknock.HandleAuth(store, knocknock.WithMetrics(metrics))
+//	mux.Handle("GET /metrics", metrics)
+func HandleMetrics(metricsOptions ...MetricsOption) *Metrics {
+	opts := defaultMetricsOptions()
+	for _, opt := range metricsOptions {
+		opt(opts)
+	}
+	// Поиск корзины двоичный, поэтому границы должны идти по возрастанию без повторов
+	opts.Buckets = slices.DeleteFunc(slices.Clone(opts.Buckets), func(bound float64) bool {
+		return math.IsNaN(bound) || math.IsInf(bound, 1)
+	})
+	slices.Sort(opts.Buckets)
+	opts.Buckets = slices.Compact(opts.Buckets)
+
+	return &Metrics{
+		opts:       opts,
+		lookups:    make(map[string]uint64),
+		rejections: make(map[[2]string]uint64),
+		durations:  make(map[storeMethod]*histogram),
+		storeErrs:  make(map[storeMethod]uint64),
+	}
+}
+
+// Функциональная опция для подключения метрик к Auth
+func WithMetrics(metrics *Metrics) AuthOption {
+	return func(o *AuthOptions) {
+		o.Metrics = metrics
+	}
+}
+
+// Учитывает созданную сессию
+func (m *Metrics) sessionCreated() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.created++
+}
+
+// Учитывает перевыпуск токена сессии
+func (m *Metrics) sessionRegenerated() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.regenerated++
+}
+
+// Учитывает поиск сессии по токену с исходом outcome
+func (m *Metrics) sessionLookup(outcome string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lookups[outcome]++
+}
+
+// Исход поиска сессии по токену с результатом err
+func lookupOutcome(err error) string {
+	switch {
+	case err == nil:
+		return lookupHit
+	case errors.Is(err, SessionExpiredError):
+		return lookupExpired
+	case errors.Is(err, SessionNotFoundError), errors.Is(err, InvalidTokenError):
+		return lookupMiss
+	}
+	return lookupError
+}
+
+// Учитывает отказ middleware по причине err
+func (m *Metrics) rejection(middleware string, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.rejections[[2]string{middleware, rejectionReason(err)}]++
+}
+
+// Короткая причина отказа для метки reason
+func rejectionReason(err error) string {
+	switch {
+	case errors.Is(err, TokenMissingError):
+		return "missing"
+	case errors.Is(err, InvalidTokenError):
+		return "invalid"
+	case errors.Is(err, SessionNotFoundError):
+		return "not_found"
+	case errors.Is(err, SessionExpiredError):
+		return "expired"
+	case errors.Is(err, TokenConflictError):
+		return "conflict"
+	case errors.Is(err, InsufficientScopeError):
+		return "forbidden"
+	case errors.Is(err, CSRFTokenInvalidError):
+		return "csrf"
+	}
+	return "error"
+}
+
+// Учитывает вызов метода хранилища
+func (m *Metrics) storeCall(store, method string, elapsed time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	key := storeMethod{store, method}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h := m.durations[key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(m.opts.Buckets))}
+		m.durations[key] = h
+	}
+	seconds := elapsed.Seconds()
+	if i, _ := slices.BinarySearch(m.opts.Buckets, seconds); i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += seconds
+
+	if err != nil && !errors.Is(err, SessionNotFoundError) && !errors.Is(err, SessionExistsError) {
+		m.storeErrs[key]++
+	}
+}
+
+// Регистрирует хранилище, число активных сессий которого отдаётся метрикой active_sessions. Хранилище, уже
+// зарегистрированное через другую обёртку, не добавляется
+func (m *Metrics) trackSessions(store string, base Store, counter SessionCounter) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Хранилища несравнимого типа не сравниваются: на таком == паникует
+	identifiable := reflect.TypeOf(base).Comparable()
+	for _, gauge := range m.gauges {
+		if identifiable && gauge.base == base {
+			return
+		}
+	}
+	m.gauges = append(m.gauges, sessionGauge{store, base, counter})
+}
+
+// Отдаёт метрики в текстовом формате Prometheus (версия 0.0.4). Вывод собирается в буфер, а клиенту пишется уже
+// без блокировки: медленный клиент не задерживает запросы, которые пишут метрики. У nil Metrics вывод пуст
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if m == nil {
+		return
+	}
+	var buf bytes.Buffer
+	m.write(&buf)
+	w.Write(buf.Bytes())
+}
+
+// Пишет все метрики. Серии внутри метрики упорядочены по меткам, чтобы вывод был стабильным
+func (m *Metrics) write(w *bytes.Buffer) {
+	// Счётчики хранилищ читаются вне блокировки: хранилище может само писать метрики
+	m.mu.Lock()
+	gauges := slices.Clone(m.gauges)
+	m.mu.Unlock()
+	active := make(map[string]float64)
+	for _, gauge := range gauges {
+		active[gauge.store] += float64(gauge.counter.ActiveSessions())
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name := m.name("sessions_created_total")
+	header(w, name, "counter", "Sessions created.")
+	sample(w, name, nil, float64(m.created))
+
+	name = m.name("sessions_regenerated_total")
+	header(w, name, "counter", "Sessions given a new token.")
+	sample(w, name, nil, float64(m.regenerated))
+
+	name = m.name("session_lookups_total")
+	header(w, name, "counter", "Session lookups by token, by outcome.")
+	for _, outcome := range []string{lookupHit, lookupMiss, lookupExpired, lookupError} {
+		sample(w, name, []string{"outcome", outcome}, float64(m.lookups[outcome]))
+	}
+
+	name = m.name("middleware_rejections_total")
+	header(w, name, "counter", "Requests rejected by middleware, by middleware and reason.")
+	for _, key := range sortedKeys(m.rejections, func(k [2]string) string { return k[0] + "\x00" + k[1] }) {
+		sample(w, name, []string{"middleware", key[0], "reason", key[1]}, float64(m.rejections[key]))
+	}
+
+	name = m.name("store_operation_duration_seconds")
+	header(w, name, "histogram", "Duration of store method calls in seconds.")
+	for _, key := range sortedKeys(m.durations, storeMethod.String) {
+		h := m.durations[key]
+		var cumulative uint64
+		for i, bound := range m.opts.Buckets {
+			cumulative += h.counts[i]
+			sample(w, name+"_bucket", []string{"store", key.store, "method", key.method, "le", formatFloat(bound)}, float64(cumulative))
+		}
+		sample(w, name+"_bucket", []string{"store", key.store, "method", key.method, "le", "+Inf"}, float64(h.count))
+		sample(w, name+"_sum", []string{"store", key.store, "method", key.method}, h.sum)
+		sample(w, name+"_count", []string{"store", key.store, "method", key.method}, float64(h.count))
+	}
+
+	name = m.name("store_errors_total")
+	header(w, name, "counter", "Failed store method calls.")
+	for _, key := range sortedKeys(m.storeErrs, storeMethod.String) {
+		sample(w, name, []string{"store", key.store, "method", key.method}, float64(m.storeErrs[key]))
+	}
+
+	if len(gauges) > 0 {
+		name = m.name("active_sessions")
+		header(w, name, "gauge", "Active sessions in the store.")
+		for _, store := range sortedKeys(active, func(store string) string { return store }) {
+			sample(w, name, []string{"store", store}, active[store])
+		}
+	}
+}
+
+func (k storeMethod) String() string {
+	return k.store + "\x00" + k.method
+}
+
+// Полное имя метрики с префиксом
+func (m *Metrics) name(metric string) string {
+	if m.opts.Namespace == "" {
+		return metric
+	}
+	return m.opts.Namespace + "_" + metric
+}
+
+// Ключи карты, упорядоченные по строковому представлению
+func sortedKeys[K comparable, V any](values map[K]V, key func(K) string) []K {
+	keys := make([]K, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(x, y K) int {
+		return strings.Compare(key(x), key(y))
+	})
+	return keys
+}
+
+// Пишет строки HELP и TYPE метрики
+func header(w *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Пишет одну серию. labels -- пары имя, значение
+func sample(w *bytes.Buffer, name string, labels []string, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(labels[i])
+			w.WriteString(`="`)
+			w.WriteString(labelEscaper.Replace(labels[i+1]))
+			w.WriteByte('"')
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+// Экранирование значений меток по текстовому формату Prometheus
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Оборачивает хранилище так, что время и ошибки каждого его метода попадают в metrics. Необязательные возможности
+// (Updater, SubjectIndexer, Replacer, ExpiryNotifier, LogReceiver) сохраняются, если они есть у исходного
+// хранилища. Если хранилище реализует SessionCounter, его число активных сессий отдаётся метрикой active_sessions.
+// Метка store -- имя типа хранилища, например MemoryStore: серии нескольких хранилищ одного типа складываются.
+//
+// Пример:
+//
+//	store := knocknock.InstrumentStore(redisStore, metrics)
+//	auth := knocknock.HandleAuth(store, knocknock.WithMetrics(metrics))
+func InstrumentStore(store Store, metrics *Metrics) Store {
+	name := storeName(store)
+	if counter, ok := storeAs[SessionCounter](store); ok {
+		metrics.trackSessions(name, unwrapStore(store), counter)
+	}
+	return &wrappedStore{store: store, name: name, around: func(ctx context.Context, method string, call func(context.Context) error) error {
+		start := time.Now()
+		err := call(ctx)
+		metrics.storeCall(name, method, time.Since(start), err)
+		return err
+	}}
+}
@@ -7,15 +7,19 @@ package knocknock
 import (
 	"context"
 	"net/http"
-	"strings"
 )
 
 type ContextKey string
 
 const SessionContextKey ContextKey = "session"
 
+// Ключ контекста, под которым Middleware оставляет причину, по которой у запроса нет сессии. По ней RequireAuth,
+// Authorize, PolicyRouter и CSRF отвечают, не обращаясь к хранилищу второй раз (см. requestSession)
+const rejectionContextKey ContextKey = "rejection"
+
 // Создает HTTP middleware для проверки аутентификации. Функция извлекает токен из запроса и, если сессия
-// валидна, добавляет её в контекст запроса.
+// валидна, добавляет её в контекст запроса. Запрос с негодным токеном проходит дальше без сессии, а причина отказа
+// пишется в лог (см. WithLogger).
 //
 // Пример:
 //
@@ -33,11 +37,40 @@ const SessionContextKey ContextKey = "session"
 func (a *Auth) Middleware() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			token := a.extractToken(r)
+			r = a.auditContext(r)
+			r, span := a.traceRequest(r)
+			outcome, failure := "anonymous", error(nil)
+			defer func() { endSpan(span, outcome, failure) }()
 
-			if session, err := a.GetSession(r.Context(), token); err == nil {
+			token, source, err := a.lookupToken(r)
+			if source != nil {
+				span.SetAttributes(Attribute{attrTokenSource, sourceName(source)})
+			}
+			switch {
+			case err != nil:
+				r = a.rejectToken(r, "", err)
+				outcome, failure = rejectionReason(err), err
+			case token == "":
+				r = r.WithContext(context.WithValue(r.Context(), rejectionContextKey, TokenMissingError))
+			case !a.validToken(token):
+				r = a.rejectToken(r, token, InvalidTokenError)
+				outcome, failure = rejectionReason(InvalidTokenError), InvalidTokenError
+			default:
+				session, err := a.GetSession(r.Context(), token)
+				if err != nil {
+					r = a.rejectToken(r, token, err)
+					outcome, failure = rejectionReason(err), err
+					break
+				}
+				outcome = "authenticated"
 				ctx := context.WithValue(r.Context(), SessionContextKey, session)
 				r = r.WithContext(ctx)
+
+				if store := a.cookieStore(); store != nil && token == a.readSessionCookie(r) {
+					sealing := &sealingResponseWriter{ResponseWriter: w, auth: a, store: store, request: r, session: session, token: token}
+					defer sealing.reseal()
+					w = sealing
+				}
 			}
 
 			next.ServeHTTP(w, r)
@@ -45,6 +78,14 @@ func (a *Auth) Middleware() func(http.Handler) http.Handler {
 	}
 }
 
+// Учитывает токен, который Middleware не принял: пишет причину в лог и в метрики. Возвращает запрос, в контексте
+// которого оставлена причина
+func (a *Auth) rejectToken(r *http.Request, token string, err error) *http.Request {
+	a.logRejected(r, token, err)
+	a.AuthOptions.Metrics.rejection("session", err)
+	return r.WithContext(context.WithValue(r.Context(), rejectionContextKey, err))
+}
+
 // Возвращает сессию из контекста запроса. Возвращает nil если сессия не найдена в контексте.
 //
 // Пример:
@@ -65,22 +106,12 @@ func GetSession(ctx context.Context) *Session {
 	return nil
 }
 
-// Извлекает токен из HTTP-запроса. Проверяет HTTP-заголовки, query-параметры и cookies.
+// Извлекает токен из HTTP-запроса. Источники и их порядок задаются WithTokenSources, по умолчанию это HTTP-заголовок,
+// query-параметр и cookie. Токен, не прошедший проверку формата генератором (см. WithTokenGenerator), или конфликт
+// источников в строгом режиме дают пустую строку
 func (a *Auth) extractToken(r *http.Request) string {
-	if authHeader := r.Header.Get(a.AuthOptions.HeaderName); authHeader != "" {
-		if strings.HasPrefix(authHeader, "Bearer ") {
-			return authHeader[7:]
-		}
-		return authHeader
-	}
-
-	if token := r.URL.Query().Get(a.AuthOptions.QueryParamName); token != "" {
+	if token, _, err := a.lookupToken(r); err == nil && a.validToken(token) {
 		return token
 	}
-
-	if cookie, err := r.Cookie(a.AuthOptions.CookieName); err == nil {
-		return cookie.Value
-	}
-
 	return ""
 }
@@ -0,0 +1,84 @@
+// Пакет knockotel -- адаптер трассировки knocknock (knocknock.Tracer) к OpenTelemetry. Вынесен в отдельный модуль,
+// чтобы основной модуль knocknock оставался без зависимостей
+package knockotel
+
+/*
+ * otel.go превращает trace.Tracer из OpenTelemetry в knocknock.Tracer. Span-ы knocknock становятся обычными span-ами
+ * OpenTelemetry вида Internal, поэтому встают в трассу входящего запроса, если его контекст уже несёт span (например,
+ * от otelhttp)
+ */
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tolstovrob/knocknock"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Оборачивает trace.Tracer из OpenTelemetry в knocknock.Tracer.
+//
+// Пример:
+//
+//	tracer := knockotel.HandleTracer(otel.Tracer("github.com/tolstovrob/knocknock"))
+//	store := knocknock.TraceStore(knocknock.HandleMemoryStore(), tracer)
+//	auth := knocknock.HandleAuth(store, knocknock.WithTracer(tracer))
+func HandleTracer(tracer trace.Tracer) knocknock.Tracer {
+	return &otelTracer{tracer: tracer}
+}
+
+type otelTracer struct {
+	tracer trace.Tracer
+}
+
+func (t *otelTracer) Start(ctx context.Context, name string, attrs ...knocknock.Attribute) (context.Context, knocknock.Span) {
+	ctx, span := t.tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindInternal),
+		trace.WithAttributes(convert(attrs)...),
+	)
+	return ctx, &otelSpan{span: span}
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s *otelSpan) SetAttributes(attrs ...knocknock.Attribute) {
+	s.span.SetAttributes(convert(attrs)...)
+}
+
+// Записывает ошибку событием span-а и ставит ему статус Error
+func (s *otelSpan) RecordError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s *otelSpan) End() {
+	s.span.End()
+}
+
+// Переводит атрибуты knocknock в атрибуты OpenTelemetry. Значения неизвестных типов становятся строками
+func convert(attrs []knocknock.Attribute) []attribute.KeyValue {
+	result := make([]attribute.KeyValue, 0, len(attrs))
+	for _, attr := range attrs {
+		var kv attribute.KeyValue
+		switch value := attr.Value.(type) {
+		case string:
+			kv = attribute.String(attr.Key, value)
+		case bool:
+			kv = attribute.Bool(attr.Key, value)
+		case int:
+			kv = attribute.Int(attr.Key, value)
+		case int64:
+			kv = attribute.Int64(attr.Key, value)
+		case float64:
+			kv = attribute.Float64(attr.Key, value)
+		default:
+			kv = attribute.String(attr.Key, fmt.Sprint(value))
+		}
+		result = append(result, kv)
+	}
+	return result
+}
@@ -0,0 +1,96 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tolstovrob/knocknock"
+	knockotel "github.com/tolstovrob/knocknock/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// Хранилище, у которого Get всегда отказывает
+type failingStore struct {
+	knocknock.Store
+}
+
+func (s failingStore) Get(ctx context.Context, token string) (*knocknock.Session, error) {
+	return nil, http.ErrServerClosed
+}
+
+func TestTracer(t *testing.T) {
+	ctx := context.Background()
+
+	setup := func(store knocknock.Store) (*knocknock.Auth, *tracetest.SpanRecorder, *sdktrace.TracerProvider) {
+		recorder := tracetest.NewSpanRecorder()
+		provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+		tracer := knockotel.HandleTracer(provider.Tracer("knocknock"))
+		return knocknock.HandleAuth(knocknock.TraceStore(store, tracer), knocknock.WithTracer(tracer)), recorder, provider
+	}
+
+	// Значение атрибута span-а
+	attr := func(span sdktrace.ReadOnlySpan, key string) attribute.Value {
+		for _, kv := range span.Attributes() {
+			if string(kv.Key) == key {
+				return kv.Value
+			}
+		}
+		return attribute.Value{}
+	}
+
+	t.Run("Spans join request trace", func(t *testing.T) {
+		auth, recorder, provider := setup(knocknock.HandleMemoryStore())
+		session, _ := auth.CreateSession(ctx, "user")
+
+		// Span входящего запроса, как от otelhttp
+		reqCtx, root := provider.Tracer("http").Start(ctx, "GET /")
+		req := httptest.NewRequest("GET", "/", nil).WithContext(reqCtx)
+		req.Header.Set("Authorization", "Bearer "+session.Token)
+		auth.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(httptest.NewRecorder(), req)
+		root.End()
+
+		spans := map[string]sdktrace.ReadOnlySpan{}
+		for _, span := range recorder.Ended() {
+			spans[span.Name()] = span
+		}
+
+		middleware, get, storeGet := spans["knocknock.Middleware"], spans["knocknock.GetSession"], spans["knocknock.store.Get"]
+		if middleware == nil || get == nil || storeGet == nil {
+			t.Fatalf("Missing spans, got %v", spans)
+		}
+		if middleware.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Error("Middleware span should be a child of the request span")
+		}
+		if get.Parent().SpanID() != middleware.SpanContext().SpanID() || storeGet.Parent().SpanID() != get.SpanContext().SpanID() {
+			t.Error("Spans should be nested: Middleware > GetSession > store.Get")
+		}
+		if attr(middleware, "knocknock.token.source").AsString() != "header" || attr(get, "knocknock.outcome").AsString() != "hit" {
+			t.Errorf("Unexpected attributes %v %v", middleware.Attributes(), get.Attributes())
+		}
+		if attr(storeGet, "knocknock.store").AsString() != "MemoryStore" {
+			t.Errorf("Unexpected store attributes %v", storeGet.Attributes())
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		auth, recorder, _ := setup(failingStore{knocknock.HandleMemoryStore()})
+		session, _ := auth.CreateSession(ctx, "user")
+		auth.GetSession(ctx, session.Token)
+
+		for _, span := range recorder.Ended() {
+			if span.Name() != "knocknock.store.Get" {
+				continue
+			}
+			if span.Status().Code != codes.Error || len(span.Events()) == 0 {
+				t.Errorf("Expected error status and event, got %v %v", span.Status(), span.Events())
+			}
+			return
+		}
+		t.Error("Expected store.Get span")
+	})
+}
@@ -0,0 +1,208 @@
+package knocknock
+
+/*
+ * policy.go содержит таблицу правил доступа к маршрутам. Маршруты задаются шаблонами http.ServeMux (Go 1.22+):
+ * "GET /admin/", "POST /orders", "/users/{id}". Запрос сопоставляется с шаблонами по тем же правилам, что и в
+ * ServeMux, то есть побеждает самый специфичный шаблон. Маршруты, не попавшие ни под один шаблон, пропускаются.
+ * Путь перед сопоставлением очищается (path.Clean), поэтому "/admin//users" и "/x/../admin/users" подпадают под
+ * правило "/admin/", а "/admin" -- под правило "/admin/", на которое ServeMux перенаправил бы такой запрос.
+ *
+ * В режиме пробного запуска (WithPolicyDryRun) запрет не применяется, а только пишется в лог. Так можно включить
+ * авторизацию на работающем сервисе и сначала посмотреть, кого она отрежет
+ */
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"slices"
+)
+
+// Правило доступа к маршруту
+type Policy struct {
+	Pattern string // Шаблон http.ServeMux, например "GET /admin/" или "POST /orders"
+	Rule    Rule   // Правило для сессии. Пустое правило требует лишь наличия сессии
+	Public  bool   // Маршрут доступен без сессии. Rule при этом не проверяется
+}
+
+// Структура настроек PolicyRouter через функциональные опции
+type PolicyOptions struct {
+	DryRun             bool                // Только писать запреты в лог, не отклоняя запросы
+	Logger             *slog.Logger        // Лог для пробного запуска. nil -- лог Auth (см. WithLogger)
+	RequireAuthOptions []RequireAuthOption // Настройки ответов 401 и 403, как у RequireAuth
+}
+
+type PolicyOption func(*PolicyOptions)
+
+// Функциональная опция для пробного запуска: запросы, которые были бы отклонены, пропускаются и пишутся в лог
+func WithPolicyDryRun() PolicyOption {
+	return func(o *PolicyOptions) {
+		o.DryRun = true
+	}
+}
+
+// Функциональная опция для установки лога пробного запуска
+func WithPolicyLogger(logger *slog.Logger) PolicyOption {
+	return func(o *PolicyOptions) {
+		o.Logger = logger
+	}
+}
+
+// Функциональная опция для настройки ответов на отказ. Принимает те же опции, что и RequireAuth
+func WithPolicyResponses(requireAuthOptions ...RequireAuthOption) PolicyOption {
+	return func(o *PolicyOptions) {
+		o.RequireAuthOptions = append(o.RequireAuthOptions, requireAuthOptions...)
+	}
+}
+
+// Маршрутизатор правил доступа
+type PolicyRouter struct {
+	auth     *Auth
+	mux      *http.ServeMux
+	opts     *PolicyOptions
+	response *RequireAuthOptions
+}
+
+// Правило из таблицы. Регистрируется в ServeMux вместо обработчика, чтобы найти правило по запросу
+type policyMatch struct {
+	policy *Policy
+}
+
+func (policyMatch) ServeHTTP(http.ResponseWriter, *http.Request) {}
+
+// Создаёт маршрутизатор по таблице правил. Возвращает ошибку, если шаблон некорректен, повторяется или конфликтует
+// с другим шаблоном (по правилам http.ServeMux).
+//
+// Пример:
+//
+//	policies, err := auth.PolicyRouter([]knocknock.Policy{
+//	    {Pattern: "GET /admin/", Rule: knocknock.AllRoles("admin")},
+//	    {Pattern: "POST /orders", Rule: knocknock.AllScopes("orders:write")},
+//	    {Pattern: "/login", Public: true},
+//	}, knocknock.WithPolicyDryRun())
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	handler := auth.Middleware()(policies.Middleware()(mux))
+func (a *Auth) PolicyRouter(policies []Policy, policyOptions ...PolicyOption) (router *PolicyRouter, err error) {
+	opts := &PolicyOptions{}
+	for _, opt := range policyOptions {
+		opt(opts)
+	}
+	response := defaultRequireAuthOptions()
+	for _, opt := range opts.RequireAuthOptions {
+		opt(response)
+	}
+
+	mux := http.NewServeMux()
+	// ServeMux сообщает о плохих и конфликтующих шаблонах паникой
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			router, err = nil, fmt.Errorf("knocknock: %v", recovered)
+		}
+	}()
+	table := slices.Clone(policies)
+	for i := range table {
+		mux.Handle(table[i].Pattern, policyMatch{&table[i]})
+	}
+
+	return &PolicyRouter{a, mux, opts, response}, nil
+}
+
+// Создаёт HTTP middleware, применяющее таблицу правил. Ставится после Auth.Middleware, чтобы взять сессию из
+// контекста, но работает и без него
+func (p *PolicyRouter) Middleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			policy, redirect := p.match(r)
+			if redirect != nil {
+				redirect.ServeHTTP(w, r)
+				return
+			}
+			if policy == nil || policy.Public {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			r = p.auth.auditContext(r)
+			session, r, denied := p.auth.requestSession(r)
+			if denied == nil && !policy.Rule.allows(p.auth, session) {
+				denied = InsufficientScopeError
+			}
+
+			if denied == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if p.opts.DryRun {
+				p.report(r, policy, session, denied)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			p.auth.deny(r, "policy", session, denied)
+			if session == nil {
+				p.response.unauthorized(w, r, denied)
+			} else {
+				p.response.forbidden(w, r, &policy.Rule)
+			}
+		})
+	}
+}
+
+// Находит правило для запроса по очищенному пути. Если ServeMux и для очищенного пути отвечает перенаправлением
+// ("/admin" при шаблоне "/admin/"), применяется правило, на которое ведёт перенаправление. Если его найти не удалось,
+// возвращается само перенаправление: пропускать такой запрос дальше без проверки нельзя
+func (p *PolicyRouter) match(r *http.Request) (*Policy, http.Handler) {
+	target, u := *r, *r.URL
+	u.Path, u.RawPath = cleanPath(u.Path), ""
+	target.URL = &u
+
+	handler, pattern := p.mux.Handler(&target)
+	if match, ok := handler.(policyMatch); ok {
+		return match.policy, nil
+	}
+	if pattern == "" {
+		return nil, nil
+	}
+
+	u.Path += "/"
+	if slashed, _ := p.mux.Handler(&target); slashed != nil {
+		if match, ok := slashed.(policyMatch); ok {
+			return match.policy, nil
+		}
+	}
+	return nil, handler
+}
+
+// Очищает путь запроса так же, как ServeMux: убирает "." и "..", повторные "/" и сохраняет завершающий "/"
+func cleanPath(p string) string {
+	if p == "" || p[0] != '/' {
+		p = "/" + p
+	}
+	cleaned := path.Clean(p)
+	if p[len(p)-1] == '/' && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// Пишет в лог запрос, который был бы отклонён
+func (p *PolicyRouter) report(r *http.Request, policy *Policy, session *Session, denied error) {
+	attrs := []slog.Attr{
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.String("pattern", policy.Pattern),
+		slog.String("reason", denied.Error()),
+	}
+	if session != nil && session.Subject != "" {
+		attrs = append(attrs, slog.String("subject", session.Subject))
+	}
+	logger := p.opts.Logger
+	if logger == nil {
+		logger = p.auth.logger()
+	}
+	logger.LogAttrs(r.Context(), slog.LevelWarn, "knocknock: policy would deny request", attrs...)
+}
@@ -0,0 +1,223 @@
+package knocknock
+
+/*
+ * refresh.go содержит пары из короткоживущей сессии и долгоживущего refresh-токена. Refresh-токен хранится в том же
+ * Store, что и сессии, но с видом SessionKindRefresh, поэтому запросы им авторизовать нельзя.
+ *
+ * При каждом обновлении пара ротируется: старый refresh-токен не удаляется, а помечается ссылкой ReplacedBy на новый.
+ * Если заменённый токен предъявят снова, значит его украли (или украли его преемника), и вся цепочка токенов --
+ * семейство -- отзывается, как требует OAuth 2.1.
+ *
+ * Сессия пары знает ключ своего refresh-токена (Session.Pair), поэтому при перевыпуске (см. regenerate.go) refresh-токен
+ * перенаправляется на новую сессию, и Refresh по-прежнему удаляет её.
+ *
+ * Refresh-токены хранятся на сервере, поэтому с CookieStore, который ничего не хранит, пары не работают.
+ *
+ * Ротация защищена от гонки: прежде чем выдать новую пару, Refresh сохраняет служебную запись "rotated:<ключ>".
+ * Store.Save не перезаписывает существующие записи, поэтому из одновременных обменов одного токена запись создаёт
+ * только один, а остальные считаются повторным использованием: они помечают запись и отзывают семейство. Победитель,
+ * привязав новую пару к старому токену, перечитывает запись и, если она помечена, отзывает и свою ветку. Так новая
+ * пара не переживает обнаруженное повторное использование, в каком бы порядке ни шли запросы
+ */
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Префикс ключей отметок о ротации refresh-токенов в хранилище
+const rotatedKeyPrefix = "rotated:"
+
+// Значение ReplacedBy отметки о ротации, по которой одновременный запрос обнаружил повторное использование
+const rotationReused = "reused"
+
+// Пара из сессии и refresh-токена, которым её можно обновить
+type SessionPair struct {
+	Access  *Session // Короткоживущая сессия. Её токеном авторизуются запросы
+	Refresh *Session // Долгоживущий refresh-токен. Его нужно хранить на клиенте и передавать только в Refresh
+}
+
+// Создаёт пару из сессии на AccessExpiry и refresh-токена на RefreshExpiry. Опции сессии применяются к обоим. С
+// CookieStore возвращает StoreUnsupportedError: refresh-токен хранить негде.
+//
+// Пример:
+//
+//	pair, err := auth.CreateSessionPair(ctx, user)
+//	if err != nil {
+//	    return err
+//	}
+//	respond(pair.Access.Token, pair.Refresh.Token)
+func (a *Auth) CreateSessionPair(ctx context.Context, userData UserData, sessionOptions ...SessionOption) (*SessionPair, error) {
+	if err := a.pairsSupported(); err != nil {
+		return nil, err
+	}
+
+	// Токен refresh создаётся заранее, чтобы сессия сразу сохранилась со ссылкой на него
+	refreshToken, err := a.newToken()
+	if err != nil {
+		return nil, err
+	}
+	if a.AuthOptions.JWTKey == nil {
+		sessionOptions = append(sessionOptions, func(s *Session) {
+			s.Pair = a.storeKey(refreshToken)
+		})
+	}
+
+	access, err := a.newSession(ctx, userData, a.AuthOptions.AccessExpiry, sessionOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	refresh, err := a.newRefreshSession(ctx, access, refreshToken)
+	if err != nil {
+		_ = a.DeleteSession(ctx, access.Token)
+		return nil, err
+	}
+
+	return &SessionPair{access, refresh}, nil
+}
+
+// Обменивает refresh-токен на новую пару. Старая сессия удаляется, а старый refresh-токен помечается как заменённый.
+// Повторное предъявление заменённого токена отзывает всё семейство и возвращает RefreshTokenReusedError. Из
+// одновременных запросов с одним токеном новую пару получает только один, остальные тоже считаются повторным
+// использованием. С CookieStore возвращает StoreUnsupportedError, как и CreateSessionPair
+func (a *Auth) Refresh(ctx context.Context, refreshToken string) (*SessionPair, error) {
+	if err := a.pairsSupported(); err != nil {
+		return nil, err
+	}
+
+	refresh, err := a.findSession(ctx, refreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if refresh.Kind != SessionKindRefresh {
+		return nil, InvalidRefreshTokenError
+	}
+
+	if refresh.ReplacedBy != "" {
+		return nil, a.refreshReused(ctx, refresh)
+	}
+
+	if refresh.IsExpired() {
+		if err := a.deleteStoredSession(ctx, refresh); err != nil {
+			a.logStoreError(ctx, "failed to delete expired refresh token", err)
+		}
+		a.emit(ctx, EventExpire, a.withToken(refresh, refreshToken))
+		return nil, SessionExpiredError
+	}
+
+	claim := &Session{
+		Token:     rotatedKeyPrefix + refresh.Token,
+		CreatedAt: time.Now(),
+		ExpiresAt: refresh.ExpiresAt,
+		Kind:      SessionKindRevoked,
+	}
+	if err := a.store.Save(ctx, claim); errors.Is(err, SessionExistsError) {
+		// Токен обменивает другой запрос. Метка заставит его отозвать свою ветку, если он привяжет её после того, как
+		// мы перечитаем токен
+		claim.ReplacedBy = rotationReused
+		if err := a.updateSession(ctx, claim); err != nil && !errors.Is(err, SessionNotFoundError) {
+			a.logStoreError(ctx, "failed to mark refresh token rotation", err)
+		}
+		if current, err := a.store.Get(ctx, refresh.Token); err == nil {
+			refresh = current
+		}
+		return nil, a.refreshReused(ctx, refresh)
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Старая сессия удаляется до создания новой, чтобы не занимать место в лимите сессий пользователя. При ошибке
+	// отметка снимается, чтобы клиент мог повторить обмен
+	if refresh.Pair != "" {
+		if err := a.store.Delete(ctx, refresh.Pair); err != nil {
+			_ = a.store.Delete(ctx, claim.Token)
+			return nil, err
+		}
+	}
+
+	pair, err := a.CreateSessionPair(ctx, refresh.UserData, inheritSession(refresh))
+	if err != nil {
+		_ = a.store.Delete(ctx, claim.Token)
+		return nil, err
+	}
+
+	rotated := *refresh
+	rotated.ReplacedBy = a.storeKey(pair.Refresh.Token)
+	if err := a.updateSession(ctx, &rotated); err != nil {
+		_ = a.DeleteSession(ctx, pair.Refresh.Token)
+		if errors.Is(err, SessionNotFoundError) {
+			// Проигравший одновременный запрос уже отозвал семейство
+			return nil, RefreshTokenReusedError
+		}
+		return nil, err
+	}
+
+	if current, err := a.store.Get(ctx, claim.Token); err == nil && current.ReplacedBy == rotationReused {
+		return nil, a.refreshReused(ctx, &rotated)
+	}
+
+	a.emit(ctx, EventRefresh, pair.Access)
+	return pair, nil
+}
+
+// Пишет в лог повторное использование refresh-токена и отзывает его семейство
+func (a *Auth) refreshReused(ctx context.Context, refresh *Session) error {
+	a.logger().LogAttrs(ctx, slog.LevelWarn, "knocknock: refresh token reuse detected", slog.Any("session", refresh))
+	if err := a.revokeFamily(ctx, refresh); err != nil {
+		a.logStoreError(ctx, "failed to revoke refresh token family", err)
+	}
+	return RefreshTokenReusedError
+}
+
+// Проверяет, что хранилище может держать refresh-токены
+func (a *Auth) pairsSupported() error {
+	if a.cookieStore() != nil {
+		return fmt.Errorf("%w: session pairs need a server-side store, CookieStore keeps no refresh tokens", StoreUnsupportedError)
+	}
+	return nil
+}
+
+// Создаёт и сохраняет refresh-токен с токеном token для сессии
+func (a *Auth) newRefreshSession(ctx context.Context, access *Session, token string) (*Session, error) {
+	refresh := MakeSession(a.storeKey(token), access.UserData, a.AuthOptions.RefreshExpiry)
+	refresh.Verifier = verifierHash(token)
+	inheritSession(access)(refresh)
+	refresh.Kind = SessionKindRefresh
+	if !a.signedToken(access.Token) {
+		// Подписанную сессию удалить нельзя: она доживёт до своего короткого AccessExpiry
+		refresh.Pair = a.storeKey(access.Token)
+	}
+
+	if err := a.store.Save(ctx, refresh); err != nil {
+		return nil, err
+	}
+
+	return a.withToken(refresh, token), nil
+}
+
+// Отзывает семейство, начиная с данного refresh-токена: проходит по цепочке ReplacedBy и удаляет каждый токен вместе
+// с выданной с ним сессией. Более ранние звенья цепочки уже бесполезны: они заменены и при предъявлении снова
+// приведут сюда
+func (a *Auth) revokeFamily(ctx context.Context, refresh *Session) error {
+	for refresh != nil {
+		if err := a.deleteStoredSession(ctx, refresh); err != nil {
+			return err
+		}
+
+		if refresh.ReplacedBy == "" {
+			return nil
+		}
+
+		next, err := a.store.Get(ctx, refresh.ReplacedBy)
+		if err != nil {
+			return nil
+		}
+		refresh = next
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package knocknock
+
+/*
+ * regenerate.go содержит перевыпуск токена сессии. Его вызывают при смене привилегий (вход, подтверждение пароля,
+ * выдача роли), чтобы токен, подсмотренный или подброшенный до этого (session fixation), перестал действовать.
+ * Данные, пользователь, роли, права и сроки сессии сохраняются, а CSRF-токен выдаётся заново
+ */
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Выдаёт сессии новый токен и делает старый недействительным. Опции сессии применяются к новой сессии, например, чтобы
+// добавить роль. Если хранилище реализует Replacer, замена атомарна: из одновременных вызовов с одним токеном успешен
+// только один, остальные получают SessionNotFoundError.
+//
+// Подписанный токен (WithJWT) заносится в список отозванных. В CookieStore старый токен отозвать нельзя: он
+// останется действительным до своего ExpiresAt. Refresh-токен пары (см. CreateSessionPair) перенаправляется на новую
+// сессию, так что Refresh удалит именно её.
+//
+// Перевыпуск -- не обращение к сессии: OnAccess не вызывается, а срок при скользящем истечении не продлевается.
+// Время создания сохраняется, так что MaxLifetime отсчитывается от первого входа во всех режимах.
+//
+// Пример:
+//
+//	session, err := auth.RegenerateSession(ctx, token, knocknock.WithRoles("admin"))
+func (a *Auth) RegenerateSession(ctx context.Context, oldToken string, sessionOptions ...SessionOption) (*Session, error) {
+	session, old, err := a.regenerate(ctx, oldToken, sessionOptions)
+	if err != nil {
+		return nil, err
+	}
+	a.AuthOptions.Metrics.sessionRegenerated()
+	a.notify(ctx, EventDelete, old)
+	a.notify(ctx, EventCreate, session)
+	if a.AuthOptions.Audit != nil {
+		a.writeAudit(ctx, &AuditRecord{
+			Action:              AuditSessionRegenerate,
+			Subject:             session.Subject,
+			TokenFingerprint:    a.tokenFingerprint(session.Token),
+			PreviousFingerprint: a.tokenFingerprint(oldToken),
+		})
+	}
+	return session, nil
+}
+
+// Выпускает замену сессии с токеном oldToken в режиме, в котором работает Auth. Возвращает новую сессию и старую.
+// Старая сессия ищется один раз и без продления, как в GetSession, но без события обращения
+func (a *Auth) regenerate(ctx context.Context, oldToken string, sessionOptions []SessionOption) (*Session, *Session, error) {
+	if a.signedToken(oldToken) {
+		old, err := a.getSignedSession(ctx, oldToken)
+		if err != nil {
+			return nil, nil, err
+		}
+		claims, err := a.parseSignedToken(oldToken)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := a.saveRevocation(ctx, claims); errors.Is(err, SessionExistsError) {
+			return nil, nil, SessionNotFoundError
+		} else if err != nil {
+			return nil, nil, err
+		}
+		session, err := a.newSignedSession(old.UserData, time.Until(old.ExpiresAt), regeneratedOptions(old, sessionOptions))
+		return session, old, err
+	}
+	if store := a.cookieStore(); store != nil {
+		old, err := a.openSealedSession(ctx, store, oldToken)
+		if err != nil {
+			return nil, nil, err
+		}
+		session, err := a.newSealedSession(store, old.UserData, time.Until(old.ExpiresAt), regeneratedOptions(old, sessionOptions))
+		return session, old, err
+	}
+
+	// Ключ старой сессии в хранилище: после ротации ключа хеширования он может быть посчитан прежним ключом
+	stored, err := a.storedSession(ctx, oldToken)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	token, err := a.newToken()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	session := *stored
+	session.Token = a.storeKey(token)
+	session.Verifier = verifierHash(token)
+	session.CSRFToken = ""
+	for _, opt := range sessionOptions {
+		opt(&session)
+	}
+
+	if err := a.replaceSession(ctx, stored.Token, &session); err != nil {
+		return nil, nil, err
+	}
+	a.repointRefresh(ctx, stored.Token, &session)
+	return a.withToken(&session, token), a.withToken(stored, oldToken), nil
+}
+
+// Перенаправляет refresh-токен пары (см. CreateSessionPair) со старого ключа сессии на новый, чтобы Refresh удалил
+// перевыпущенную сессию. Ошибка только пишется в лог: перевыпуск уже состоялся
+func (a *Auth) repointRefresh(ctx context.Context, oldKey string, session *Session) {
+	if session.Pair == "" {
+		return
+	}
+	refresh, err := a.store.Get(ctx, session.Pair)
+	if err != nil || refresh.Kind != SessionKindRefresh || refresh.Pair != oldKey {
+		return
+	}
+	refresh.Pair = session.Token
+	if err := a.updateSession(ctx, refresh); err != nil && !errors.Is(err, SessionNotFoundError) {
+		a.logStoreError(ctx, "failed to repoint refresh token", err)
+	}
+}
+
+// Опции новой сессии при перевыпуске без хранилища: пользователь, роли, права и время создания старой сессии, затем
+// опции вызывающего. Время создания нужно, чтобы перевыпуск не сдвигал MaxLifetime
+func regeneratedOptions(old *Session, sessionOptions []SessionOption) []SessionOption {
+	created := func(s *Session) {
+		s.CreatedAt = old.CreatedAt
+	}
+	return append([]SessionOption{inheritSession(old), created}, sessionOptions...)
+}
+
+// Заменяет сохранённую сессию сессией с другим токеном. Без Replacer новая сессия сохраняется до удаления старой,
+// чтобы сбой между шагами не оставил пользователя без сессии
+func (a *Auth) replaceSession(ctx context.Context, oldKey string, session *Session) error {
+	if replacer, ok := storeAs[Replacer](a.store); ok {
+		return replacer.Replace(ctx, oldKey, session)
+	}
+
+	if err := a.store.Save(ctx, session); err != nil {
+		return err
+	}
+	if err := a.store.Delete(ctx, oldKey); err != nil {
+		_ = a.store.Delete(ctx, session.Token)
+		return err
+	}
+	return nil
+}
+
+// Перевыпускает токен сессии запроса (см. RegenerateSession). Если токен пришёл в cookie (см. CookieSource), cookie
+// перезаписывается; иначе новый токен нужно вернуть клиенту самому. Сессия в контексте запроса не меняется: она
+// может быть общей с другим кодом. Вместо этого возвращается запрос, в контексте которого лежит новая сессия, и
+// дальше стоит работать с ним.
+//
+// Пример:
+//
+//	mux.HandleFunc("POST /sudo", func(w http.ResponseWriter, r *http.Request) {
+//	    if !checkPassword(r) {
+//	        http.Error(w, "Forbidden", http.StatusForbidden)
+//	        return
+//	    }
+//	    session, r, err := auth.Regenerate(w, r, knocknock.WithScopes("sudo"))
+//	    if err != nil {
+//	        http.Error(w, "Failed to regenerate session", http.StatusInternalServerError)
+//	        return
+//	    }
+//	    renderSudo(w, r, session)
+//	})
+func (a *Auth) Regenerate(w http.ResponseWriter, r *http.Request, sessionOptions ...SessionOption) (*Session, *http.Request, error) {
+	token, source, err := a.lookupToken(r)
+	if err != nil {
+		return nil, r, err
+	}
+	if token == "" {
+		return nil, r, TokenMissingError
+	}
+	if !a.validToken(token) {
+		return nil, r, InvalidTokenError
+	}
+
+	session, err := a.RegenerateSession(a.auditContext(r).Context(), token, sessionOptions...)
+	if err != nil {
+		return nil, r, err
+	}
+
+	if _, cookie := source.(cookieSource); cookie {
+		if err := a.SetSessionCookie(w, r, session); err != nil {
+			return nil, r, err
+		}
+		skipReseal(w)
+	}
+	return session, r.WithContext(context.WithValue(r.Context(), SessionContextKey, session)), nil
+}
@@ -0,0 +1,227 @@
+package knocknock
+
+/*
+ * require.go содержит middleware, которое пропускает дальше только запросы с действующей сессией. Отказ по умолчанию
+ * оформляется по RFC 6750: 401 с заголовком WWW-Authenticate: Bearer. Если токена в запросе нет, код ошибки в вызове
+ * не указывается, а для протухшего или неверного токена указывается error="invalid_token". Сессии, которой не хватает
+ * ролей или прав (см. authorize.go), отвечают 403 с error="insufficient_scope"
+ */
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Обработчик отказа в доступе. err -- причина: TokenMissingError, SessionExpiredError, SessionNotFoundError,
+// InvalidTokenError, TokenConflictError или ошибка хранилища
+type UnauthorizedHandler func(w http.ResponseWriter, r *http.Request, err error)
+
+// Структура настроек RequireAuth через функциональные опции
+type RequireAuthOptions struct {
+	Realm               string              // Значение realm в вызове WWW-Authenticate. Пустое не указывается
+	UnauthorizedHandler UnauthorizedHandler // Свой ответ на отказ. nil -- ответ по RFC 6750
+	ForbiddenHandler    UnauthorizedHandler // Свой ответ, если сессии не хватает ролей или прав (см. Authorize)
+	LoginURL            string              // Страница входа для HTML-маршрутов. Пустая -- без перенаправления
+	RedirectParam       string              // Имя query-параметра страницы входа, в котором передаётся исходный адрес
+}
+
+type RequireAuthOption func(*RequireAuthOptions)
+
+// Функциональная опция для установки realm в вызове WWW-Authenticate
+func WithRealm(realm string) RequireAuthOption {
+	return func(o *RequireAuthOptions) {
+		o.Realm = realm
+	}
+}
+
+// Функциональная опция для установки своего ответа на отказ
+func WithUnauthorizedHandler(handler UnauthorizedHandler) RequireAuthOption {
+	return func(o *RequireAuthOptions) {
+		o.UnauthorizedHandler = handler
+	}
+}
+
+// Функциональная опция для установки своего ответа, если сессии не хватает ролей или прав. В обработчик передаётся
+// InsufficientScopeError
+func WithForbiddenHandler(handler UnauthorizedHandler) RequireAuthOption {
+	return func(o *RequireAuthOptions) {
+		o.ForbiddenHandler = handler
+	}
+}
+
+// Функциональная опция для перенаправления на страницу входа. Перенаправляются только запросы, принимающие HTML
+// (браузерные переходы), остальным по-прежнему отвечает UnauthorizedHandler или 401. Исходный адрес передаётся в
+// параметре next
+func WithLoginRedirect(loginURL string) RequireAuthOption {
+	return func(o *RequireAuthOptions) {
+		o.LoginURL = loginURL
+	}
+}
+
+// Функциональная опция для установки имени параметра с исходным адресом при перенаправлении на страницу входа
+func WithRedirectParam(name string) RequireAuthOption {
+	return func(o *RequireAuthOptions) {
+		o.RedirectParam = name
+	}
+}
+
+// Создаёт и возвращает конфигурацию RequireAuth по умолчанию
+func defaultRequireAuthOptions() *RequireAuthOptions {
+	return &RequireAuthOptions{
+		RedirectParam: "next",
+	}
+}
+
+// Создаёт HTTP middleware, которое отклоняет запросы без действующей сессии. Если перед ним стоит Middleware,
+// используется уже найденная сессия, иначе токен извлекается здесь же, а сессия кладётся в контекст.
+//
+// Пример:
+//
+//	mux.Handle("/api/", auth.RequireAuth()(apiHandler))
+//	mux.Handle("/account", auth.RequireAuth(knocknock.WithLoginRedirect("/login"))(accountPage))
+func (a *Auth) RequireAuth(requireAuthOptions ...RequireAuthOption) func(http.Handler) http.Handler {
+	return a.guard(nil, requireAuthOptions)
+}
+
+// Общая часть RequireAuth и Authorize: требует сессию и, если задано правило, проверяет его
+func (a *Auth) guard(rule *Rule, requireAuthOptions []RequireAuthOption) func(http.Handler) http.Handler {
+	opts := defaultRequireAuthOptions()
+	for _, opt := range requireAuthOptions {
+		opt(opts)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r = a.auditContext(r)
+			session, r, err := a.requestSession(r)
+			if err != nil {
+				a.deny(r, "require", nil, err)
+				opts.unauthorized(w, r, err)
+				return
+			}
+
+			if rule != nil && !rule.allows(a, session) {
+				a.deny(r, "require", session, InsufficientScopeError)
+				opts.forbidden(w, r, rule)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Сессия запроса для RequireAuth, Authorize, PolicyRouter и CSRF. Если впереди стоит Middleware, берётся его
+// результат, сессия или причина отказа, и хранилище второй раз не спрашивается. Иначе сессия ищется здесь же и
+// кладётся в контекст возвращённого запроса
+func (a *Auth) requestSession(r *http.Request) (*Session, *http.Request, error) {
+	if session := GetSession(r.Context()); session != nil {
+		return session, r, nil
+	}
+	if err, ok := r.Context().Value(rejectionContextKey).(error); ok {
+		return nil, r, err
+	}
+	session, err := a.authenticate(r)
+	if err != nil {
+		return nil, r, err
+	}
+	return session, r.WithContext(context.WithValue(r.Context(), SessionContextKey, session)), nil
+}
+
+// Находит сессию запроса и объясняет, почему её нет
+func (a *Auth) authenticate(r *http.Request) (*Session, error) {
+	token, _, err := a.lookupToken(r)
+	switch {
+	case err != nil:
+		return nil, err
+	case token == "":
+		return nil, TokenMissingError
+	case !a.validToken(token):
+		return nil, InvalidTokenError
+	}
+	return a.GetSession(r.Context(), token)
+}
+
+// Отвечает на запрос без действующей сессии
+func (o *RequireAuthOptions) unauthorized(w http.ResponseWriter, r *http.Request, err error) {
+	if o.LoginURL != "" && acceptsHTML(r) {
+		http.Redirect(w, r, o.loginRedirect(r), http.StatusSeeOther)
+		return
+	}
+
+	if o.UnauthorizedHandler != nil {
+		o.UnauthorizedHandler(w, r, err)
+		return
+	}
+
+	// Несколько токенов в одном запросе -- ошибка запроса, а не токена (RFC 6750, раздел 3.1)
+	status := http.StatusUnauthorized
+	if errors.Is(err, TokenConflictError) {
+		status = http.StatusBadRequest
+	}
+	w.Header().Set("WWW-Authenticate", bearerChallenge(o.Realm, err))
+	http.Error(w, http.StatusText(status), status)
+}
+
+// Отвечает на запрос, сессии которого не хватает ролей или прав: 403 с вызовом insufficient_scope по RFC 6750
+func (o *RequireAuthOptions) forbidden(w http.ResponseWriter, r *http.Request, rule *Rule) {
+	if o.ForbiddenHandler != nil {
+		o.ForbiddenHandler(w, r, InsufficientScopeError)
+		return
+	}
+
+	params := []string{`error="insufficient_scope"`}
+	if o.Realm != "" {
+		params = append([]string{"realm=" + strconv.Quote(o.Realm)}, params...)
+	}
+	if len(rule.scope) > 0 {
+		params = append(params, "scope="+strconv.Quote(strings.Join(rule.scope, " ")))
+	}
+
+	w.Header().Set("WWW-Authenticate", "Bearer "+strings.Join(params, ", "))
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+}
+
+// Адрес страницы входа с исходным адресом запроса в параметре RedirectParam
+func (o *RequireAuthOptions) loginRedirect(r *http.Request) string {
+	login, err := url.Parse(o.LoginURL)
+	if err != nil {
+		return o.LoginURL
+	}
+	query := login.Query()
+	query.Set(o.RedirectParam, r.URL.RequestURI())
+	login.RawQuery = query.Encode()
+	return login.String()
+}
+
+// Формирует вызов WWW-Authenticate по RFC 6750. Для запроса без токена код ошибки не указывается (раздел 3.1)
+func bearerChallenge(realm string, err error) string {
+	var params []string
+	if realm != "" {
+		params = append(params, "realm="+strconv.Quote(realm))
+	}
+
+	switch {
+	case errors.Is(err, TokenMissingError):
+	case errors.Is(err, TokenConflictError):
+		params = append(params, `error="invalid_request"`, `error_description="The request has conflicting tokens"`)
+	case errors.Is(err, SessionExpiredError):
+		params = append(params, `error="invalid_token"`, `error_description="The access token expired"`)
+	default:
+		params = append(params, `error="invalid_token"`, `error_description="The access token is invalid"`)
+	}
+
+	if len(params) == 0 {
+		return "Bearer"
+	}
+	return "Bearer " + strings.Join(params, ", ")
+}
+
+// Принимает ли клиент HTML. Так отличаются браузерные переходы от запросов API
+func acceptsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
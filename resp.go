@@ -0,0 +1,431 @@
+package knocknock
+
+/*
+ * resp.go содержит минимальный клиент протокола Redis (RESP2 и RESP3) с пулом соединений. Его хватает ровно на то,
+ * что нужно RedisStore (store_redis.go), поэтому сторонние зависимости не требуются
+ */
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Ошибка, которую вернул сервер Redis в ответ на команду
+type RedisError string
+
+func (e RedisError) Error() string {
+	return string(e)
+}
+
+// Момент времени в прошлом, установка которого как дедлайна прерывает блокирующие операции с соединением
+var respDeadlineInPast = time.Unix(1, 0)
+
+// Одно соединение с сервером
+type respConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// Отправляет команду и читает ответ. Ответ раскладывается в Go-значения: простые строки -- string, bulk-строки --
+// []byte, целые -- int64, массивы и множества -- []any, словари -- map[string]any, null -- nil
+func (c *respConn) do(args ...string) (any, error) {
+	if err := c.write(args); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// Выполняет команды одной транзакцией MULTI/EXEC и возвращает ответ EXEC: массив ответов команд. Команды
+// отправляются одним пакетом, подтверждения постановки в очередь пропускаются: ошибка в любой из них приходит
+// в ответе EXEC (EXECABORT). Если транзакция прошла, но одна из команд вернула ошибку, ответом будет эта ошибка
+func (c *respConn) multi(commands [][]string) (any, error) {
+	if err := c.write([]string{"MULTI"}); err != nil {
+		return nil, err
+	}
+	for _, command := range commands {
+		if err := c.write(command); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.write([]string{"EXEC"}); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	for range len(commands) + 1 {
+		if _, err := c.read(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := c.read()
+	if replies, ok := reply.([]any); ok {
+		for _, item := range replies {
+			if redisErr, ok := item.(RedisError); ok {
+				return redisErr, err
+			}
+		}
+	}
+	return reply, err
+}
+
+// Записывает команду как массив bulk-строк
+func (c *respConn) write(args []string) error {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n", len(arg))
+		c.w.WriteString(arg)
+		if _, err := c.w.WriteString("\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Читает строку ответа без завершающего \r\n
+func (c *respConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("knocknock: malformed RESP line %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+// Читает один ответ сервера. Ошибки Redis возвращаются как значение типа RedisError, а не как ошибка чтения, чтобы
+// ответы внутри массивов не рвали разбор
+func (c *respConn) read() (any, error) {
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			return nil, errors.New("knocknock: empty RESP line")
+		}
+
+		kind, payload := line[0], line[1:]
+		switch kind {
+		case '+':
+			return payload, nil
+		case '-':
+			return RedisError(payload), nil
+		case ':':
+			return strconv.ParseInt(payload, 10, 64)
+		case '_':
+			return nil, nil
+		case '#':
+			return payload == "t", nil
+		case ',':
+			return strconv.ParseFloat(payload, 64)
+		case '(':
+			return payload, nil
+		case '$', '=', '!':
+			blob, err := c.readBlob(payload)
+			if err != nil || blob == nil {
+				return nil, err
+			}
+			if kind == '=' && len(blob) >= 4 {
+				blob = blob[4:] // Отбрасываем формат вида "txt:"
+			}
+			if kind == '!' {
+				return RedisError(blob), nil
+			}
+			return blob, nil
+		case '*', '~':
+			return c.readArray(payload)
+		case '%':
+			return c.readMap(payload)
+		case '>', '|':
+			// Push-сообщения и атрибуты не относятся к ответу на команду: пропускаем их
+			if _, err := c.readAggregate(payload, kind == '|'); err != nil {
+				return nil, err
+			}
+			continue
+		default:
+			return nil, fmt.Errorf("knocknock: unknown RESP type %q", kind)
+		}
+	}
+}
+
+// Читает тело bulk-строки заданной длины. Длина -1 означает null в RESP2
+func (c *respConn) readBlob(length string) ([]byte, error) {
+	n, err := strconv.Atoi(length)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, nil
+	}
+
+	blob := make([]byte, n+2)
+	if _, err := io.ReadFull(c.r, blob); err != nil {
+		return nil, err
+	}
+	return blob[:n], nil
+}
+
+// Читает массив или множество. Длина -1 означает null в RESP2
+func (c *respConn) readArray(length string) (any, error) {
+	n, err := strconv.Atoi(length)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, nil
+	}
+
+	items := make([]any, n)
+	for i := range items {
+		if items[i], err = c.read(); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// Читает словарь RESP3. Ключи приводятся к строкам
+func (c *respConn) readMap(length string) (any, error) {
+	items, err := c.readAggregate(length, true)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]any, len(items)/2)
+	for i := 0; i+1 < len(items); i += 2 {
+		result[respString(items[i])] = items[i+1]
+	}
+	return result, nil
+}
+
+// Читает агрегат из n (или 2n для словарей) элементов
+func (c *respConn) readAggregate(length string, pairs bool) ([]any, error) {
+	n, err := strconv.Atoi(length)
+	if err != nil {
+		return nil, err
+	}
+	if pairs {
+		n *= 2
+	}
+
+	items := make([]any, n)
+	for i := range items {
+		if items[i], err = c.read(); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// Приводит строковый ответ сервера к string
+func respString(reply any) string {
+	switch v := reply.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Настройки соединения с сервером
+type respDialer struct {
+	addr        string
+	username    string
+	password    string
+	db          int
+	protocol    int
+	dialTimeout time.Duration
+}
+
+// Открывает соединение и выполняет рукопожатие: выбор протокола, авторизация и выбор базы
+func (d *respDialer) dial(ctx context.Context) (*respConn, error) {
+	dialer := net.Dialer{Timeout: d.dialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &respConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := d.handshake(c); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return c, nil
+}
+
+// Договаривается о протоколе. Если сервер не знает HELLO (Redis до 6.0), остаётся на RESP2
+func (d *respDialer) handshake(c *respConn) error {
+	authenticated := false
+
+	if d.protocol == 3 {
+		args := []string{"HELLO", "3"}
+		if d.password != "" {
+			args = append(args, "AUTH", d.usernameOrDefault(), d.password)
+		}
+
+		reply, err := c.do(args...)
+		if err != nil {
+			return err
+		}
+		if _, failed := reply.(RedisError); !failed {
+			authenticated = true
+		}
+	}
+
+	if !authenticated && d.password != "" {
+		args := []string{"AUTH", d.password}
+		if d.username != "" {
+			args = []string{"AUTH", d.username, d.password}
+		}
+		if err := expectOK(c.do(args...)); err != nil {
+			return err
+		}
+	}
+
+	if d.db != 0 {
+		if err := expectOK(c.do("SELECT", strconv.Itoa(d.db))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Имя пользователя для HELLO AUTH. Без ACL в Redis есть только пользователь default
+func (d *respDialer) usernameOrDefault() string {
+	if d.username == "" {
+		return "default"
+	}
+	return d.username
+}
+
+// Превращает ответ-ошибку сервера в ошибку Go
+func expectOK(reply any, err error) error {
+	if err != nil {
+		return err
+	}
+	if redisErr, ok := reply.(RedisError); ok {
+		return redisErr
+	}
+	return nil
+}
+
+// Пул соединений. Число одновременно открытых соединений ограничено семафором, ожидание свободного слота
+// прерывается контекстом
+type respPool struct {
+	dialer *respDialer
+	sem    chan struct{}
+	idle   chan *respConn
+}
+
+// Создаёт пул не более чем на size соединений
+func newRespPool(dialer *respDialer, size int) *respPool {
+	if size <= 0 {
+		size = 1
+	}
+	return &respPool{
+		dialer: dialer,
+		sem:    make(chan struct{}, size),
+		idle:   make(chan *respConn, size),
+	}
+}
+
+// Выполняет команду на соединении из пула. Контекст ограничивает и ожидание соединения, и саму команду: при отмене
+// контекста соединение прерывается и выбрасывается из пула
+func (p *respPool) do(ctx context.Context, args ...string) (any, error) {
+	return p.run(ctx, func(c *respConn) (any, error) {
+		return c.do(args...)
+	})
+}
+
+// Выполняет команды транзакцией MULTI/EXEC на одном соединении из пула (см. respConn.multi)
+func (p *respPool) multi(ctx context.Context, commands ...[]string) (any, error) {
+	return p.run(ctx, func(c *respConn) (any, error) {
+		return c.multi(commands)
+	})
+}
+
+// Выполняет call на соединении из пула с ограничениями контекста, как do
+func (p *respPool) run(ctx context.Context, call func(c *respConn) (any, error)) (any, error) {
+	select {
+	case p.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-p.sem }()
+
+	c, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.conn.SetDeadline(time.Time{})
+	stop := context.AfterFunc(ctx, func() {
+		c.conn.SetDeadline(respDeadlineInPast)
+	})
+
+	reply, err := call(c)
+
+	if !stop() || err != nil {
+		c.conn.Close()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+
+	p.put(c)
+	return reply, nil
+}
+
+// Берёт свободное соединение или открывает новое
+func (p *respPool) get(ctx context.Context) (*respConn, error) {
+	select {
+	case c := <-p.idle:
+		return c, nil
+	default:
+		return p.dialer.dial(ctx)
+	}
+}
+
+// Возвращает соединение в пул
+func (p *respPool) put(c *respConn) {
+	select {
+	case p.idle <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+// Закрывает все свободные соединения
+func (p *respPool) close() {
+	for {
+		select {
+		case c := <-p.idle:
+			c.conn.Close()
+		default:
+			return
+		}
+	}
+}
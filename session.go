@@ -7,16 +7,37 @@ package knocknock
 import "time"
 
 // UserData представляет пользовательские данные, хранимые в сессии. Может быть любого типа.
-type UserData = any // TODO(tolstovrob): think about generics
-
-// Структура сессии
-type Session struct {
-	Token     string    `json:"token"`     // Токен сессии
-	UserData  UserData  `json:"userData"`  // Информация о пользователе
-	CreatedAt time.Time `json:"createdAt"` // Время создания
-	ExpiresAt time.Time `json:"expiresAt"` // Время истечения
+type UserData = any
+
+// Вид сессии
+type SessionKind string
+
+const (
+	SessionKindAccess  SessionKind = ""        // Обычная сессия, которой авторизуются запросы
+	SessionKindRefresh SessionKind = "refresh" // Refresh-токен из пары (см. refresh.go). Запросы им не авторизуются
+	SessionKindRevoked SessionKind = "revoked" // Служебная запись: отозванный подписанный токен (см. jwt.go) или отметка о ротации refresh-токена (см. refresh.go)
+)
+
+// Структура сессии с пользовательскими данными типа T. Для типизированной работы см. TypedAuth (typed.go)
+type TypedSession[T any] struct {
+	Token          string      `json:"token"`                   // Токен сессии
+	UserData       T           `json:"userData"`                // Информация о пользователе
+	Subject        string      `json:"subject,omitempty"`       // Идентификатор пользователя, которому принадлежит сессия
+	Roles          []string    `json:"roles,omitempty"`         // Роли пользователя (см. RequireRoles)
+	Scopes         []string    `json:"scopes,omitempty"`        // Выданные сессии права доступа (см. RequireScopes)
+	CreatedAt      time.Time   `json:"createdAt"`               // Время создания
+	ExpiresAt      time.Time   `json:"expiresAt"`               // Время истечения
+	LastAccessedAt time.Time   `json:"lastAccessedAt,omitzero"` // Время последнего обращения. Обновляется не на каждый запрос, см. WithTouchInterval
+	Kind           SessionKind `json:"kind,omitempty"`          // Вид сессии
+	Pair           string      `json:"pair,omitempty"`          // Для refresh-токена: токен выданной вместе с ним сессии, для сессии из пары -- токен её refresh-токена
+	ReplacedBy     string      `json:"replacedBy,omitempty"`    // Для refresh-токена: токен, которым его заменили при ротации
+	Verifier       string      `json:"verifier,omitempty"`      // SHA-256 верификатора для токенов "селектор.верификатор"
+	CSRFToken      string      `json:"csrfToken,omitempty"`     // Синхронизирующий CSRF-токен (см. csrf.go). Создаётся при первом запросе
 }
 
+// Структура сессии с данными произвольного типа. Именно с ней работают Auth и хранилища
+type Session = TypedSession[UserData]
+
 // Создает новую сессию с указанным токеном, пользовательскими данными и сроком жизни. Важно: третий аргумент expiresIn
 // отвечает именно за время жизни, а значит в структуре Session в поле createdAt будет текущее время, а в expiresAt --
 // текущее время + expiresIn.
@@ -30,7 +51,41 @@ func MakeSession(token string, userData UserData, expiresIn time.Duration) *Sess
 	return ss
 }
 
+// Функциональная опция сессии. Передаётся в Auth.CreateSession и применяется к сессии перед сохранением
+type SessionOption func(*Session)
+
+// Опция сессии для установки идентификатора пользователя. По нему работают Auth.ListSessions и
+// Auth.RevokeAllSessions
+func WithSubject(subject string) SessionOption {
+	return func(s *Session) {
+		s.Subject = subject
+	}
+}
+
+// Опция сессии для установки ролей пользователя
+func WithRoles(roles ...string) SessionOption {
+	return func(s *Session) {
+		s.Roles = roles
+	}
+}
+
+// Опция сессии для установки прав доступа, например "orders:write"
+func WithScopes(scopes ...string) SessionOption {
+	return func(s *Session) {
+		s.Scopes = scopes
+	}
+}
+
+// Опция сессии, переносящая служебные данные (но не токен и не сроки) с другой сессии
+func inheritSession(source *Session) SessionOption {
+	return func(s *Session) {
+		s.Subject = source.Subject
+		s.Roles = source.Roles
+		s.Scopes = source.Scopes
+	}
+}
+
 // Проверяет, истекла ли сессия
-func (s *Session) IsExpired() bool {
+func (s *TypedSession[T]) IsExpired() bool {
 	return time.Now().After(s.ExpiresAt)
 }
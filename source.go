@@ -0,0 +1,176 @@
+package knocknock
+
+/*
+ * source.go содержит источники токена запроса. По умолчанию токен ищется в заголовке HeaderName, затем в
+ * query-параметре QueryParamName, затем в cookie CookieName. WithTokenSources задаёт свой порядок и набор: например,
+ * убирает query-параметр, токены из которого попадают в логи доступа и заголовок Referer.
+ *
+ * Побеждает первый источник, нашедший токен. В строгом режиме (WithStrictTokenSources) опрашиваются все источники,
+ * и запрос с разными токенами из разных источников отклоняется с TokenConflictError
+ */
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Источник токена запроса. Возвращает пустую строку, если токена в запросе нет
+type TokenSource interface {
+	Token(r *http.Request) string
+}
+
+// Функция как источник токена
+//
+// Пример:
+//
+//	knocknock.TokenSourceFunc(func(r *http.Request) string {
+//	    return r.Header.Get("X-Api-Key")
+//	})
+type TokenSourceFunc func(r *http.Request) string
+
+func (f TokenSourceFunc) Token(r *http.Request) string {
+	return f(r)
+}
+
+type headerSource string
+
+// Источник токена из HTTP-заголовка. Префикс "Bearer " отбрасывается
+func HeaderSource(name string) TokenSource {
+	return headerSource(name)
+}
+
+func (s headerSource) Token(r *http.Request) string {
+	header := r.Header.Get(string(s))
+	if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+		return token
+	}
+	return header
+}
+
+type querySource string
+
+// Источник токена из query-параметра
+func QuerySource(name string) TokenSource {
+	return querySource(name)
+}
+
+func (s querySource) Token(r *http.Request) string {
+	return r.URL.Query().Get(string(s))
+}
+
+type cookieSource string
+
+// Источник токена из cookie. Части длинного токена (см. CookieStore) склеиваются. Только запросы, токен которых дал
+// этот источник, проверяются CSRF.Middleware
+func CookieSource(name string) TokenSource {
+	return cookieSource(name)
+}
+
+func (s cookieSource) Token(r *http.Request) string {
+	return readChunkedCookie(r, string(s))
+}
+
+type formSource string
+
+// Наибольший размер тела формы, которое разбирает FormSource
+const maxFormSourceBody = 64 << 10
+
+// Источник токена из поля формы в теле POST-запроса. Читаются только формы application/x-www-form-urlencoded
+// с известной длиной не больше 64 КиБ: multipart, большие формы, тела без Content-Length и другие тела не трогаются,
+// чтобы поиск токена не съедал их до обработчика. Форма разбирается в r.PostForm, и обработчик получает её через
+// r.PostFormValue как обычно
+func FormSource(name string) TokenSource {
+	return formSource(name)
+}
+
+func (s formSource) Token(r *http.Request) string {
+	if r.PostForm == nil {
+		// Тело длиннее предела пришлось бы прочитать целиком или оборвать: и то и другое лишает обработчик формы
+		if r.Method != http.MethodPost || r.Body == nil || r.ContentLength < 0 || r.ContentLength > maxFormSourceBody {
+			return ""
+		}
+		if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil ||
+			mediaType != "application/x-www-form-urlencoded" {
+			return ""
+		}
+		if err := r.ParseForm(); err != nil {
+			return ""
+		}
+	}
+	return r.PostForm.Get(string(s))
+}
+
+// Упорядоченный набор источников
+type tokenSources []TokenSource
+
+func (s *tokenSources) Token(r *http.Request) string {
+	for _, source := range *s {
+		if token := source.Token(r); token != "" {
+			return token
+		}
+	}
+	return ""
+}
+
+// Функциональная опция для установки источников токена в порядке приоритета.
+//
+// Пример:
+//
+//	auth := knocknock.HandleAuth(store, knocknock.WithTokenSources(
+//	    knocknock.HeaderSource("Authorization"),
+//	    knocknock.CookieSource("session_token"),
+//	))
+func WithTokenSources(sources ...TokenSource) AuthOption {
+	// Набор хранится по указателю, чтобы AuthOptions оставалась сравнимой
+	chain := tokenSources(sources)
+	return func(o *AuthOptions) {
+		o.TokenSource = &chain
+	}
+}
+
+// Функциональная опция для строгого режима: запрос, в котором источники дают разные токены, отклоняется
+func WithStrictTokenSources() AuthOption {
+	return func(o *AuthOptions) {
+		o.StrictTokenSources = true
+	}
+}
+
+// Источники токена в порядке приоритета. Набор по умолчанию собирается из текущих AuthOptions, чтобы
+// UpdateAuthOptions с новым именем заголовка или cookie действовал сразу
+func (a *Auth) tokenSources() []TokenSource {
+	switch source := a.AuthOptions.TokenSource.(type) {
+	case nil:
+		return []TokenSource{
+			HeaderSource(a.AuthOptions.HeaderName),
+			QuerySource(a.AuthOptions.QueryParamName),
+			CookieSource(a.AuthOptions.CookieName),
+		}
+	case *tokenSources:
+		return *source
+	default:
+		return []TokenSource{source}
+	}
+}
+
+// Находит токен в запросе без проверки формата и возвращает источник, который его дал. В строгом режиме при разных
+// токенах из разных источников возвращает TokenConflictError
+func (a *Auth) lookupToken(r *http.Request) (string, TokenSource, error) {
+	var token string
+	var found TokenSource
+	for _, source := range a.tokenSources() {
+		candidate := source.Token(r)
+		if candidate == "" {
+			continue
+		}
+		if found == nil {
+			token, found = candidate, source
+			if !a.AuthOptions.StrictTokenSources {
+				break
+			}
+		} else if candidate != token {
+			return "", nil, TokenConflictError
+		}
+	}
+	return token, found, nil
+}
@@ -1,12 +1,15 @@
 package knocknock
 
 /*
- * В store.go описан интерфейс для реализации методов работы с любым хранилищем. Библиотека поставляет лишь in-memory
- * хранилище (store_memory.go), оставляя остальное на усмотрение программиста
+ * В store.go описан интерфейс для реализации методов работы с любым хранилищем. Библиотека поставляет in-memory
+ * хранилище (store_memory.go), файловое (store_file.go), SQL (store_sql.go), Redis (store_redis.go) и хранилище
+ * в самой cookie (store_cookie.go); свои реализации подключаются через тот же интерфейс
  */
 
 import (
 	"context"
+	"log/slog"
+	"reflect"
 )
 
 // Интерфейс для хранилища сессий. Реализации должны обеспечивать сохранение, получение и удаление сессий.
@@ -15,3 +18,196 @@ type Store interface {
 	Get(ctx context.Context, token string) (*Session, error)
 	Delete(ctx context.Context, token string) error
 }
+
+// Необязательная возможность хранилища: перезапись уже сохранённой сессии. Нужна, например, для скользящего
+// истечения (см. WithIdleTimeout). Если сессии с таким токеном нет, реализация должна вернуть SessionNotFoundError.
+// Если хранилище её не реализует, Auth перезаписывает ещё существующую сессию через Delete и Save, и удаление,
+// совпавшее с перезаписью, может не сработать
+type Updater interface {
+	Update(ctx context.Context, session *Session) error
+}
+
+// Необязательная возможность хранилища: поиск сессий по Session.Subject. Нужна для Auth.ListSessions и
+// Auth.RevokeAllSessions. Реализация возвращает все сессии пользователя, включая протухшие и refresh-токены:
+// фильтрует их Auth
+type SubjectIndexer interface {
+	ListBySubject(ctx context.Context, subject string) ([]*Session, error)
+}
+
+// Необязательная возможность хранилища: атомарная замена сессии oldToken сессией с другим токеном. Если сессии
+// oldToken уже нет, реализация должна вернуть SessionNotFoundError и ничего не сохранять: так из двух одновременных
+// Auth.RegenerateSession с одним токеном выигрывает только один. Если хранилище её не реализует, Auth сохраняет
+// новую сессию и удаляет старую по отдельности
+type Replacer interface {
+	Replace(ctx context.Context, oldToken string, session *Session) error
+}
+
+// Необязательная возможность хранилища: сообщать о протухших сессиях, которые хранилище удалило само, например при
+// очистке. Auth подписывается в HandleAuth, и такие сессии попадают в OnExpire (см. hooks.go). Возвращаемая функция
+// снимает обработчик: её вызывает Auth.Close, иначе хранилище держит Auth до конца работы программы
+type ExpiryNotifier interface {
+	NotifyExpired(handler func(session *Session)) (unregister func())
+}
+
+// Необязательная возможность хранилища: сообщить число активных (не протухших) сессий. Используется для метрик
+// (см. metrics.go). Реализуется MemoryStore
+type SessionCounter interface {
+	ActiveSessions() int
+}
+
+// Хранилище-обёртка над другим хранилищем, например InstrumentStore. Обёртки прозрачны для необязательных
+// возможностей: Auth видит у обёртки только те из них, что есть у обёрнутого хранилища
+type StoreWrapper interface {
+	Unwrap() Store
+}
+
+// Находит у хранилища необязательную возможность T. У обёртки (StoreWrapper) возможность есть, только если она есть
+// у всей цепочки обёрнутых хранилищ
+func storeAs[T any](store Store) (T, bool) {
+	capable, ok := store.(T)
+	for inner := store; ok; {
+		wrapper, wrapped := inner.(StoreWrapper)
+		if !wrapped {
+			return capable, true
+		}
+		inner = wrapper.Unwrap()
+		_, ok = inner.(T)
+	}
+	var zero T
+	return zero, false
+}
+
+// Хранилище под всеми обёртками (StoreWrapper)
+func unwrapStore(store Store) Store {
+	for {
+		wrapper, ok := store.(StoreWrapper)
+		if !ok {
+			return store
+		}
+		store = wrapper.Unwrap()
+	}
+}
+
+// Имя типа хранилища без пакета и указателя, например MemoryStore. У обёртки это имя обёрнутого хранилища
+func storeName(store Store) string {
+	t := reflect.TypeOf(unwrapStore(store))
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if name := t.Name(); name != "" {
+		return name
+	}
+	return t.String()
+}
+
+// Обёртка хранилища, вызывающая around вокруг каждого его метода. Основа InstrumentStore и TraceStore. Реализует
+// все необязательные возможности, но Auth видит только те, что есть у обёрнутого хранилища (см. storeAs)
+type wrappedStore struct {
+	store  Store
+	name   string
+	around func(ctx context.Context, method string, call func(ctx context.Context) error) error
+}
+
+func (s *wrappedStore) Unwrap() Store {
+	return s.store
+}
+
+func (s *wrappedStore) Save(ctx context.Context, session *Session) error {
+	return s.around(ctx, "Save", func(ctx context.Context) error {
+		return s.store.Save(ctx, session)
+	})
+}
+
+func (s *wrappedStore) Get(ctx context.Context, token string) (session *Session, err error) {
+	err = s.around(ctx, "Get", func(ctx context.Context) error {
+		session, err = s.store.Get(ctx, token)
+		return err
+	})
+	return session, err
+}
+
+func (s *wrappedStore) Delete(ctx context.Context, token string) error {
+	return s.around(ctx, "Delete", func(ctx context.Context) error {
+		return s.store.Delete(ctx, token)
+	})
+}
+
+func (s *wrappedStore) Update(ctx context.Context, session *Session) error {
+	updater, ok := s.store.(Updater)
+	if !ok {
+		return StoreUnsupportedError
+	}
+	return s.around(ctx, "Update", func(ctx context.Context) error {
+		return updater.Update(ctx, session)
+	})
+}
+
+func (s *wrappedStore) Replace(ctx context.Context, oldToken string, session *Session) error {
+	replacer, ok := s.store.(Replacer)
+	if !ok {
+		return StoreUnsupportedError
+	}
+	return s.around(ctx, "Replace", func(ctx context.Context) error {
+		return replacer.Replace(ctx, oldToken, session)
+	})
+}
+
+func (s *wrappedStore) ListBySubject(ctx context.Context, subject string) (sessions []*Session, err error) {
+	indexer, ok := s.store.(SubjectIndexer)
+	if !ok {
+		return nil, StoreUnsupportedError
+	}
+	err = s.around(ctx, "ListBySubject", func(ctx context.Context) error {
+		sessions, err = indexer.ListBySubject(ctx, subject)
+		return err
+	})
+	return sessions, err
+}
+
+func (s *wrappedStore) NotifyExpired(handler func(session *Session)) func() {
+	if notifier, ok := s.store.(ExpiryNotifier); ok {
+		return notifier.NotifyExpired(handler)
+	}
+	return func() {}
+}
+
+func (s *wrappedStore) SetLogger(logger *slog.Logger) {
+	if receiver, ok := s.store.(LogReceiver); ok {
+		receiver.SetLogger(logger)
+	}
+}
+
+// Вторичный индекс токенов по Session.Subject для хранилищ, которые держат сессии в памяти. Не потокобезопасен:
+// защищается блокировкой хранилища
+type subjectIndex map[string]map[string]struct{}
+
+// Добавляет сессию в индекс. Сессии без Subject не индексируются
+func (idx subjectIndex) add(session *Session) {
+	if session.Subject == "" {
+		return
+	}
+	if idx[session.Subject] == nil {
+		idx[session.Subject] = make(map[string]struct{})
+	}
+	idx[session.Subject][session.Token] = struct{}{}
+}
+
+// Удаляет сессию из индекса
+func (idx subjectIndex) remove(session *Session) {
+	tokens := idx[session.Subject]
+	delete(tokens, session.Token)
+	if len(tokens) == 0 {
+		delete(idx, session.Subject)
+	}
+}
+
+// Возвращает сессии пользователя из карты сессий хранилища
+func (idx subjectIndex) sessions(subject string, all map[string]*Session) []*Session {
+	result := make([]*Session, 0, len(idx[subject]))
+	for token := range idx[subject] {
+		if session, ok := all[token]; ok {
+			result = append(result, session)
+		}
+	}
+	return result
+}
@@ -0,0 +1,420 @@
+package knocknock
+
+/*
+ * Хранилище, которое ничего не хранит на сервере: сессия целиком шифруется AES-GCM и становится токеном, который
+ * кладётся в cookie AuthOptions.CookieName. Подойдёт небольшим развёртываниям без базы.
+ *
+ * Ключи образуют связку: сессии шифруются текущим ключом, а расшифровываются любым из связки. Каждый токен помечен
+ * идентификатором ключа, так что при ротации старые cookie продолжают открываться, а Middleware перешифровывает их
+ * текущим ключом. Браузеры не принимают cookie длиннее 4 КБ, поэтому длинные токены режутся на части: name, name.1,
+ * name.2 и так далее.
+ *
+ * Отозвать такую сессию на сервере нельзя: Delete ничего не делает, а сессия живёт, пока у клиента есть cookie и не
+ * наступил ExpiresAt. Refresh-токены и индекс по пользователю не поддерживаются
+ */
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Длина идентификатора ключа в токене
+const cookieKeyIDSize = 4
+
+// Структура настроек CookieStore через функциональные опции
+type CookieStoreOptions struct {
+	PreviousKeys [][]byte // Прежние ключи, которыми токены ещё расшифровываются
+	ChunkSize    int      // Максимальная длина значения одной cookie
+	MaxChunks    int      // Максимальное число частей, на которые режется токен
+}
+
+type CookieStoreOption func(*CookieStoreOptions)
+
+// Функциональная опция для добавления прежних ключей при ротации
+func WithCookiePreviousKeys(keys ...[]byte) CookieStoreOption {
+	return func(o *CookieStoreOptions) {
+		o.PreviousKeys = append(o.PreviousKeys, keys...)
+	}
+}
+
+// Функциональная опция для установки максимальной длины значения одной cookie
+func WithCookieChunkSize(size int) CookieStoreOption {
+	return func(o *CookieStoreOptions) {
+		o.ChunkSize = size
+	}
+}
+
+// Функциональная опция для установки максимального числа частей токена
+func WithCookieMaxChunks(chunks int) CookieStoreOption {
+	return func(o *CookieStoreOptions) {
+		o.MaxChunks = chunks
+	}
+}
+
+// Создаёт и возвращает конфигурацию CookieStore по умолчанию
+func defaultCookieStoreOptions() *CookieStoreOptions {
+	return &CookieStoreOptions{
+		ChunkSize: 3800, // Оставляет место под имя и атрибуты в пределах 4096 байт
+		MaxChunks: 8,
+	}
+}
+
+// Ключ связки
+type cookieKey struct {
+	id   [cookieKeyIDSize]byte
+	aead cipher.AEAD
+}
+
+// Структура хранилища сессий в зашифрованных cookie
+type CookieStore struct {
+	keys []cookieKey // Первый ключ -- текущий
+	opts *CookieStoreOptions
+}
+
+// Создаёт хранилище с текущим ключом key длиной 16, 24 или 32 байта (AES-128, AES-192 или AES-256).
+//
+// Пример:
+//
+//	store, err := knocknock.HandleCookieStore(newKey, knocknock.WithCookiePreviousKeys(oldKey))
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	auth := knocknock.HandleAuth(store)
+func HandleCookieStore(key []byte, cookieStoreOptions ...CookieStoreOption) (*CookieStore, error) {
+	opts := defaultCookieStoreOptions()
+	for _, opt := range cookieStoreOptions {
+		opt(opts)
+	}
+
+	store := &CookieStore{opts: opts}
+	for _, raw := range append([][]byte{key}, opts.PreviousKeys...) {
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		sum := sha256.Sum256(raw)
+		var id [cookieKeyIDSize]byte
+		copy(id[:], sum[:])
+		store.keys = append(store.keys, cookieKey{id, aead})
+	}
+	return store, nil
+}
+
+// Шифрует сессию текущим ключом. Токен внутри не сохраняется: токеном становится сам результат
+func (c *CookieStore) Seal(session *Session) (string, error) {
+	payload, err := sealedPayload(session)
+	if err != nil {
+		return "", err
+	}
+
+	key := c.keys[0]
+	out := make([]byte, cookieKeyIDSize+key.aead.NonceSize(), cookieKeyIDSize+key.aead.NonceSize()+len(payload)+key.aead.Overhead())
+	copy(out, key.id[:])
+	if _, err := rand.Read(out[cookieKeyIDSize:]); err != nil {
+		return "", err
+	}
+	out = key.aead.Seal(out, out[cookieKeyIDSize:], payload, nil)
+	return base64.RawURLEncoding.EncodeToString(out), nil
+}
+
+// Расшифровывает сессию любым ключом связки. Если токен повреждён или ключа нет в связке, возвращает
+// SessionNotFoundError
+func (c *CookieStore) Open(token string) (*Session, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(raw) < cookieKeyIDSize {
+		return nil, SessionNotFoundError
+	}
+
+	key, ok := c.key(raw[:cookieKeyIDSize])
+	if !ok || len(raw) < cookieKeyIDSize+key.aead.NonceSize() {
+		return nil, SessionNotFoundError
+	}
+
+	nonce := raw[cookieKeyIDSize : cookieKeyIDSize+key.aead.NonceSize()]
+	payload, err := key.aead.Open(nil, nonce, raw[cookieKeyIDSize+key.aead.NonceSize():], nil)
+	if err != nil {
+		return nil, SessionNotFoundError
+	}
+
+	var session Session
+	if err := json.Unmarshal(payload, &session); err != nil {
+		return nil, SessionNotFoundError
+	}
+	session.Token = token
+	return &session, nil
+}
+
+// Реализация Store.Save. Сохранять на сервере нечего, поэтому возвращает StoreUnsupportedError: Auth запечатывает
+// сессии сам, а refresh-токены с CookieStore не работают
+func (c *CookieStore) Save(ctx context.Context, session *Session) error {
+	return StoreUnsupportedError
+}
+
+// Реализация Store.Get
+func (c *CookieStore) Get(ctx context.Context, token string) (*Session, error) {
+	return c.Open(token)
+}
+
+// Реализация Store.Delete. Ничего не делает: сессия удаляется вместе с cookie на клиенте
+func (c *CookieStore) Delete(ctx context.Context, token string) error {
+	return nil
+}
+
+// Ищет ключ связки по идентификатору
+func (c *CookieStore) key(id []byte) (cookieKey, bool) {
+	for _, key := range c.keys {
+		if string(key.id[:]) == string(id) {
+			return key, true
+		}
+	}
+	return cookieKey{}, false
+}
+
+// Зашифрован ли токен текущим ключом
+func (c *CookieStore) current(token string) bool {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	return err == nil && len(raw) >= cookieKeyIDSize && string(raw[:cookieKeyIDSize]) == string(c.keys[0].id[:])
+}
+
+// Сериализует сессию для шифрования. Токен не входит в данные: им становится шифртекст
+func sealedPayload(session *Session) ([]byte, error) {
+	sealed := *session
+	sealed.Token = ""
+	return json.Marshal(&sealed)
+}
+
+// Создаёт сессию, запечатанную в токен. В хранилище ничего не пишется
+func (a *Auth) newSealedSession(store *CookieStore, userData UserData, expiresIn time.Duration, sessionOptions []SessionOption) (*Session, error) {
+	session := MakeSession("", userData, expiresIn)
+	for _, opt := range sessionOptions {
+		opt(session)
+	}
+
+	token, err := store.Seal(session)
+	if err != nil {
+		return nil, err
+	}
+	session.Token = token
+	return session, nil
+}
+
+// Открывает запечатанную сессию. Продление при скользящем истечении делается только в памяти: в cookie его
+// записывает Middleware
+func (a *Auth) getSealedSession(ctx context.Context, store *CookieStore, token string) (*Session, error) {
+	session, err := a.openSealedSession(ctx, store, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.AuthOptions.IdleTimeout > 0 {
+		session, _ = a.touch(session)
+	}
+	return session, nil
+}
+
+// Открывает запечатанную сессию доступа и проверяет её срок, без продления
+func (a *Auth) openSealedSession(ctx context.Context, store *CookieStore, token string) (*Session, error) {
+	session, err := store.Open(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if session.Kind != SessionKindAccess {
+		return nil, SessionNotFoundError
+	}
+	if session.IsExpired() {
+		a.emit(ctx, EventExpire, session)
+		return nil, SessionExpiredError
+	}
+	return session, nil
+}
+
+// Возвращает CookieStore, если Auth работает с ним, в том числе через обёртки (см. StoreWrapper)
+func (a *Auth) cookieStore() *CookieStore {
+	for store := a.store; ; {
+		if cookies, ok := store.(*CookieStore); ok {
+			return cookies
+		}
+		wrapper, ok := store.(StoreWrapper)
+		if !ok {
+			return nil
+		}
+		store = wrapper.Unwrap()
+	}
+}
+
+// Записывает токен сессии в cookie AuthOptions.CookieName. Длинный токен режется на части по ChunkSize CookieStore,
+// лишние части от прежнего, более длинного токена удаляются. Для CookieStore этим пользуются после CreateSession,
+// для остальных хранилищ -- по желанию.
+//
+// Пример:
+//
+//	session, err := auth.CreateSession(r.Context(), user)
+//	if err != nil {
+//	    return err
+//	}
+//	err = auth.SetSessionCookie(w, r, session)
+func (a *Auth) SetSessionCookie(w http.ResponseWriter, r *http.Request, session *Session) error {
+	chunkSize, maxChunks := len(session.Token), 1
+	if store := a.cookieStore(); store != nil {
+		chunkSize, maxChunks = store.opts.ChunkSize, store.opts.MaxChunks
+	}
+
+	var chunks []string
+	for token := session.Token; len(token) > 0; {
+		n := min(chunkSize, len(token))
+		chunks = append(chunks, token[:n])
+		token = token[n:]
+	}
+	if len(chunks) > maxChunks {
+		return CookieTooLargeError
+	}
+
+	for i, chunk := range chunks {
+		http.SetCookie(w, a.sessionCookie(cookieChunkName(a.AuthOptions.CookieName, i), chunk, session.ExpiresAt, r))
+	}
+	for i := max(len(chunks), 1); ; i++ {
+		name := cookieChunkName(a.AuthOptions.CookieName, i)
+		if _, err := r.Cookie(name); err != nil {
+			break
+		}
+		http.SetCookie(w, a.sessionCookie(name, "", time.Unix(0, 0), r))
+	}
+	return nil
+}
+
+// Собирает токен из cookie AuthOptions.CookieName и её частей
+func (a *Auth) readSessionCookie(r *http.Request) string {
+	return readChunkedCookie(r, a.AuthOptions.CookieName)
+}
+
+// Собирает значение cookie name и её частей name.1, name.2 и так далее
+func readChunkedCookie(r *http.Request, name string) string {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return ""
+	}
+
+	value := cookie.Value
+	for i := 1; ; i++ {
+		chunk, err := r.Cookie(cookieChunkName(name, i))
+		if err != nil {
+			return value
+		}
+		value += chunk.Value
+	}
+}
+
+// Cookie сессии с атрибутами из AuthOptions
+func (a *Auth) sessionCookie(name, value string, expires time.Time, r *http.Request) *http.Cookie {
+	return &http.Cookie{
+		Name:        name,
+		Value:       value,
+		Domain:      a.AuthOptions.CookieDomain,
+		Path:        a.AuthOptions.CookiePath,
+		Expires:     expires,
+		HttpOnly:    true,
+		Secure:      a.AuthOptions.CookieSecure || r.TLS != nil,
+		SameSite:    a.AuthOptions.CookieSameSite,
+		Partitioned: a.AuthOptions.CookiePartitioned,
+	}
+}
+
+// Имя i-й части cookie
+func cookieChunkName(name string, i int) string {
+	if i == 0 {
+		return name
+	}
+	return name + "." + strconv.Itoa(i)
+}
+
+// ResponseWriter, который перед отправкой заголовков перезапечатывает сессию из cookie, если обработчик изменил её,
+// сессия продлилась или была зашифрована прежним ключом
+type sealingResponseWriter struct {
+	http.ResponseWriter
+	auth    *Auth
+	store   *CookieStore
+	request *http.Request
+	session *Session
+	token   string
+	done    bool
+}
+
+func (w *sealingResponseWriter) WriteHeader(status int) {
+	w.reseal()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *sealingResponseWriter) Write(b []byte) (int, error) {
+	w.reseal()
+	return w.ResponseWriter.Write(b)
+}
+
+// Нужен http.ResponseController, чтобы добраться до Flush и прочего у исходного ResponseWriter
+func (w *sealingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Находит sealingResponseWriter среди обёрток w, если Middleware его поставил
+func findSealingWriter(w http.ResponseWriter) *sealingResponseWriter {
+	for {
+		switch writer := w.(type) {
+		case *sealingResponseWriter:
+			return writer
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = writer.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+// Отключает перезапечатывание сессии запроса: обработчик сам записал или стёр cookie (Login, Logout, Regenerate),
+// и Middleware не должен поставить поверх неё старую сессию
+func skipReseal(w http.ResponseWriter) {
+	if sealing := findSealingWriter(w); sealing != nil {
+		sealing.done = true
+	}
+}
+
+// Перезапечатывает сессию один раз, до отправки заголовков. Ошибки не прерывают ответ: клиент останется со старой
+// cookie
+func (w *sealingResponseWriter) reseal() {
+	if w.done {
+		return
+	}
+	w.done = true
+
+	if w.store.current(w.token) {
+		original, err := w.store.Open(w.token)
+		if err != nil {
+			return
+		}
+		before, _ := sealedPayload(original)
+		after, err := sealedPayload(w.session)
+		if err != nil || string(before) == string(after) {
+			return
+		}
+	}
+
+	token, err := w.store.Seal(w.session)
+	if err != nil {
+		return
+	}
+	resealed := *w.session
+	resealed.Token = token
+	_ = w.auth.SetSessionCookie(w.ResponseWriter, w.request, &resealed)
+}
@@ -0,0 +1,511 @@
+package knocknock
+
+/*
+ * Реализация интерфейса Store (store.go) поверх append-only лога на локальном диске. Каждая операция дописывает в
+ * файл одну JSON-запись на строку, а при открытии лог проигрывается заново. Лог периодически сжимается в фоне, а
+ * оборванная последняя запись (например, после падения процесса посреди записи) отбрасывается при открытии. Если
+ * запись или fsync вернули ошибку (нет места, сбой диска), лог обрезается до начала записи, а операция возвращает
+ * ошибку и не применяется: память и диск остаются согласованы.
+ *
+ * Важно: UserData сериализуется в JSON, поэтому после перезапуска она восстанавливается так, как её раскодирует
+ * encoding/json (структуры превращаются в map[string]any).
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Тип операции в логе
+type fileStoreOp string
+
+const (
+	fileStoreOpSave    fileStoreOp = "save"
+	fileStoreOpDelete  fileStoreOp = "delete"
+	fileStoreOpReplace fileStoreOp = "replace" // Удаление Token и сохранение Session одной записью
+)
+
+// Одна запись лога
+type fileStoreRecord struct {
+	Op      fileStoreOp `json:"op"`
+	Token   string      `json:"token,omitempty"`
+	Session *Session    `json:"session,omitempty"`
+}
+
+// Структура настроек FileStore через функциональные опции
+type FileStoreOptions struct {
+	CompactInterval time.Duration // Период фонового сжатия лога. 0 отключает фоновое сжатие
+	CompactMinSize  int           // Минимальное число записей в логе, после которого имеет смысл сжатие
+	SyncWrites      bool          // Вызывать fsync после каждой записи
+	Logger          *slog.Logger  // Лог ошибок фонового сжатия и отброшенных записей. nil -- не писать
+}
+
+type FileStoreOption func(*FileStoreOptions)
+
+// Функциональная опция для установки периода фонового сжатия лога
+func WithCompactInterval(interval time.Duration) FileStoreOption {
+	return func(o *FileStoreOptions) {
+		o.CompactInterval = interval
+	}
+}
+
+// Функциональная опция для установки минимального размера лога, при котором запускается сжатие
+func WithCompactMinSize(records int) FileStoreOption {
+	return func(o *FileStoreOptions) {
+		o.CompactMinSize = records
+	}
+}
+
+// Функциональная опция для включения или отключения fsync после каждой записи
+func WithSyncWrites(sync bool) FileStoreOption {
+	return func(o *FileStoreOptions) {
+		o.SyncWrites = sync
+	}
+}
+
+// Функциональная опция для установки логгера. Если хранилище передано в HandleAuth с WithLogger, логгер Auth
+// ставится автоматически
+func WithFileStoreLogger(logger *slog.Logger) FileStoreOption {
+	return func(o *FileStoreOptions) {
+		o.Logger = logger
+	}
+}
+
+// Создаёт и возвращает конфигурацию FileStore по умолчанию
+func defaultFileStoreOptions() *FileStoreOptions {
+	return &FileStoreOptions{
+		CompactInterval: 5 * time.Minute,
+		CompactMinSize:  1024,
+		SyncWrites:      true,
+	}
+}
+
+// Структура файлового хранилища. Актуальное состояние держится в памяти, а файл служит журналом для восстановления
+type FileStore struct {
+	mu       sync.RWMutex
+	path     string
+	file     *os.File
+	sessions map[string]*Session
+	subjects subjectIndex
+	records  int   // Число записей в логе, включая уже неактуальные
+	size     int64 // Конец последней целой записи в логе
+	torn     bool  // После неудачной записи хвост лога обрезать не удалось: это нужно сделать перед следующей
+	opts     *FileStoreOptions
+	stop     chan struct{}
+	done     chan struct{}
+	closing  sync.Once
+	closeErr error
+}
+
+// Открывает (или создаёт) хранилище в указанном файле, проигрывает лог и запускает фоновое сжатие. Хранилище нужно
+// закрыть через Close.
+//
+// Пример:
+//
+//	store, err := knocknock.HandleFileStore("sessions.log", knocknock.WithCompactInterval(time.Minute))
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	defer store.Close()
+func HandleFileStore(path string, fileStoreOptions ...FileStoreOption) (*FileStore, error) {
+	opts := defaultFileStoreOptions()
+	for _, opt := range fileStoreOptions {
+		opt(opts)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &FileStore{
+		path:     path,
+		file:     file,
+		sessions: make(map[string]*Session),
+		subjects: make(subjectIndex),
+		opts:     opts,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if err := f.replay(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	go f.compactLoop()
+	return f, nil
+}
+
+// Реализация Store.Save
+func (f *FileStore) Save(ctx context.Context, session *Session) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, exists := f.sessions[session.Token]; exists {
+		return SessionExistsError
+	}
+
+	if err := f.append(fileStoreRecord{Op: fileStoreOpSave, Session: session}); err != nil {
+		return err
+	}
+
+	f.put(session)
+	return nil
+}
+
+// Реализация Store.Get
+func (f *FileStore) Get(ctx context.Context, token string) (*Session, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	session, exists := f.sessions[token]
+	if !exists {
+		return nil, SessionNotFoundError
+	}
+
+	return session, nil
+}
+
+// Реализация Store.Delete
+func (f *FileStore) Delete(ctx context.Context, token string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, exists := f.sessions[token]; !exists {
+		return nil
+	}
+
+	if err := f.append(fileStoreRecord{Op: fileStoreOpDelete, Token: token}); err != nil {
+		return err
+	}
+
+	f.drop(token)
+	return nil
+}
+
+// Реализация Updater.Update. В лог дописывается новая версия сессии, старая отбросится при сжатии
+func (f *FileStore) Update(ctx context.Context, session *Session) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, exists := f.sessions[session.Token]; !exists {
+		return SessionNotFoundError
+	}
+
+	if err := f.append(fileStoreRecord{Op: fileStoreOpSave, Session: session}); err != nil {
+		return err
+	}
+
+	f.put(session)
+	return nil
+}
+
+// Реализация Replacer.Replace. В лог дописывается одна запись, поэтому после падения замена либо применена целиком,
+// либо (если запись оборвалась) не применена вовсе
+func (f *FileStore) Replace(ctx context.Context, oldToken string, session *Session) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, exists := f.sessions[oldToken]; !exists {
+		return SessionNotFoundError
+	}
+	if _, exists := f.sessions[session.Token]; exists {
+		return SessionExistsError
+	}
+
+	if err := f.append(fileStoreRecord{Op: fileStoreOpReplace, Token: oldToken, Session: session}); err != nil {
+		return err
+	}
+
+	f.drop(oldToken)
+	f.put(session)
+	return nil
+}
+
+// Реализация SubjectIndexer.ListBySubject
+func (f *FileStore) ListBySubject(ctx context.Context, subject string) ([]*Session, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.subjects.sessions(subject, f.sessions), nil
+}
+
+// Переписывает лог так, чтобы в нём остались только актуальные непротухшие сессии. Новый лог сначала пишется во
+// временный файл, а затем атомарно подменяет старый, так что падение посреди сжатия не теряет данных
+func (f *FileStore) Compact() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.compact()
+}
+
+// Останавливает фоновое сжатие и закрывает файл лога. Повторные и одновременные вызовы возвращают результат первого
+func (f *FileStore) Close() error {
+	f.closing.Do(func() {
+		close(f.stop)
+		<-f.done
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		if f.file != nil {
+			f.closeErr = f.file.Close()
+			f.file = nil
+		}
+	})
+	return f.closeErr
+}
+
+// Кладёт сессию в память, поддерживая индекс по пользователю. Вызывается под блокировкой
+func (f *FileStore) put(session *Session) {
+	if previous, exists := f.sessions[session.Token]; exists {
+		f.subjects.remove(previous)
+	}
+	f.sessions[session.Token] = session
+	f.subjects.add(session)
+}
+
+// Убирает сессию из памяти. Вызывается под блокировкой
+func (f *FileStore) drop(token string) {
+	if session, exists := f.sessions[token]; exists {
+		f.subjects.remove(session)
+		delete(f.sessions, token)
+	}
+}
+
+// Проигрывает лог в память. Оборванная последняя запись отрезается от файла
+func (f *FileStore) replay() error {
+	reader := bufio.NewReader(f.file)
+	var offset int64
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				f.log(slog.LevelWarn, "knocknock: dropping torn file store record", slog.Int64("offset", offset))
+				return f.truncate(offset)
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var record fileStoreRecord
+		if jsonErr := json.Unmarshal(line, &record); jsonErr != nil || !f.apply(record) {
+			if _, peekErr := reader.Peek(1); errors.Is(peekErr, io.EOF) {
+				f.log(slog.LevelWarn, "knocknock: dropping torn file store record", slog.Int64("offset", offset))
+				return f.truncate(offset)
+			}
+			return FileStoreCorruptedError
+		}
+
+		offset += int64(len(line))
+		f.records++
+	}
+
+	f.size = offset
+	_, err := f.file.Seek(0, io.SeekEnd)
+	return err
+}
+
+// Применяет запись лога к состоянию в памяти. Возвращает false, если запись некорректна
+func (f *FileStore) apply(record fileStoreRecord) bool {
+	switch record.Op {
+	case fileStoreOpSave:
+		if record.Session == nil {
+			return false
+		}
+		f.put(record.Session)
+	case fileStoreOpDelete:
+		f.drop(record.Token)
+	case fileStoreOpReplace:
+		if record.Session == nil {
+			return false
+		}
+		f.drop(record.Token)
+		f.put(record.Session)
+	default:
+		return false
+	}
+	return true
+}
+
+// Обрезает лог до указанного смещения, отбрасывая оборванную запись
+func (f *FileStore) truncate(offset int64) error {
+	if err := f.file.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := f.file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	return f.file.Sync()
+}
+
+// Дописывает запись в конец лога. Вызывается под блокировкой. Если запись или fsync не удались, хвост лога
+// обрезается до начала записи и операция не применяется ни в памяти, ни на диске: иначе обрывок строки оказался бы
+// посреди лога, и следующее открытие вернуло бы FileStoreCorruptedError
+func (f *FileStore) append(record fileStoreRecord) error {
+	if f.file == nil {
+		return os.ErrClosed
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if f.torn {
+		if err := f.truncate(f.size); err != nil {
+			return err
+		}
+		f.torn = false
+	}
+
+	_, err = f.file.Write(append(line, '\n'))
+	if err == nil && f.opts.SyncWrites {
+		err = f.file.Sync()
+	}
+	if err != nil {
+		if truncErr := f.truncate(f.size); truncErr != nil {
+			f.torn = true
+			f.log(slog.LevelError, "knocknock: failed to drop incomplete file store record", slog.String("error", truncErr.Error()))
+		}
+		return err
+	}
+
+	f.size += int64(len(line)) + 1
+	f.records++
+	return nil
+}
+
+// Сжимает лог. Вызывается под блокировкой
+func (f *FileStore) compact() error {
+	if f.file == nil {
+		return os.ErrClosed
+	}
+
+	now := time.Now()
+	var buf bytes.Buffer
+	records := 0
+
+	for token, session := range f.sessions {
+		if now.After(session.ExpiresAt) {
+			f.drop(token)
+			continue
+		}
+
+		line, err := json.Marshal(fileStoreRecord{Op: fileStoreOpSave, Session: session})
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+		records++
+	}
+
+	// Новый лог пишется через дескриптор, который после переименования становится рабочим: переоткрывать файл не
+	// нужно, и f.file не может остаться указывать на удалённый лог
+	tmpPath := f.path + ".compact"
+	file, err := writeFileSync(tmpPath, buf.Bytes())
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, f.path); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	syncDir(filepath.Dir(f.path))
+
+	f.file.Close()
+	f.file = file
+	f.records = records
+	f.size = int64(buf.Len())
+	f.torn = false
+	return nil
+}
+
+// Передаёт хранилищу логгер (см. LogReceiver)
+func (f *FileStore) SetLogger(logger *slog.Logger) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.opts.Logger = logger
+}
+
+// Пишет в лог хранилища, если он задан. Вызывается под блокировкой
+func (f *FileStore) log(level slog.Level, msg string, attrs ...slog.Attr) {
+	if f.opts.Logger != nil {
+		f.opts.Logger.LogAttrs(context.Background(), level, msg, attrs...)
+	}
+}
+
+// Периодически сжимает лог, если в нём накопилось достаточно неактуальных записей
+func (f *FileStore) compactLoop() {
+	defer close(f.done)
+
+	if f.opts.CompactInterval <= 0 {
+		<-f.stop
+		return
+	}
+
+	ticker := time.NewTicker(f.opts.CompactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+			f.mu.Lock()
+			if f.records >= f.opts.CompactMinSize && f.records > 2*len(f.sessions) {
+				if err := f.compact(); err != nil {
+					f.log(slog.LevelError, "knocknock: file store compaction failed", slog.String("error", err.Error()))
+				}
+			}
+			f.mu.Unlock()
+		}
+	}
+}
+
+// Записывает данные в файл и дожидается их сброса на диск. Возвращает открытый файл, смещение -- в его конце
+func writeFileSync(path string, data []byte) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// Сбрасывает на диск метаданные каталога, чтобы переименование файла пережило падение. Ошибки игнорируются: не все
+// платформы позволяют открыть каталог на запись метаданных
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+}
@@ -15,12 +15,15 @@ import (
 type MemoryStore struct {
 	mu       sync.RWMutex
 	sessions map[string]*Session
+	subjects subjectIndex
+	expired  []*func(session *Session) // Обработчики из NotifyExpired, по указателю, чтобы их можно было снять
 }
 
 // Создаёт новое хранилище
 func HandleMemoryStore() *MemoryStore {
 	return &MemoryStore{
 		sessions: make(map[string]*Session),
+		subjects: make(subjectIndex),
 	}
 }
 
@@ -34,6 +37,7 @@ func (m *MemoryStore) Save(ctx context.Context, session *Session) error {
 	}
 
 	m.sessions[session.Token] = session
+	m.subjects.add(session)
 	return nil
 }
 
@@ -56,20 +60,111 @@ func (m *MemoryStore) Delete(ctx context.Context, token string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	delete(m.sessions, token)
+	if session, exists := m.sessions[token]; exists {
+		m.subjects.remove(session)
+		delete(m.sessions, token)
+	}
 	return nil
 }
 
-// Очищает хранилище от протухших сессий. Примечательно, что функция не реализует Store. Программист может дополнять
-// свои хранилища методами не из Store
-func (m *MemoryStore) Cleanup() {
+// Реализация Updater.Update
+func (m *MemoryStore) Update(ctx context.Context, session *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	previous, exists := m.sessions[session.Token]
+	if !exists {
+		return SessionNotFoundError
+	}
+
+	m.subjects.remove(previous)
+	m.sessions[session.Token] = session
+	m.subjects.add(session)
+	return nil
+}
+
+// Реализация Replacer.Replace
+func (m *MemoryStore) Replace(ctx context.Context, oldToken string, session *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	previous, exists := m.sessions[oldToken]
+	if !exists {
+		return SessionNotFoundError
+	}
+	if _, exists := m.sessions[session.Token]; exists {
+		return SessionExistsError
+	}
+
+	m.subjects.remove(previous)
+	delete(m.sessions, oldToken)
+	m.sessions[session.Token] = session
+	m.subjects.add(session)
+	return nil
+}
+
+// Реализация SubjectIndexer.ListBySubject
+func (m *MemoryStore) ListBySubject(ctx context.Context, subject string) ([]*Session, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.subjects.sessions(subject, m.sessions), nil
+}
+
+// Реализация ExpiryNotifier.NotifyExpired
+func (m *MemoryStore) NotifyExpired(handler func(session *Session)) func() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	registered := &handler
+	m.expired = append(m.expired, registered)
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		for i, h := range m.expired {
+			if h == registered {
+				m.expired = append(m.expired[:i:i], m.expired[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Реализация SessionCounter.ActiveSessions. Refresh-токены и записи отозванных токенов не считаются
+func (m *MemoryStore) ActiveSessions() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now()
+	active := 0
+	for _, session := range m.sessions {
+		if session.Kind == SessionKindAccess && !now.After(session.ExpiresAt) {
+			active++
+		}
+	}
+	return active
+}
+
+// Очищает хранилище от протухших сессий. Примечательно, что функция не реализует Store. Программист может дополнять
+// свои хранилища методами не из Store. Об удалённых сессиях сообщается обработчикам NotifyExpired
+func (m *MemoryStore) Cleanup() {
+	m.mu.Lock()
 	now := time.Now()
+	var removed []*Session
 	for token, session := range m.sessions {
 		if now.After(session.ExpiresAt) {
+			m.subjects.remove(session)
 			delete(m.sessions, token)
+			removed = append(removed, session)
+		}
+	}
+	handlers := m.expired
+	m.mu.Unlock()
+
+	for _, session := range removed {
+		for _, handler := range handlers {
+			(*handler)(session)
 		}
 	}
 }
@@ -0,0 +1,297 @@
+package knocknock
+
+/*
+ * Реализация интерфейса Store (store.go) поверх Redis. Используется встроенный RESP-клиент (resp.go), поэтому
+ * сторонние зависимости не нужны. Время жизни сессии отображается на нативный TTL ключа, так что протухшие сессии
+ * Redis удаляет сам.
+ *
+ * Как и в FileStore, UserData сериализуется в JSON и при чтении раскодируется как encoding/json.
+ *
+ * Токены пользователя лежат в множестве (см. SubjectIndexer). Delete и Replace убирают из него токен в той же
+ * транзакции, а само множество живёт до истечения самой поздней своей сессии (PEXPIREAT с NX и GT, Redis 7.0+),
+ * поэтому индекс не растёт у пользователей, чьи сессии никто не перечисляет.
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Структура настроек RedisStore через функциональные опции
+type RedisStoreOptions struct {
+	Username    string        // Имя пользователя ACL
+	Password    string        // Пароль
+	DB          int           // Номер базы
+	Protocol    int           // Версия протокола: 2 или 3. С RESP3 клиент откатывается на RESP2, если сервер его не знает
+	PoolSize    int           // Максимальное число одновременно открытых соединений
+	DialTimeout time.Duration // Таймаут установки соединения
+	KeyPrefix   string        // Префикс ключей сессий
+	IndexPrefix string        // Префикс ключей множеств токенов по пользователю (см. SubjectIndexer)
+}
+
+type RedisStoreOption func(*RedisStoreOptions)
+
+// Функциональная опция для установки имени пользователя и пароля
+func WithRedisAuth(username, password string) RedisStoreOption {
+	return func(o *RedisStoreOptions) {
+		o.Username = username
+		o.Password = password
+	}
+}
+
+// Функциональная опция для выбора номера базы
+func WithRedisDB(db int) RedisStoreOption {
+	return func(o *RedisStoreOptions) {
+		o.DB = db
+	}
+}
+
+// Функциональная опция для выбора версии протокола RESP
+func WithRedisProtocol(protocol int) RedisStoreOption {
+	return func(o *RedisStoreOptions) {
+		o.Protocol = protocol
+	}
+}
+
+// Функциональная опция для установки размера пула соединений
+func WithRedisPoolSize(size int) RedisStoreOption {
+	return func(o *RedisStoreOptions) {
+		o.PoolSize = size
+	}
+}
+
+// Функциональная опция для установки таймаута установки соединения
+func WithRedisDialTimeout(timeout time.Duration) RedisStoreOption {
+	return func(o *RedisStoreOptions) {
+		o.DialTimeout = timeout
+	}
+}
+
+// Функциональная опция для установки префикса ключей
+func WithRedisKeyPrefix(prefix string) RedisStoreOption {
+	return func(o *RedisStoreOptions) {
+		o.KeyPrefix = prefix
+	}
+}
+
+// Функциональная опция для установки префикса ключей индекса по пользователю
+func WithRedisIndexPrefix(prefix string) RedisStoreOption {
+	return func(o *RedisStoreOptions) {
+		o.IndexPrefix = prefix
+	}
+}
+
+// Создаёт и возвращает конфигурацию RedisStore по умолчанию
+func defaultRedisStoreOptions() *RedisStoreOptions {
+	return &RedisStoreOptions{
+		Protocol:    3,
+		PoolSize:    10,
+		DialTimeout: 5 * time.Second,
+		KeyPrefix:   "knocknock:session:",
+		IndexPrefix: "knocknock:subject:",
+	}
+}
+
+// Структура хранилища поверх Redis
+type RedisStore struct {
+	pool *respPool
+	opts *RedisStoreOptions
+}
+
+// Создаёт хранилище для сервера по адресу addr. Соединения открываются лениво, при первой команде.
+//
+// Пример:
+//
+//	store := knocknock.HandleRedisStore("localhost:6379", knocknock.WithRedisPoolSize(32))
+//	defer store.Close()
+func HandleRedisStore(addr string, redisStoreOptions ...RedisStoreOption) *RedisStore {
+	opts := defaultRedisStoreOptions()
+	for _, opt := range redisStoreOptions {
+		opt(opts)
+	}
+
+	dialer := &respDialer{
+		addr:        addr,
+		username:    opts.Username,
+		password:    opts.Password,
+		db:          opts.DB,
+		protocol:    opts.Protocol,
+		dialTimeout: opts.DialTimeout,
+	}
+	return &RedisStore{newRespPool(dialer, opts.PoolSize), opts}
+}
+
+// Реализация Store.Save. Использует SET NX, поэтому проверка на занятость токена атомарна
+func (r *RedisStore) Save(ctx context.Context, session *Session) error {
+	if err := r.set(ctx, session, "NX"); err != nil {
+		return err
+	}
+	return r.index(ctx, session)
+}
+
+// Реализация Store.Get
+func (r *RedisStore) Get(ctx context.Context, token string) (*Session, error) {
+	reply, err := r.pool.do(ctx, "GET", r.key(token))
+	if err := expectOK(reply, err); err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, SessionNotFoundError
+	}
+
+	var session Session
+	if err := json.Unmarshal([]byte(respString(reply)), &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// Реализация Store.Delete. Пользователь сессии читается заранее, чтобы убрать токен из его множества в одной
+// транзакции с удалением
+func (r *RedisStore) Delete(ctx context.Context, token string) error {
+	reply, err := r.pool.do(ctx, "GET", r.key(token))
+	if err := expectOK(reply, err); err != nil {
+		return err
+	}
+
+	var session Session
+	if reply == nil || json.Unmarshal([]byte(respString(reply)), &session) != nil || session.Subject == "" {
+		return expectOK(r.pool.do(ctx, "DEL", r.key(token)))
+	}
+	return expectOK(r.pool.multi(ctx,
+		[]string{"DEL", r.key(token)},
+		[]string{"SREM", r.opts.IndexPrefix + session.Subject, token},
+	))
+}
+
+// Реализация Updater.Update. Использует SET XX, поэтому удалённая или протухшая сессия не воскреснет
+func (r *RedisStore) Update(ctx context.Context, session *Session) error {
+	if err := r.set(ctx, session, "XX"); err != nil {
+		return err
+	}
+	return r.index(ctx, session)
+}
+
+// Записывает сессию командой SET с условием NX или XX. Невыполненное условие даёт SessionExistsError для NX и
+// SessionNotFoundError для XX
+func (r *RedisStore) set(ctx context.Context, session *Session, condition string) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	reply, err := r.pool.do(ctx, "SET", r.key(session.Token), string(data), condition, "PXAT", expiresAtMillis(session))
+	if err := expectOK(reply, err); err != nil {
+		return err
+	}
+	if reply == nil && condition == "NX" {
+		return SessionExistsError
+	}
+	if reply == nil {
+		return SessionNotFoundError
+	}
+	return nil
+}
+
+// Реализация Replacer.Replace. Старая сессия забирается через GETDEL (Redis 6.2+), поэтому заменить её сможет
+// только один из одновременных вызовов. Если новую сессию сохранить не удалось, старая возвращается на место
+func (r *RedisStore) Replace(ctx context.Context, oldToken string, session *Session) error {
+	reply, err := r.pool.do(ctx, "GETDEL", r.key(oldToken))
+	if err := expectOK(reply, err); err != nil {
+		return err
+	}
+	if reply == nil {
+		return SessionNotFoundError
+	}
+
+	var previous Session
+	decoded := json.Unmarshal([]byte(respString(reply)), &previous) == nil
+
+	if err := r.set(ctx, session, "NX"); err != nil {
+		if decoded {
+			_, _ = r.pool.do(ctx, "SET", r.key(oldToken), respString(reply), "NX", "PXAT", expiresAtMillis(&previous))
+		}
+		return err
+	}
+
+	commands := r.indexCommands(session)
+	if decoded && previous.Subject != "" {
+		commands = append([][]string{{"SREM", r.opts.IndexPrefix + previous.Subject, oldToken}}, commands...)
+	}
+	if len(commands) == 0 {
+		return nil
+	}
+	return expectOK(r.pool.multi(ctx, commands...))
+}
+
+// Реализация SubjectIndexer.ListBySubject. Токены пользователя лежат в множестве, которое не знает о TTL сессий,
+// поэтому протухшие и удалённые токены вычищаются из него здесь же
+func (r *RedisStore) ListBySubject(ctx context.Context, subject string) ([]*Session, error) {
+	reply, err := r.pool.do(ctx, "SMEMBERS", r.opts.IndexPrefix+subject)
+	if err := expectOK(reply, err); err != nil {
+		return nil, err
+	}
+
+	members, _ := reply.([]any)
+	sessions := make([]*Session, 0, len(members))
+	for _, member := range members {
+		token := respString(member)
+
+		session, err := r.Get(ctx, token)
+		if errors.Is(err, SessionNotFoundError) {
+			if err := expectOK(r.pool.do(ctx, "SREM", r.opts.IndexPrefix+subject, token)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// Закрывает свободные соединения пула
+func (r *RedisStore) Close() error {
+	r.pool.close()
+	return nil
+}
+
+// Добавляет токен сессии в множество токенов её пользователя
+func (r *RedisStore) index(ctx context.Context, session *Session) error {
+	commands := r.indexCommands(session)
+	if len(commands) == 0 {
+		return nil
+	}
+	return expectOK(r.pool.multi(ctx, commands...))
+}
+
+// Команды, добавляющие токен в множество пользователя и продлевающие множество до истечения сессии. PEXPIREAT NX
+// ставит срок новому множеству, GT продлевает срок существующего, но никогда не сокращает его
+func (r *RedisStore) indexCommands(session *Session) [][]string {
+	if session.Subject == "" {
+		return nil
+	}
+	set, expiresAt := r.opts.IndexPrefix+session.Subject, expiresAtMillis(session)
+	return [][]string{
+		{"SADD", set, session.Token},
+		{"PEXPIREAT", set, expiresAt, "NX"},
+		{"PEXPIREAT", set, expiresAt, "GT"},
+	}
+}
+
+// Возвращает ключ сессии в Redis
+func (r *RedisStore) key(token string) string {
+	return r.opts.KeyPrefix + token
+}
+
+// Время истечения сессии в миллисекундах Unix для PXAT. Redis не принимает неположительные значения, а сессия,
+// протухшая в прошлом, всё равно удалится сразу
+func expiresAtMillis(session *Session) string {
+	return strconv.FormatInt(max(session.ExpiresAt.UnixMilli(), 1), 10)
+}
@@ -0,0 +1,459 @@
+package knocknock
+
+/*
+ * Реализация интерфейса Store (store.go) поверх database/sql. Драйвер не импортируется: программист сам открывает
+ * *sql.DB с нужным драйвером и передаёт его вместе с диалектом. Схема таблицы сессий создаётся и обновляется
+ * версионированными миграциями (см. Migrate).
+ *
+ * Как и в FileStore, UserData сериализуется в JSON и при чтении раскодируется как encoding/json.
+ */
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Диалект SQL. Описывает то немногое, в чём расходятся поддерживаемые СУБД
+type SQLDialect interface {
+	// Возвращает плейсхолдер для n-го (с единицы) параметра запроса
+	Placeholder(n int) string
+	// Сообщает, является ли ошибка драйвера нарушением уникальности первичного ключа
+	IsUniqueViolation(err error) bool
+	// Возвращает запрос, удаляющий не более limit строк таблицы, подходящих под условие where
+	LimitedDelete(table, where string, limit int) string
+}
+
+var (
+	// Диалект PostgreSQL: плейсхолдеры $1, $2, ...
+	PostgresDialect SQLDialect = postgresDialect{}
+	// Диалект MySQL и MariaDB: плейсхолдеры ?
+	MySQLDialect SQLDialect = mysqlDialect{}
+	// Диалект SQLite: плейсхолдеры ?
+	SQLiteDialect SQLDialect = sqliteDialect{}
+)
+
+type postgresDialect struct{}
+
+func (postgresDialect) Placeholder(n int) string { return "$" + strconv.Itoa(n) }
+
+func (postgresDialect) IsUniqueViolation(err error) bool {
+	return containsAny(err, "SQLSTATE 23505", "duplicate key value")
+}
+
+func (postgresDialect) LimitedDelete(table, where string, limit int) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE token IN (SELECT token FROM %s WHERE %s LIMIT %d)", table, table, where, limit)
+}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) Placeholder(n int) string { return "?" }
+
+func (mysqlDialect) IsUniqueViolation(err error) bool {
+	return containsAny(err, "Error 1062", "Duplicate entry")
+}
+
+func (mysqlDialect) LimitedDelete(table, where string, limit int) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE %s LIMIT %d", table, where, limit)
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Placeholder(n int) string { return "?" }
+
+func (sqliteDialect) IsUniqueViolation(err error) bool {
+	return containsAny(err, "UNIQUE constraint failed", "PRIMARY KEY constraint failed")
+}
+
+func (sqliteDialect) LimitedDelete(table, where string, limit int) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE token IN (SELECT token FROM %s WHERE %s LIMIT %d)", table, table, where, limit)
+}
+
+// Проверяет, содержит ли текст ошибки одну из подстрок. Драйверы не имеют общего типа ошибок, поэтому диалекты
+// распознают нарушение уникальности по тексту
+func containsAny(err error, substrings ...string) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	for _, s := range substrings {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Одна версия схемы. Запросы получают имя таблицы сессий через fmt-подстановку %[1]s
+type sqlMigration struct {
+	version    int
+	statements []string
+}
+
+// Миграции схемы по порядку. Уже выпущенные миграции менять нельзя: только дописывать новые
+var sqlMigrations = []sqlMigration{
+	{1, []string{
+		`CREATE TABLE %[1]s (
+			token VARCHAR(255) NOT NULL PRIMARY KEY,
+			user_data TEXT NOT NULL,
+			created_at BIGINT NOT NULL,
+			expires_at BIGINT NOT NULL
+		)`,
+		`CREATE INDEX %[1]s_expires_at_idx ON %[1]s (expires_at)`,
+	}},
+	{2, []string{
+		// Служебные поля сессии (вид, ссылки на связанные токены и т.п.) одним JSON-объектом, чтобы новые поля не
+		// требовали новых колонок
+		`ALTER TABLE %[1]s ADD COLUMN meta TEXT`,
+	}},
+	{3, []string{
+		// Subject дублируется из meta в отдельную колонку ради индекса
+		`ALTER TABLE %[1]s ADD COLUMN subject VARCHAR(255)`,
+		`CREATE INDEX %[1]s_subject_idx ON %[1]s (subject)`,
+	}},
+}
+
+// Структура настроек SQLStore через функциональные опции
+type SQLStoreOptions struct {
+	TableName       string // Имя таблицы сессий
+	MigrationsTable string // Имя таблицы с применёнными версиями схемы
+	CleanupBatch    int    // Сколько протухших строк удалять одним запросом
+}
+
+type SQLStoreOption func(*SQLStoreOptions)
+
+// Функциональная опция для установки имени таблицы сессий
+func WithSQLTableName(name string) SQLStoreOption {
+	return func(o *SQLStoreOptions) {
+		o.TableName = name
+	}
+}
+
+// Функциональная опция для установки имени таблицы миграций
+func WithSQLMigrationsTable(name string) SQLStoreOption {
+	return func(o *SQLStoreOptions) {
+		o.MigrationsTable = name
+	}
+}
+
+// Функциональная опция для установки размера пачки при удалении протухших сессий
+func WithSQLCleanupBatch(size int) SQLStoreOption {
+	return func(o *SQLStoreOptions) {
+		o.CleanupBatch = size
+	}
+}
+
+// Создаёт и возвращает конфигурацию SQLStore по умолчанию
+func defaultSQLStoreOptions() *SQLStoreOptions {
+	return &SQLStoreOptions{
+		TableName:       "knocknock_sessions",
+		MigrationsTable: "knocknock_migrations",
+		CleanupBatch:    1000,
+	}
+}
+
+// Структура хранилища поверх database/sql
+type SQLStore struct {
+	db      *sql.DB
+	dialect SQLDialect
+	opts    *SQLStoreOptions
+}
+
+// Создаёт хранилище поверх открытого соединения с базой. Схему нужно подготовить вызовом Migrate.
+//
+// Пример:
+//
+//	db, _ := sql.Open("pgx", dsn)
+//	store := knocknock.HandleSQLStore(db, knocknock.PostgresDialect)
+//	if err := store.Migrate(ctx); err != nil {
+//	    log.Fatal(err)
+//	}
+func HandleSQLStore(db *sql.DB, dialect SQLDialect, sqlStoreOptions ...SQLStoreOption) *SQLStore {
+	opts := defaultSQLStoreOptions()
+	for _, opt := range sqlStoreOptions {
+		opt(opts)
+	}
+	return &SQLStore{db, dialect, opts}
+}
+
+// Применяет все ещё не применённые миграции схемы. Каждая миграция выполняется в своей транзакции (там, где СУБД
+// поддерживает транзакционный DDL). Повторный вызов безопасен
+func (s *SQLStore) Migrate(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (version INTEGER NOT NULL PRIMARY KEY)", s.opts.MigrationsTable))
+	if err != nil {
+		return err
+	}
+
+	current, err := s.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range sqlMigrations {
+		if migration.version <= current {
+			continue
+		}
+		if err := s.applyMigration(ctx, migration); err != nil {
+			return fmt.Errorf("knocknock: migration %d: %w", migration.version, err)
+		}
+	}
+
+	return nil
+}
+
+// Возвращает номер последней применённой миграции или 0, если схема ещё не создана
+func (s *SQLStore) SchemaVersion(ctx context.Context) (int, error) {
+	var version sql.NullInt64
+	row := s.db.QueryRowContext(ctx, fmt.Sprintf("SELECT MAX(version) FROM %s", s.opts.MigrationsTable))
+	if err := row.Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// Применяет одну миграцию и записывает её версию
+func (s *SQLStore) applyMigration(ctx context.Context, migration sqlMigration) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range migration.statements {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(statement, s.opts.TableName)); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx,
+		fmt.Sprintf("INSERT INTO %s (version) VALUES (%s)", s.opts.MigrationsTable, s.dialect.Placeholder(1)),
+		migration.version)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Реализация Store.Save
+func (s *SQLStore) Save(ctx context.Context, session *Session) error {
+	userData, meta, err := encodeSQLSession(session)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx,
+		fmt.Sprintf("INSERT INTO %s (token, user_data, meta, subject, created_at, expires_at) VALUES (%s)",
+			s.opts.TableName, s.placeholders(6)),
+		session.Token, userData, meta, nullString(session.Subject), session.CreatedAt.UnixNano(),
+		session.ExpiresAt.UnixNano())
+	if s.dialect.IsUniqueViolation(err) {
+		return SessionExistsError
+	}
+	return err
+}
+
+// Реализация Store.Get
+func (s *SQLStore) Get(ctx context.Context, token string) (*Session, error) {
+	row := s.db.QueryRowContext(ctx,
+		fmt.Sprintf("SELECT %s FROM %s WHERE token = %s", sqlSessionColumns, s.opts.TableName, s.dialect.Placeholder(1)),
+		token)
+
+	session, err := scanSQLSession(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, SessionNotFoundError
+	}
+	return session, err
+}
+
+// Реализация Store.Delete
+func (s *SQLStore) Delete(ctx context.Context, token string) error {
+	_, err := s.db.ExecContext(ctx,
+		fmt.Sprintf("DELETE FROM %s WHERE token = %s", s.opts.TableName, s.dialect.Placeholder(1)),
+		token)
+	return err
+}
+
+// Реализация Updater.Update
+func (s *SQLStore) Update(ctx context.Context, session *Session) error {
+	userData, meta, err := encodeSQLSession(session)
+	if err != nil {
+		return err
+	}
+
+	result, err := s.db.ExecContext(ctx,
+		fmt.Sprintf("UPDATE %s SET user_data = %s, meta = %s, subject = %s, created_at = %s, expires_at = %s WHERE token = %s",
+			s.opts.TableName, s.dialect.Placeholder(1), s.dialect.Placeholder(2), s.dialect.Placeholder(3),
+			s.dialect.Placeholder(4), s.dialect.Placeholder(5), s.dialect.Placeholder(6)),
+		userData, meta, nullString(session.Subject), session.CreatedAt.UnixNano(), session.ExpiresAt.UnixNano(),
+		session.Token)
+	if err != nil {
+		return err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return SessionNotFoundError
+	}
+	return nil
+}
+
+// Реализация Replacer.Replace. Удаление и вставка выполняются в одной транзакции
+func (s *SQLStore) Replace(ctx context.Context, oldToken string, session *Session) error {
+	userData, meta, err := encodeSQLSession(session)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx,
+		fmt.Sprintf("DELETE FROM %s WHERE token = %s", s.opts.TableName, s.dialect.Placeholder(1)),
+		oldToken)
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return SessionNotFoundError
+	}
+
+	_, err = tx.ExecContext(ctx,
+		fmt.Sprintf("INSERT INTO %s (token, user_data, meta, subject, created_at, expires_at) VALUES (%s)",
+			s.opts.TableName, s.placeholders(6)),
+		session.Token, userData, meta, nullString(session.Subject), session.CreatedAt.UnixNano(),
+		session.ExpiresAt.UnixNano())
+	if s.dialect.IsUniqueViolation(err) {
+		return SessionExistsError
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Реализация SubjectIndexer.ListBySubject
+func (s *SQLStore) ListBySubject(ctx context.Context, subject string) ([]*Session, error) {
+	rows, err := s.db.QueryContext(ctx,
+		fmt.Sprintf("SELECT %s FROM %s WHERE subject = %s", sqlSessionColumns, s.opts.TableName, s.dialect.Placeholder(1)),
+		subject)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*Session
+	for rows.Next() {
+		session, err := scanSQLSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// Удаляет протухшие сессии пачками по CleanupBatch строк, чтобы не держать долгих блокировок. Возвращает число
+// удалённых строк. Как и MemoryStore.Cleanup, метод не входит в Store
+func (s *SQLStore) Cleanup(ctx context.Context) (int64, error) {
+	query := s.dialect.LimitedDelete(s.opts.TableName,
+		"expires_at < "+s.dialect.Placeholder(1), s.opts.CleanupBatch)
+	now := time.Now().UnixNano()
+
+	var total int64
+	for {
+		result, err := s.db.ExecContext(ctx, query, now)
+		if err != nil {
+			return total, err
+		}
+
+		deleted, err := result.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+
+		total += deleted
+		if deleted == 0 || deleted < int64(s.opts.CleanupBatch) {
+			return total, nil
+		}
+	}
+}
+
+// Колонки, из которых собирается сессия, в порядке scanSQLSession
+const sqlSessionColumns = "token, user_data, meta, created_at, expires_at"
+
+// Собирает сессию из строки результата
+func scanSQLSession(row interface{ Scan(...any) error }) (*Session, error) {
+	var (
+		token, userData      string
+		meta                 sql.NullString
+		createdAt, expiresAt int64
+	)
+
+	if err := row.Scan(&token, &userData, &meta, &createdAt, &expiresAt); err != nil {
+		return nil, err
+	}
+
+	session := &Session{}
+	if meta.Valid {
+		if err := json.Unmarshal([]byte(meta.String), session); err != nil {
+			return nil, err
+		}
+	}
+	if err := json.Unmarshal([]byte(userData), &session.UserData); err != nil {
+		return nil, err
+	}
+
+	session.Token = token
+	session.CreatedAt = time.Unix(0, createdAt)
+	session.ExpiresAt = time.Unix(0, expiresAt)
+	return session, nil
+}
+
+// Пустая строка превращается в NULL, чтобы сессии без пользователя не попадали в индекс
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// Раскладывает сессию на колонки user_data и meta. В meta попадают все поля, у которых нет своей колонки
+func encodeSQLSession(session *Session) (string, string, error) {
+	userData, err := json.Marshal(session.UserData)
+	if err != nil {
+		return "", "", err
+	}
+
+	rest := *session
+	rest.Token, rest.UserData, rest.CreatedAt, rest.ExpiresAt = "", nil, time.Time{}, time.Time{}
+	meta, err := json.Marshal(rest)
+	if err != nil {
+		return "", "", err
+	}
+
+	return string(userData), string(meta), nil
+}
+
+// Возвращает список из n плейсхолдеров через запятую
+func (s *SQLStore) placeholders(n int) string {
+	list := make([]string, n)
+	for i := range list {
+		list[i] = s.dialect.Placeholder(i + 1)
+	}
+	return strings.Join(list, ", ")
+}
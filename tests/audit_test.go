@@ -0,0 +1,311 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tolstovrob/knocknock"
+)
+
+func TestAudit(t *testing.T) {
+	ctx := context.Background()
+
+	// Собирает записи журнала в память
+	collect := func(t *testing.T, authOptions ...knocknock.AuthOption) (*knocknock.Auth, *[]knocknock.AuditRecord) {
+		var records []knocknock.AuditRecord
+		audit, err := knocknock.HandleAuditLog(knocknock.AuditSinkFunc(func(ctx context.Context, record *knocknock.AuditRecord) error {
+			records = append(records, *record)
+			return nil
+		}))
+		if err != nil {
+			t.Fatalf("HandleAuditLog failed: %v", err)
+		}
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), append(authOptions, knocknock.WithAudit(audit))...)
+		return auth, &records
+	}
+
+	actions := func(records []knocknock.AuditRecord) []knocknock.AuditAction {
+		var result []knocknock.AuditAction
+		for _, record := range records {
+			result = append(result, record.Action)
+		}
+		return result
+	}
+
+	t.Run("Lifecycle", func(t *testing.T) {
+		auth, records := collect(t, knocknock.WithTokenHashing([]byte("secret")))
+
+		session, _ := auth.CreateSession(ctx, "user", knocknock.WithSubject("alice"))
+		auth.GetSession(ctx, session.Token)
+		regenerated, _ := auth.RegenerateSession(ctx, session.Token)
+		auth.DeleteSession(ctx, regenerated.Token)
+
+		expected := []knocknock.AuditAction{knocknock.AuditSessionCreate, knocknock.AuditSessionRegenerate, knocknock.AuditSessionRevoke}
+		if got := actions(*records); !slices.Equal(got, expected) {
+			t.Fatalf("Expected actions %v, got %v", expected, got)
+		}
+
+		created, regenerate, revoked := (*records)[0], (*records)[1], (*records)[2]
+		if created.Subject != "alice" || created.TokenFingerprint == "" {
+			t.Errorf("Unexpected create record %+v", created)
+		}
+		if regenerate.PreviousFingerprint != created.TokenFingerprint || regenerate.TokenFingerprint != revoked.TokenFingerprint {
+			t.Error("Fingerprints should link records of the same session")
+		}
+		for i, record := range *records {
+			if record.Seq != uint64(i+1) || record.Time.IsZero() || record.Hash == "" {
+				t.Errorf("Record %d is not sealed: %+v", i, record)
+			}
+			if i > 0 && record.PrevHash != (*records)[i-1].Hash {
+				t.Errorf("Record %d does not link to the previous one", i)
+			}
+		}
+	})
+
+	t.Run("Expire", func(t *testing.T) {
+		auth, records := collect(t, knocknock.WithDefaultExpiry(time.Millisecond))
+		session, _ := auth.CreateSession(ctx, "user")
+		time.Sleep(5 * time.Millisecond)
+		auth.GetSession(ctx, session.Token)
+
+		expected := []knocknock.AuditAction{knocknock.AuditSessionCreate, knocknock.AuditSessionExpire}
+		if got := actions(*records); !slices.Equal(got, expected) {
+			t.Errorf("Expected actions %v, got %v", expected, got)
+		}
+	})
+
+	t.Run("Access denied", func(t *testing.T) {
+		auth, records := collect(t)
+		session, _ := auth.CreateSession(ctx, "user", knocknock.WithSubject("alice"))
+		handler := auth.Middleware()(auth.Authorize(knocknock.AnyRole("admin"))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+		req := httptest.NewRequest("GET", "/admin", nil)
+		req.RemoteAddr = "203.0.113.7:51234"
+		req.Header.Set("User-Agent", "curl/8.0")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		req = httptest.NewRequest("GET", "/admin", nil)
+		req.Header.Set("Authorization", "Bearer "+session.Token)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		denied := (*records)[1:]
+		if len(denied) != 2 || denied[0].Action != knocknock.AuditAccessDenied || denied[1].Action != knocknock.AuditAccessDenied {
+			t.Fatalf("Expected two denials, got %v", actions(*records))
+		}
+		if denied[0].ClientIP != "203.0.113.7" || denied[0].UserAgent != "curl/8.0" {
+			t.Errorf("Expected client info, got %+v", denied[0])
+		}
+		if denied[0].Reason != knocknock.TokenMissingError.Error() {
+			t.Errorf("Unexpected reason %q", denied[0].Reason)
+		}
+		if denied[1].Subject != "alice" || denied[1].TokenFingerprint != (*records)[0].TokenFingerprint {
+			t.Errorf("Expected denial to identify the session, got %+v", denied[1])
+		}
+	})
+
+	t.Run("Request context", func(t *testing.T) {
+		auth, records := collect(t)
+		handler := auth.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth.Login(w, r, "user")
+		}))
+
+		req := httptest.NewRequest("POST", "/login", nil)
+		req.RemoteAddr = "198.51.100.1:4000"
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if len(*records) != 1 || (*records)[0].ClientIP != "198.51.100.1" {
+			t.Errorf("Expected create record with client IP, got %+v", *records)
+		}
+	})
+
+	t.Run("No raw tokens", func(t *testing.T) {
+		var buf bytes.Buffer
+		audit, _ := knocknock.HandleAuditLog(knocknock.HandleSlogSink(slog.New(slog.NewJSONHandler(&buf, nil))))
+		for _, opts := range [][]knocknock.AuthOption{
+			{knocknock.WithAudit(audit)},
+			{knocknock.WithAudit(audit), knocknock.WithJWT(knocknock.HS256Key([]byte("0123456789abcdef0123456789abcdef")))},
+		} {
+			auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), opts...)
+			session, _ := auth.CreateSession(ctx, "user")
+			auth.DeleteSession(ctx, session.Token)
+
+			if strings.Contains(buf.String(), session.Token) {
+				t.Error("Audit log should not contain raw token")
+			}
+		}
+		if !strings.Contains(buf.String(), `"action":"session.revoke"`) {
+			t.Errorf("Expected slog output to contain records, got %s", buf.String())
+		}
+	})
+
+	t.Run("Sink error keeps chain", func(t *testing.T) {
+		var written []knocknock.AuditRecord
+		fail := true
+		var reported error
+		audit, _ := knocknock.HandleAuditLog(knocknock.AuditSinkFunc(func(ctx context.Context, record *knocknock.AuditRecord) error {
+			if fail {
+				return errors.New("disk full")
+			}
+			written = append(written, *record)
+			return nil
+		}), knocknock.WithAuditErrorHandler(func(err error) { reported = err }))
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithAudit(audit))
+
+		if _, err := auth.CreateSession(ctx, "user"); err != nil {
+			t.Fatalf("Audit failure should not fail CreateSession: %v", err)
+		}
+		if reported == nil {
+			t.Error("Expected error handler to be called")
+		}
+
+		fail = false
+		auth.CreateSession(ctx, "user")
+		if len(written) != 1 || written[0].Seq != 1 || written[0].PrevHash != "" {
+			t.Errorf("Rejected record should not advance the chain, got %+v", written)
+		}
+	})
+}
+
+func TestJSONLinesSink(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	write := func(subjects ...string) {
+		sink, err := knocknock.HandleJSONLinesSink(path)
+		if err != nil {
+			t.Fatalf("HandleJSONLinesSink failed: %v", err)
+		}
+		defer sink.Close()
+		audit, err := knocknock.HandleAuditLog(sink)
+		if err != nil {
+			t.Fatalf("HandleAuditLog failed: %v", err)
+		}
+		for _, subject := range subjects {
+			audit.Record(ctx, &knocknock.AuditRecord{Action: knocknock.AuditAccessDenied, Subject: subject, Reason: "invalid password"})
+		}
+	}
+
+	t.Run("Resume and verify", func(t *testing.T) {
+		write("alice", "bob")
+		write("carol")
+
+		data, _ := os.ReadFile(path)
+		if lines := strings.Count(string(data), "\n"); lines != 3 {
+			t.Fatalf("Expected 3 lines, got %d", lines)
+		}
+		if err := knocknock.VerifyAuditLog(bytes.NewReader(data)); err != nil {
+			t.Errorf("Chain should verify after restart: %v", err)
+		}
+	})
+
+	t.Run("Tampering", func(t *testing.T) {
+		data, _ := os.ReadFile(path)
+		lines := strings.SplitAfter(string(data), "\n")
+
+		edited := strings.Replace(string(data), `"subject":"bob"`, `"subject":"eve"`, 1)
+		if err := knocknock.VerifyAuditLog(strings.NewReader(edited)); !errors.Is(err, knocknock.AuditChainBrokenError) {
+			t.Errorf("Edited record should break the chain, got %v", err)
+		}
+
+		removed := lines[0] + lines[2]
+		if err := knocknock.VerifyAuditLog(strings.NewReader(removed)); !errors.Is(err, knocknock.AuditChainBrokenError) {
+			t.Errorf("Removed record should break the chain, got %v", err)
+		}
+
+		// Хвост журнала после ротации проверяется сам по себе
+		if err := knocknock.VerifyAuditLog(strings.NewReader(lines[1] + lines[2])); err != nil {
+			t.Errorf("Suffix of the chain should verify, got %v", err)
+		}
+	})
+
+	t.Run("Torn last line", func(t *testing.T) {
+		file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+		file.WriteString(`{"seq":4,"act`)
+		file.Close()
+
+		sink, _ := knocknock.HandleJSONLinesSink(path)
+		defer sink.Close()
+		if _, err := knocknock.HandleAuditLog(sink); !errors.Is(err, knocknock.AuditChainBrokenError) {
+			t.Errorf("Expected AuditChainBrokenError, got %v", err)
+		}
+	})
+
+	t.Run("Large records", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "audit.jsonl")
+		reason := strings.Repeat("x", 2<<20)
+		for range 2 {
+			sink, _ := knocknock.HandleJSONLinesSink(path)
+			audit, err := knocknock.HandleAuditLog(sink)
+			if err != nil {
+				t.Fatalf("HandleAuditLog failed: %v", err)
+			}
+			audit.Record(ctx, &knocknock.AuditRecord{Action: knocknock.AuditAccessDenied, Reason: reason})
+			sink.Close()
+		}
+
+		file, _ := os.Open(path)
+		defer file.Close()
+		if err := knocknock.VerifyAuditLog(file); err != nil {
+			t.Errorf("Records over 1 MiB should verify: %v", err)
+		}
+	})
+
+	t.Run("Keyed chain", func(t *testing.T) {
+		key := []byte("audit-key")
+		record := func(opts ...knocknock.AuditOption) (string, *knocknock.AuditLog) {
+			var buf bytes.Buffer
+			sink := knocknock.AuditSinkFunc(func(ctx context.Context, record *knocknock.AuditRecord) error {
+				data, err := json.Marshal(record)
+				buf.Write(append(data, '\n'))
+				return err
+			})
+			audit, _ := knocknock.HandleAuditLog(sink, opts...)
+			for _, subject := range []string{"alice", "bob", "carol"} {
+				audit.Record(ctx, &knocknock.AuditRecord{Action: knocknock.AuditAccessDenied, Subject: subject})
+			}
+			return buf.String(), audit
+		}
+
+		signed, audit := record(knocknock.WithAuditKey(key))
+		if err := knocknock.VerifyAuditLog(strings.NewReader(signed), knocknock.WithAuditKey(key)); err != nil {
+			t.Errorf("Signed chain should verify with its key: %v", err)
+		}
+
+		// Цепочку без ключа подделыватель пересчитывает сам, с ключом -- нет
+		forged, _ := record()
+		if err := knocknock.VerifyAuditLog(strings.NewReader(forged)); err != nil {
+			t.Errorf("Unkeyed chain should verify without key: %v", err)
+		}
+		if err := knocknock.VerifyAuditLog(strings.NewReader(forged), knocknock.WithAuditKey(key)); !errors.Is(err, knocknock.AuditChainBrokenError) {
+			t.Errorf("Recomputed chain should not verify with key, got %v", err)
+		}
+
+		// Отрезанный хвост -- верная цепочка, его находит только якорь
+		seq, hash := audit.Head()
+		lines := strings.SplitAfter(signed, "\n")
+		truncated := lines[0] + lines[1]
+		if err := knocknock.VerifyAuditLog(strings.NewReader(truncated), knocknock.WithAuditKey(key)); err != nil {
+			t.Errorf("Truncated chain is still a chain, got %v", err)
+		}
+		if err := knocknock.VerifyAuditLog(strings.NewReader(truncated), knocknock.WithAuditKey(key), knocknock.WithAuditAnchor(seq, hash)); !errors.Is(err, knocknock.AuditChainBrokenError) {
+			t.Errorf("Truncated chain should fail the anchor, got %v", err)
+		}
+		if err := knocknock.VerifyAuditLog(strings.NewReader(signed), knocknock.WithAuditKey(key), knocknock.WithAuditAnchor(seq, hash)); err != nil {
+			t.Errorf("Full chain should match the anchor: %v", err)
+		}
+		if err := knocknock.VerifyAuditLog(strings.NewReader(signed), knocknock.WithAuditKey(key), knocknock.WithAuditAnchor(seq, "other")); !errors.Is(err, knocknock.AuditChainBrokenError) {
+			t.Errorf("Chain with other anchor hash should fail, got %v", err)
+		}
+	})
+}
@@ -2,12 +2,29 @@ package tests
 
 import (
 	"context"
+	"errors"
 	"testing"
 	"time"
 
 	"github.com/tolstovrob/knocknock"
 )
 
+// Хранилище без Updater, в котором сессия удаляется сразу после первого чтения: так продление гарантированно
+// совпадает с выходом на другом запросе
+type logoutRaceStore struct {
+	knocknock.Store
+	deleted bool
+}
+
+func (s *logoutRaceStore) Get(ctx context.Context, token string) (*knocknock.Session, error) {
+	session, err := s.Store.Get(ctx, token)
+	if err == nil && !s.deleted {
+		s.deleted = true
+		s.Store.Delete(ctx, token)
+	}
+	return session, err
+}
+
 func TestAuth(t *testing.T) {
 	store := knocknock.HandleMemoryStore()
 	auth := knocknock.HandleAuth(store)
@@ -218,4 +235,186 @@ func TestAuth(t *testing.T) {
 			t.Error("AuthOptions should not change with empty update")
 		}
 	})
+
+	t.Run("Sliding expiration extends session", func(t *testing.T) {
+		store := knocknock.HandleMemoryStore()
+		auth := knocknock.HandleAuth(store, knocknock.WithIdleTimeout(time.Hour), knocknock.WithTouchInterval(0))
+
+		store.Save(ctx, &knocknock.Session{
+			Token:     "idle",
+			CreatedAt: time.Now().Add(-2 * time.Hour),
+			ExpiresAt: time.Now().Add(time.Minute),
+		})
+
+		session, err := auth.GetSession(ctx, "idle")
+		if err != nil {
+			t.Fatalf("GetSession failed: %v", err)
+		}
+		if time.Until(session.ExpiresAt) < 59*time.Minute {
+			t.Errorf("Expected session to be extended by idle timeout, expires in %v", time.Until(session.ExpiresAt))
+		}
+
+		stored, _ := store.Get(ctx, "idle")
+		if !stored.ExpiresAt.Equal(session.ExpiresAt) {
+			t.Error("Extended expiry should be persisted in store")
+		}
+	})
+
+	t.Run("Sliding expiration respects max lifetime", func(t *testing.T) {
+		store := knocknock.HandleMemoryStore()
+		auth := knocknock.HandleAuth(store,
+			knocknock.WithIdleTimeout(time.Hour),
+			knocknock.WithMaxLifetime(150*time.Minute),
+			knocknock.WithTouchInterval(0),
+		)
+
+		createdAt := time.Now().Add(-2 * time.Hour)
+		store.Save(ctx, &knocknock.Session{
+			Token:     "capped",
+			CreatedAt: createdAt,
+			ExpiresAt: time.Now().Add(time.Minute),
+		})
+
+		session, err := auth.GetSession(ctx, "capped")
+		if err != nil {
+			t.Fatalf("GetSession failed: %v", err)
+		}
+		if expected := createdAt.Add(150 * time.Minute); !session.ExpiresAt.Equal(expected) {
+			t.Errorf("Expected expiry capped at %v, got %v", expected, session.ExpiresAt)
+		}
+	})
+
+	t.Run("Sliding expiration throttles writes", func(t *testing.T) {
+		store := knocknock.HandleMemoryStore()
+		auth := knocknock.HandleAuth(store, knocknock.WithIdleTimeout(time.Hour), knocknock.WithTouchInterval(time.Minute))
+
+		created, _ := auth.CreateSession(ctx, "user")
+		if expected := created.CreatedAt.Add(time.Hour); !created.ExpiresAt.Equal(expected) {
+			t.Errorf("Expected initial expiry %v, got %v", expected, created.ExpiresAt)
+		}
+
+		session, _ := auth.GetSession(ctx, created.Token)
+		if !session.ExpiresAt.Equal(created.ExpiresAt) {
+			t.Error("Session should not be extended within touch interval")
+		}
+	})
+
+	t.Run("Sliding expiration does not restore deleted sessions", func(t *testing.T) {
+		store := &logoutRaceStore{Store: knocknock.HandleMemoryStore()}
+		auth := knocknock.HandleAuth(store, knocknock.WithIdleTimeout(time.Hour))
+
+		created, _ := auth.CreateSession(ctx, "user")
+		auth.GetSession(ctx, created.Token)
+
+		if _, err := auth.GetSession(ctx, created.Token); !errors.Is(err, knocknock.SessionNotFoundError) {
+			t.Errorf("Touch without Updater should not save a deleted session back, got %v", err)
+		}
+	})
+
+	t.Run("ListSessions and RevokeAllSessions", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore())
+
+		first, _ := auth.CreateSession(ctx, "user", knocknock.WithSubject("alice"))
+		auth.CreateSession(ctx, "user", knocknock.WithSubject("alice"))
+		pair, _ := auth.CreateSessionPair(ctx, "user", knocknock.WithSubject("alice"))
+		other, _ := auth.CreateSession(ctx, "user", knocknock.WithSubject("bob"))
+
+		if first.Subject != "alice" {
+			t.Errorf("Expected subject alice, got %q", first.Subject)
+		}
+
+		sessions, err := auth.ListSessions(ctx, "alice")
+		if err != nil {
+			t.Fatalf("ListSessions failed: %v", err)
+		}
+		if len(sessions) != 3 {
+			t.Errorf("Expected 3 active sessions without refresh tokens, got %d", len(sessions))
+		}
+
+		if err := auth.RevokeAllSessions(ctx, "alice"); err != nil {
+			t.Fatalf("RevokeAllSessions failed: %v", err)
+		}
+
+		if sessions, _ := auth.ListSessions(ctx, "alice"); len(sessions) != 0 {
+			t.Errorf("Expected no sessions after revoke, got %d", len(sessions))
+		}
+		if _, err := auth.Refresh(ctx, pair.Refresh.Token); err == nil {
+			t.Error("Refresh token should be revoked too")
+		}
+		if _, err := auth.GetSession(ctx, other.Token); err != nil {
+			t.Errorf("Other user's session should survive: %v", err)
+		}
+	})
+
+	t.Run("ListSessions with unsupported store", func(t *testing.T) {
+		auth := knocknock.HandleAuth(struct{ knocknock.Store }{knocknock.HandleMemoryStore()})
+
+		if _, err := auth.ListSessions(ctx, "alice"); !errors.Is(err, knocknock.StoreUnsupportedError) {
+			t.Errorf("Expected StoreUnsupportedError, got %v", err)
+		}
+	})
+
+	t.Run("Session limit rejects new login", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithSessionLimit(1, knocknock.SessionLimitReject))
+
+		pair, err := auth.CreateSessionPair(ctx, "user", knocknock.WithSubject("alice"))
+		if err != nil {
+			t.Fatalf("CreateSessionPair failed: %v", err)
+		}
+		if _, err := auth.CreateSession(ctx, "user", knocknock.WithSubject("alice")); !errors.Is(err, knocknock.SessionLimitExceededError) {
+			t.Errorf("Expected SessionLimitExceededError, got %v", err)
+		}
+		if _, err := auth.CreateSession(ctx, "user", knocknock.WithSubject("bob")); err != nil {
+			t.Errorf("Other user should not be limited: %v", err)
+		}
+		if _, err := auth.Refresh(ctx, pair.Refresh.Token); err != nil {
+			t.Errorf("Refresh should replace the session within the limit: %v", err)
+		}
+	})
+
+	t.Run("Session limit evicts oldest", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithSessionLimit(2, knocknock.SessionLimitEvictOldest))
+
+		oldest, _ := auth.CreateSessionPair(ctx, "user", knocknock.WithSubject("alice"))
+		second, _ := auth.CreateSession(ctx, "user", knocknock.WithSubject("alice"))
+		third, err := auth.CreateSession(ctx, "user", knocknock.WithSubject("alice"))
+		if err != nil {
+			t.Fatalf("CreateSession failed: %v", err)
+		}
+
+		if _, err := auth.GetSession(ctx, oldest.Access.Token); err == nil {
+			t.Error("Oldest session should be evicted")
+		}
+		if _, err := auth.Refresh(ctx, oldest.Refresh.Token); err == nil {
+			t.Error("Refresh token of evicted session should be revoked")
+		}
+		for _, session := range []*knocknock.Session{second, third} {
+			if _, err := auth.GetSession(ctx, session.Token); err != nil {
+				t.Errorf("Newer session should survive: %v", err)
+			}
+		}
+	})
+
+	t.Run("Session limit evicts least recently used", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(),
+			knocknock.WithSessionLimit(2, knocknock.SessionLimitEvictLRU),
+			knocknock.WithTouchInterval(time.Nanosecond),
+		)
+
+		first, _ := auth.CreateSession(ctx, "user", knocknock.WithSubject("alice"))
+		second, _ := auth.CreateSession(ctx, "user", knocknock.WithSubject("alice"))
+
+		if session, _ := auth.GetSession(ctx, first.Token); session.LastAccessedAt.IsZero() {
+			t.Error("GetSession should record last access")
+		}
+
+		auth.CreateSession(ctx, "user", knocknock.WithSubject("alice"))
+
+		if _, err := auth.GetSession(ctx, first.Token); err != nil {
+			t.Errorf("Recently used session should survive: %v", err)
+		}
+		if _, err := auth.GetSession(ctx, second.Token); err == nil {
+			t.Error("Least recently used session should be evicted")
+		}
+	})
 }
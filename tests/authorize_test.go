@@ -0,0 +1,109 @@
+package tests
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tolstovrob/knocknock"
+)
+
+func TestAuthorize(t *testing.T) {
+	ctx := context.Background()
+	auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithRoleHierarchy(map[string][]string{
+		"admin":  {"editor"},
+		"editor": {"viewer"},
+	}))
+
+	admin, _ := auth.CreateSession(ctx, "admin", knocknock.WithRoles("admin"))
+	editor, _ := auth.CreateSession(ctx, "editor", knocknock.WithRoles("editor"), knocknock.WithScopes("orders:read", "orders:write"))
+	viewer, _ := auth.CreateSession(ctx, "viewer", knocknock.WithRoles("viewer"), knocknock.WithScopes("orders:read"))
+
+	serve := func(middleware func(http.Handler) http.Handler, session *knocknock.Session) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		if session != nil {
+			req.Header.Set("Authorization", "Bearer "+session.Token)
+		}
+		rr := httptest.NewRecorder()
+		middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("Role hierarchy", func(t *testing.T) {
+		requireViewer := auth.RequireRoles("viewer")
+		for _, session := range []*knocknock.Session{admin, editor, viewer} {
+			if rr := serve(requireViewer, session); rr.Code != http.StatusOK {
+				t.Errorf("Role %v should imply viewer, got %d", session.Roles, rr.Code)
+			}
+		}
+
+		if rr := serve(auth.RequireRoles("editor"), viewer); rr.Code != http.StatusForbidden {
+			t.Errorf("Viewer should not pass editor check, got %d", rr.Code)
+		}
+		if !auth.HasRole(admin, "viewer") || auth.HasRole(viewer, "admin") {
+			t.Error("HasRole should follow hierarchy transitively and one way")
+		}
+	})
+
+	t.Run("Scopes with AND", func(t *testing.T) {
+		requireWrite := auth.RequireScopes("orders:read", "orders:write")
+
+		if rr := serve(requireWrite, editor); rr.Code != http.StatusOK {
+			t.Errorf("Expected 200, got %d", rr.Code)
+		}
+
+		rr := serve(requireWrite, viewer)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("Expected 403, got %d", rr.Code)
+		}
+		expected := `Bearer error="insufficient_scope", scope="orders:read orders:write"`
+		if challenge := rr.Header().Get("WWW-Authenticate"); challenge != expected {
+			t.Errorf("Expected %q, got %q", expected, challenge)
+		}
+	})
+
+	t.Run("Rules with OR", func(t *testing.T) {
+		rule := auth.Authorize(knocknock.Or(knocknock.AllRoles("admin"), knocknock.AnyScope("orders:write")))
+
+		for session, code := range map[*knocknock.Session]int{admin: 200, editor: 200, viewer: 403} {
+			if rr := serve(rule, session); rr.Code != code {
+				t.Errorf("Session %v: expected %d, got %d", session.Roles, code, rr.Code)
+			}
+		}
+	})
+
+	t.Run("Rules with AND", func(t *testing.T) {
+		rule := auth.Authorize(knocknock.And(knocknock.AnyRole("editor", "viewer"), knocknock.AllScopes("orders:write")))
+
+		for session, code := range map[*knocknock.Session]int{admin: 403, editor: 200, viewer: 403} {
+			if rr := serve(rule, session); rr.Code != code {
+				t.Errorf("Session %v: expected %d, got %d", session.Roles, code, rr.Code)
+			}
+		}
+	})
+
+	t.Run("Unauthenticated", func(t *testing.T) {
+		if rr := serve(auth.RequireRoles("viewer"), nil); rr.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401, got %d", rr.Code)
+		}
+	})
+
+	t.Run("Roles survive refresh and JWT", func(t *testing.T) {
+		pair, _ := auth.CreateSessionPair(ctx, "admin", knocknock.WithRoles("admin"))
+		rotated, _ := auth.Refresh(ctx, pair.Refresh.Token)
+		if !auth.HasRole(rotated.Access, "admin") {
+			t.Errorf("Roles should carry over refresh, got %v", rotated.Access.Roles)
+		}
+
+		_, private, _ := ed25519.GenerateKey(rand.Reader)
+		signed := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithJWT(knocknock.EdDSAKey(private)))
+		session, _ := signed.CreateSession(ctx, "editor", knocknock.WithRoles("editor"), knocknock.WithScopes("orders:read", "orders:write"))
+		retrieved, _ := signed.GetSession(ctx, session.Token)
+		if !signed.HasRole(retrieved, "editor") || !retrieved.HasScope("orders:write") {
+			t.Errorf("Roles and scopes should round trip through JWT, got %v %v", retrieved.Roles, retrieved.Scopes)
+		}
+	})
+}
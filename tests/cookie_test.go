@@ -0,0 +1,205 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tolstovrob/knocknock"
+)
+
+func TestCookieOptions(t *testing.T) {
+	t.Run("Attributes", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(),
+			knocknock.WithCookieDomain("example.com"),
+			knocknock.WithCookiePath("/app"),
+			knocknock.WithCookieSecure(true),
+			knocknock.WithCookieSameSite(http.SameSiteStrictMode),
+			knocknock.WithCookiePartitioned(),
+		)
+
+		rr := httptest.NewRecorder()
+		if _, err := auth.Login(rr, httptest.NewRequest("POST", "/login", nil), "user"); err != nil {
+			t.Fatalf("Login failed: %v", err)
+		}
+		cookies := rr.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("Expected one cookie, got %d", len(cookies))
+		}
+		cookie := cookies[0]
+		if cookie.Domain != "example.com" || cookie.Path != "/app" || !cookie.Secure || !cookie.HttpOnly ||
+			cookie.SameSite != http.SameSiteStrictMode || !cookie.Partitioned {
+			t.Errorf("Unexpected cookie attributes: %+v", cookie)
+		}
+	})
+
+	t.Run("Defaults", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore())
+		rr := httptest.NewRecorder()
+		auth.Login(rr, httptest.NewRequest("POST", "/login", nil), "user")
+		cookie := rr.Result().Cookies()[0]
+		if cookie.Path != "/" || !cookie.Secure || cookie.SameSite != http.SameSiteLaxMode {
+			t.Errorf("Unexpected default cookie attributes: %+v", cookie)
+		}
+
+		// Без Secure по умолчанию cookie ставится с Secure только для запросов по TLS
+		auth = knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithCookieSecure(false))
+		rr = httptest.NewRecorder()
+		auth.Login(rr, httptest.NewRequest("POST", "/login", nil), "user")
+		if cookie := rr.Result().Cookies()[0]; cookie.Secure {
+			t.Errorf("Expected no Secure over plain HTTP after opt-out: %+v", cookie)
+		}
+		rr = httptest.NewRecorder()
+		auth.Login(rr, httptest.NewRequest("POST", "https://example.com/login", nil), "user")
+		if cookie := rr.Result().Cookies()[0]; !cookie.Secure {
+			t.Errorf("Expected Secure over TLS after opt-out: %+v", cookie)
+		}
+	})
+
+	t.Run("Host prefix", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithHostPrefix(), knocknock.WithCookieName("sid"))
+		if auth.AuthOptions.CookieName != "__Host-sid" {
+			t.Fatalf("Expected __Host- prefix, got %q", auth.AuthOptions.CookieName)
+		}
+
+		rr := httptest.NewRecorder()
+		auth.Login(rr, httptest.NewRequest("POST", "/login", nil), "user")
+		cookie := rr.Result().Cookies()[0]
+		if cookie.Name != "__Host-sid" || !cookie.Secure || cookie.Path != "/" || cookie.Domain != "" {
+			t.Errorf("Unexpected __Host- cookie: %+v", cookie)
+		}
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		invalid := map[string][]knocknock.AuthOption{
+			"host prefix without secure":   {knocknock.WithCookieName("__Host-sid"), knocknock.WithCookieSecure(false)},
+			"host prefix with domain":      {knocknock.WithHostPrefix(), knocknock.WithCookieDomain("example.com")},
+			"secure prefix without secure": {knocknock.WithCookieName("__Secure-sid"), knocknock.WithCookieSecure(false)},
+			"same site none":               {knocknock.WithCookieSameSite(http.SameSiteNoneMode), knocknock.WithCookieSecure(false)},
+			"partitioned":                  {knocknock.WithCookiePartitioned(), knocknock.WithCookieSecure(false)},
+			"relative path":                {knocknock.WithCookiePath("app")},
+			"bad name":                     {knocknock.WithCookieName("bad name")},
+		}
+		for name, opts := range invalid {
+			options := knocknock.HandleAuth(knocknock.HandleMemoryStore()).AuthOptions
+			for _, opt := range opts {
+				opt(options)
+			}
+			if err := options.Validate(); !errors.Is(err, knocknock.InvalidCookieOptionsError) {
+				t.Errorf("%s: expected InvalidCookieOptionsError, got %v", name, err)
+			}
+		}
+
+		if _, err := knocknock.HandleCheckedAuth(knocknock.HandleMemoryStore(), knocknock.WithCookiePath("app")); !errors.Is(err, knocknock.InvalidCookieOptionsError) {
+			t.Errorf("HandleCheckedAuth: expected InvalidCookieOptionsError, got %v", err)
+		}
+
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore())
+		if err := auth.UpdateCheckedAuthOptions(knocknock.WithDefaultExpiry(time.Minute), knocknock.WithCookiePath("app")); !errors.Is(err, knocknock.InvalidCookieOptionsError) {
+			t.Errorf("UpdateCheckedAuthOptions: expected InvalidCookieOptionsError, got %v", err)
+		}
+		if auth.AuthOptions.CookiePath != "/" || auth.AuthOptions.DefaultExpiry == time.Minute {
+			t.Error("Failed UpdateCheckedAuthOptions should keep previous options")
+		}
+	})
+
+	t.Run("Unchecked constructors stay lenient", func(t *testing.T) {
+		var logs bytes.Buffer
+		logger := slog.New(slog.NewTextHandler(&logs, nil))
+
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithLogger(logger), knocknock.WithCookiePath("app"))
+		if auth.AuthOptions.CookiePath != "app" {
+			t.Errorf("HandleAuth should keep options as given, got path %q", auth.AuthOptions.CookiePath)
+		}
+		auth.UpdateAuthOptions(knocknock.WithCookieSameSite(http.SameSiteNoneMode), knocknock.WithCookieSecure(false))
+		if auth.AuthOptions.CookieSameSite != http.SameSiteNoneMode {
+			t.Error("UpdateAuthOptions should apply options as given")
+		}
+		if n := strings.Count(logs.String(), "inconsistent auth options"); n != 2 {
+			t.Errorf("Expected two warnings, got %d:\n%s", n, logs.String())
+		}
+	})
+}
+
+func TestLoginLogout(t *testing.T) {
+	ctx := context.Background()
+	auth := knocknock.HandleAuth(knocknock.HandleMemoryStore())
+
+	rr := httptest.NewRecorder()
+	first, err := auth.Login(rr, httptest.NewRequest("POST", "/login", nil), "user")
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	cookie := rr.Result().Cookies()[0]
+	if cookie.Value != first.Token {
+		t.Errorf("Expected session token in cookie, got %q", cookie.Value)
+	}
+
+	// Повторный вход заменяет сессию из cookie
+	req := httptest.NewRequest("POST", "/login", nil)
+	req.AddCookie(cookie)
+	rr = httptest.NewRecorder()
+	second, err := auth.Login(rr, req, "user")
+	if err != nil {
+		t.Fatalf("Second login failed: %v", err)
+	}
+	if _, err := auth.GetSession(ctx, first.Token); !errors.Is(err, knocknock.SessionNotFoundError) {
+		t.Errorf("Expected previous session to be deleted, got %v", err)
+	}
+
+	req = httptest.NewRequest("POST", "/logout", nil)
+	req.AddCookie(rr.Result().Cookies()[0])
+	rr = httptest.NewRecorder()
+	if err := auth.Logout(rr, req); err != nil {
+		t.Fatalf("Logout failed: %v", err)
+	}
+	if _, err := auth.GetSession(ctx, second.Token); !errors.Is(err, knocknock.SessionNotFoundError) {
+		t.Errorf("Expected session to be deleted on logout, got %v", err)
+	}
+	cleared := rr.Result().Cookies()
+	if len(cleared) != 1 || cleared[0].Value != "" || !cleared[0].Expires.Before(time.Now()) {
+		t.Errorf("Expected cookie to be cleared, got %+v", cleared)
+	}
+
+	if err := auth.Logout(httptest.NewRecorder(), httptest.NewRequest("POST", "/logout", nil)); err != nil {
+		t.Errorf("Logout without session should not fail, got %v", err)
+	}
+}
+
+func TestLoginLogoutCookieStore(t *testing.T) {
+	store, _ := knocknock.HandleCookieStore([]byte("0123456789abcdef0123456789abcdef"))
+	auth := knocknock.HandleAuth(store, knocknock.WithIdleTimeout(time.Hour))
+	previous, _ := auth.CreateSession(context.Background(), "previous")
+
+	// Middleware продлевает сессию из cookie и перезапечатал бы её поверх cookie, записанной обработчиком
+	var session *knocknock.Session
+	serve := func(handler func(w http.ResponseWriter, r *http.Request)) []*http.Cookie {
+		req := httptest.NewRequest("POST", "/", nil)
+		req.AddCookie(&http.Cookie{Name: "session_token", Value: previous.Token})
+		rr := httptest.NewRecorder()
+		auth.Middleware()(http.HandlerFunc(handler)).ServeHTTP(rr, req)
+		return rr.Result().Cookies()
+	}
+
+	cookies := serve(func(w http.ResponseWriter, r *http.Request) {
+		session, _ = auth.Login(w, r, "next")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	if len(cookies) != 1 || cookies[0].Value != session.Token {
+		t.Errorf("Expected only the new session cookie after Login, got %v", cookies)
+	}
+
+	cookies = serve(func(w http.ResponseWriter, r *http.Request) {
+		auth.Logout(w, r)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	if len(cookies) != 1 || cookies[0].Value != "" {
+		t.Errorf("Expected only the cleared cookie after Logout, got %v", cookies)
+	}
+}
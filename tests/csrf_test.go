@@ -0,0 +1,261 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/tolstovrob/knocknock"
+)
+
+func TestCSRF(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Synchronizer token", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithTokenHashing([]byte("secret")))
+		csrf := auth.CSRF()
+		session, _ := auth.CreateSession(ctx, "user")
+		cookie := &http.Cookie{Name: "session_token", Value: session.Token}
+
+		// Токен выдаётся при рендеринге формы и сохраняется в сессии
+		var token string
+		issue := auth.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			previous := knocknock.GetSession(r.Context())
+			issued, next, err := csrf.Token(w, r)
+			if err != nil {
+				t.Fatalf("Token failed: %v", err)
+			}
+			if previous.CSRFToken != "" {
+				t.Error("Session in the original request should stay untouched")
+			}
+			if again, _, _ := csrf.Token(w, next); again != issued {
+				t.Errorf("Returned request should carry the issued token, got %q and %q", issued, again)
+			}
+			token = issued
+		}))
+		req := httptest.NewRequest("GET", "/form", nil)
+		req.AddCookie(cookie)
+		issue.ServeHTTP(httptest.NewRecorder(), req)
+		if token == "" {
+			t.Fatal("Expected CSRF token")
+		}
+
+		stored, err := auth.GetSession(ctx, session.Token)
+		if err != nil || stored.CSRFToken != token {
+			t.Fatalf("Expected CSRF token to be stored in session, got %q (%v)", stored.CSRFToken, err)
+		}
+
+		handler := auth.Middleware()(csrf.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+		serve := func(req *http.Request) int {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			return rr.Code
+		}
+
+		req = httptest.NewRequest("POST", "/orders", nil)
+		req.AddCookie(cookie)
+		if code := serve(req); code != http.StatusForbidden {
+			t.Errorf("Expected 403 without CSRF token, got %d", code)
+		}
+
+		req = httptest.NewRequest("POST", "/orders", nil)
+		req.AddCookie(cookie)
+		req.Header.Set("X-CSRF-Token", "forged")
+		if code := serve(req); code != http.StatusForbidden {
+			t.Errorf("Expected 403 with wrong CSRF token, got %d", code)
+		}
+
+		req = httptest.NewRequest("DELETE", "/orders/1", nil)
+		req.AddCookie(cookie)
+		req.Header.Set("X-CSRF-Token", token)
+		if code := serve(req); code != http.StatusOK {
+			t.Errorf("Expected 200 with CSRF header, got %d", code)
+		}
+
+		form := url.Values{"csrf_token": {token}}
+		req = httptest.NewRequest("POST", "/orders", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+		if code := serve(req); code != http.StatusOK {
+			t.Errorf("Expected 200 with CSRF form field, got %d", code)
+		}
+
+		req = httptest.NewRequest("GET", "/orders", nil)
+		req.AddCookie(cookie)
+		if code := serve(req); code != http.StatusOK {
+			t.Errorf("Expected safe method to pass, got %d", code)
+		}
+	})
+
+	t.Run("Exemptions", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore())
+		session, _ := auth.CreateSession(ctx, "user")
+		handler := auth.CSRF().Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+		req := httptest.NewRequest("POST", "/orders", nil)
+		req.Header.Set("Authorization", "Bearer "+session.Token)
+		req.AddCookie(&http.Cookie{Name: "session_token", Value: session.Token})
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("Expected Authorization header request to be exempt, got %d", rr.Code)
+		}
+
+		req = httptest.NewRequest("POST", "/login", nil)
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("Expected request without session cookie to pass, got %d", rr.Code)
+		}
+	})
+
+	t.Run("Cookie store", func(t *testing.T) {
+		store, _ := knocknock.HandleCookieStore([]byte("0123456789abcdef0123456789abcdef"))
+		auth := knocknock.HandleAuth(store)
+		csrf := auth.CSRF()
+		session, _ := auth.CreateSession(ctx, "user")
+
+		var token string
+		handler := auth.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, _, _ = csrf.Token(w, r)
+		}))
+		req := httptest.NewRequest("GET", "/form", nil)
+		req.AddCookie(&http.Cookie{Name: "session_token", Value: session.Token})
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		var resealed *knocknock.Session
+		check := auth.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			resealed = knocknock.GetSession(r.Context())
+		}))
+		check.ServeHTTP(httptest.NewRecorder(), requestWithCookies(rr.Result().Cookies()))
+		if token == "" || resealed == nil || resealed.CSRFToken != token {
+			t.Fatalf("Expected CSRF token in resealed cookie, got %v", resealed)
+		}
+	})
+
+	t.Run("Double submit", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithJWT(knocknock.HS256Key([]byte("0123456789abcdef0123456789abcdef"))))
+		session, _ := auth.CreateSession(ctx, "user")
+
+		var failure error
+		csrf := auth.CSRF(knocknock.WithCSRFDoubleSubmit(), knocknock.WithCSRFFailureHandler(func(w http.ResponseWriter, r *http.Request, err error) {
+			failure = err
+			w.WriteHeader(http.StatusTeapot)
+		}))
+
+		rr := httptest.NewRecorder()
+		form := httptest.NewRequest("GET", "/", nil)
+		form.AddCookie(&http.Cookie{Name: "session_token", Value: session.Token})
+		token, _, err := csrf.Token(rr, form)
+		if err != nil || token == "" {
+			t.Fatalf("Token failed: %v", err)
+		}
+		cookies := rr.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Name != "__Host-csrf_token" || cookies[0].HttpOnly || cookies[0].Domain != "" || cookies[0].Path != "/" {
+			t.Fatalf("Expected script-readable __Host-csrf_token cookie, got %v", cookies)
+		}
+
+		// За прокси, снимающим TLS, cookie должна получить Secure из настроек Auth
+		secure := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithCookieSecure(true), knocknock.WithCookieSameSite(http.SameSiteStrictMode))
+		proxied := httptest.NewRecorder()
+		secure.CSRF(knocknock.WithCSRFDoubleSubmit()).Token(proxied, httptest.NewRequest("GET", "/", nil))
+		if cookie := proxied.Result().Cookies()[0]; !cookie.Secure || cookie.SameSite != http.SameSiteStrictMode {
+			t.Errorf("Expected CSRF cookie to follow Auth cookie options, got %v", cookie)
+		}
+
+		handler := csrf.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		serve := func(submitted string) int {
+			req := httptest.NewRequest("PUT", "/profile", nil)
+			req.AddCookie(&http.Cookie{Name: "session_token", Value: session.Token})
+			req.AddCookie(cookies[0])
+			req.Header.Set("X-CSRF-Token", submitted)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			return rr.Code
+		}
+
+		if code := serve(token); code != http.StatusOK {
+			t.Errorf("Expected 200 with matching token, got %d", code)
+		}
+		if code := serve("other"); code != http.StatusTeapot || !errors.Is(failure, knocknock.CSRFTokenInvalidError) {
+			t.Errorf("Expected failure handler with CSRFTokenInvalidError, got %d (%v)", code, failure)
+		}
+
+		// Без Secure префикс __Host- невозможен, имя остаётся прежним
+		plain := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithCookieSecure(false))
+		if name := plain.CSRF(knocknock.WithCSRFDoubleSubmit()).CookieName(); name != "csrf_token" {
+			t.Errorf("Expected csrf_token without Secure, got %q", name)
+		}
+	})
+
+	t.Run("Double submit rejects planted tokens", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithJWT(knocknock.HS256Key([]byte("0123456789abcdef0123456789abcdef"))))
+		key := []byte("fedcba9876543210fedcba9876543210")
+		csrf := auth.CSRF(knocknock.WithCSRFDoubleSubmit(), knocknock.WithCSRFKey(key))
+		victim, _ := auth.CreateSession(ctx, "victim")
+		attacker, _ := auth.CreateSession(ctx, "attacker")
+
+		issue := func(session *knocknock.Session) string {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.AddCookie(&http.Cookie{Name: "session_token", Value: session.Token})
+			token, _, err := csrf.Token(httptest.NewRecorder(), req)
+			if err != nil {
+				t.Fatalf("Token failed: %v", err)
+			}
+			return token
+		}
+
+		handler := csrf.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		serve := func(session *knocknock.Session, token string) int {
+			req := httptest.NewRequest("POST", "/transfer", nil)
+			req.AddCookie(&http.Cookie{Name: "session_token", Value: session.Token})
+			req.AddCookie(&http.Cookie{Name: csrf.CookieName(), Value: token})
+			req.Header.Set("X-CSRF-Token", token)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			return rr.Code
+		}
+
+		if code := serve(victim, issue(victim)); code != http.StatusOK {
+			t.Errorf("Expected 200 with token issued for the session, got %d", code)
+		}
+
+		// Cookie и заголовок, придуманные вне сервера, совпадают, но не подписаны
+		if code := serve(victim, "forged"); code != http.StatusForbidden {
+			t.Errorf("Expected 403 for unsigned planted token, got %d", code)
+		}
+		if code := serve(victim, "0123.abcd"); code != http.StatusForbidden {
+			t.Errorf("Expected 403 for badly signed planted token, got %d", code)
+		}
+
+		// Токен, выданный атакующему для его сессии, не подходит сессии жертвы
+		if code := serve(victim, issue(attacker)); code != http.StatusForbidden {
+			t.Errorf("Expected 403 for token issued for another session, got %d", code)
+		}
+
+		// Токен, подписанный другим ключом, тоже не подходит
+		other := auth.CSRF(knocknock.WithCSRFDoubleSubmit())
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: "session_token", Value: victim.Token})
+		foreign, _, _ := other.Token(httptest.NewRecorder(), req)
+		if code := serve(victim, foreign); code != http.StatusForbidden {
+			t.Errorf("Expected 403 for token signed with another key, got %d", code)
+		}
+
+		// Токен, выданный до входа, Token заменяет новым
+		anonymous, _, _ := csrf.Token(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		req = httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: "session_token", Value: victim.Token})
+		req.AddCookie(&http.Cookie{Name: csrf.CookieName(), Value: anonymous})
+		rr := httptest.NewRecorder()
+		reissued, _, _ := csrf.Token(rr, req)
+		if reissued == anonymous || len(rr.Result().Cookies()) != 1 {
+			t.Errorf("Expected a new token after login, got %q", reissued)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tolstovrob/knocknock"
+)
+
+func TestTokenHashing(t *testing.T) {
+	ctx := context.Background()
+	oldKey := []byte("old-key-0123456789abcdef0123456789")
+	newKey := []byte("new-key-0123456789abcdef0123456789")
+
+	t.Run("Store sees only hashes", func(t *testing.T) {
+		store := knocknock.HandleMemoryStore()
+		auth := knocknock.HandleAuth(store, knocknock.WithTokenHashing(oldKey))
+
+		session, err := auth.CreateSession(ctx, "test-user")
+		if err != nil {
+			t.Fatalf("CreateSession failed: %v", err)
+		}
+
+		if _, err := store.Get(ctx, session.Token); !errors.Is(err, knocknock.SessionNotFoundError) {
+			t.Error("Raw token should not be a store key")
+		}
+
+		retrieved, err := auth.GetSession(ctx, session.Token)
+		if err != nil {
+			t.Fatalf("GetSession failed: %v", err)
+		}
+		if retrieved.Token != session.Token {
+			t.Errorf("Expected raw token %s, got %s", session.Token, retrieved.Token)
+		}
+
+		if err := auth.DeleteSession(ctx, session.Token); err != nil {
+			t.Fatalf("DeleteSession failed: %v", err)
+		}
+		if _, err := auth.GetSession(ctx, session.Token); err == nil {
+			t.Error("Session should be deleted")
+		}
+	})
+
+	t.Run("Refresh with hashed tokens", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithTokenHashing(oldKey))
+		pair, _ := auth.CreateSessionPair(ctx, "test-user")
+
+		rotated, err := auth.Refresh(ctx, pair.Refresh.Token)
+		if err != nil {
+			t.Fatalf("Refresh failed: %v", err)
+		}
+		if _, err := auth.GetSession(ctx, pair.Access.Token); err == nil {
+			t.Error("Old access token should be revoked after refresh")
+		}
+		if _, err := auth.Refresh(ctx, pair.Refresh.Token); !errors.Is(err, knocknock.RefreshTokenReusedError) {
+			t.Errorf("Expected RefreshTokenReusedError, got %v", err)
+		}
+		if _, err := auth.GetSession(ctx, rotated.Access.Token); err == nil {
+			t.Error("Family should be revoked after reuse")
+		}
+	})
+
+	t.Run("Key rotation with grace period", func(t *testing.T) {
+		store := knocknock.HandleMemoryStore()
+		auth := knocknock.HandleAuth(store, knocknock.WithTokenHashing(oldKey))
+		old, _ := auth.CreateSession(ctx, "test-user")
+
+		auth.UpdateAuthOptions(knocknock.WithTokenHashKeyRotation(newKey, oldKey, time.Hour))
+		if _, err := auth.GetSession(ctx, old.Token); err != nil {
+			t.Errorf("Session under previous key should be accepted within grace period: %v", err)
+		}
+
+		fresh, _ := auth.CreateSession(ctx, "test-user")
+		if _, err := knocknock.HandleAuth(store, knocknock.WithTokenHashing(newKey)).GetSession(ctx, fresh.Token); err != nil {
+			t.Errorf("New session should be hashed with the new key: %v", err)
+		}
+
+		auth.UpdateAuthOptions(knocknock.WithTokenHashKeyRotation(newKey, oldKey, -time.Second))
+		if _, err := auth.GetSession(ctx, old.Token); !errors.Is(err, knocknock.SessionNotFoundError) {
+			t.Errorf("Expected SessionNotFoundError after grace period, got %v", err)
+		}
+		if _, err := auth.GetSession(ctx, fresh.Token); err != nil {
+			t.Errorf("Session under current key should survive: %v", err)
+		}
+	})
+}
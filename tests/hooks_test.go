@@ -0,0 +1,167 @@
+package tests
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/tolstovrob/knocknock"
+)
+
+func TestHooks(t *testing.T) {
+	ctx := context.Background()
+
+	// Записывает виды событий в порядке их появления
+	record := func(auth *knocknock.Auth) *[]knocknock.EventKind {
+		var kinds []knocknock.EventKind
+		hook := func(kind knocknock.EventKind) knocknock.SessionHook {
+			return func(ctx context.Context, session *knocknock.Session) {
+				kinds = append(kinds, kind)
+			}
+		}
+		auth.OnCreate(hook(knocknock.EventCreate))
+		auth.OnAccess(hook(knocknock.EventAccess))
+		auth.OnExpire(hook(knocknock.EventExpire))
+		auth.OnDelete(hook(knocknock.EventDelete))
+		auth.OnRefresh(hook(knocknock.EventRefresh))
+		return &kinds
+	}
+
+	t.Run("Lifecycle", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore())
+		kinds := record(auth)
+
+		var created *knocknock.Session
+		auth.OnCreate(func(ctx context.Context, session *knocknock.Session) {
+			created = session
+		})
+
+		session, _ := auth.CreateSession(ctx, "user", knocknock.WithSubject("alice"))
+		if created == nil || created.Token != session.Token || created.Subject != "alice" {
+			t.Errorf("OnCreate should receive the new session, got %+v", created)
+		}
+
+		auth.GetSession(ctx, session.Token)
+		auth.DeleteSession(ctx, session.Token)
+		auth.DeleteSession(ctx, session.Token)
+
+		expected := []knocknock.EventKind{knocknock.EventCreate, knocknock.EventAccess, knocknock.EventDelete}
+		if !slices.Equal(*kinds, expected) {
+			t.Errorf("Expected events %v, got %v", expected, *kinds)
+		}
+	})
+
+	t.Run("Lazy expiration", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithDefaultExpiry(time.Millisecond))
+		kinds := record(auth)
+
+		session, _ := auth.CreateSession(ctx, "user")
+		time.Sleep(5 * time.Millisecond)
+		auth.GetSession(ctx, session.Token)
+
+		expected := []knocknock.EventKind{knocknock.EventCreate, knocknock.EventExpire}
+		if !slices.Equal(*kinds, expected) {
+			t.Errorf("Expected events %v, got %v", expected, *kinds)
+		}
+	})
+
+	t.Run("Cleanup expiration", func(t *testing.T) {
+		store := knocknock.HandleMemoryStore()
+		auth := knocknock.HandleAuth(store, knocknock.WithDefaultExpiry(time.Millisecond))
+
+		var expired []string
+		auth.OnExpire(func(ctx context.Context, session *knocknock.Session) {
+			expired = append(expired, session.Subject)
+		})
+
+		auth.CreateSession(ctx, "user", knocknock.WithSubject("alice"))
+		time.Sleep(5 * time.Millisecond)
+		store.Cleanup()
+
+		if !slices.Equal(expired, []string{"alice"}) {
+			t.Errorf("Expected Cleanup to report expired session, got %v", expired)
+		}
+	})
+
+	t.Run("Close unregisters from store", func(t *testing.T) {
+		store := knocknock.HandleMemoryStore()
+		auth := knocknock.HandleAuth(store, knocknock.WithDefaultExpiry(time.Millisecond))
+		closed := knocknock.HandleAuth(store, knocknock.WithDefaultExpiry(time.Millisecond))
+
+		var expired, leaked int
+		auth.OnExpire(func(ctx context.Context, session *knocknock.Session) { expired++ })
+		closed.OnExpire(func(ctx context.Context, session *knocknock.Session) { leaked++ })
+		if err := closed.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+		closed.Close()
+
+		auth.CreateSession(ctx, "user")
+		time.Sleep(5 * time.Millisecond)
+		store.Cleanup()
+
+		if expired != 1 || leaked != 0 {
+			t.Errorf("Expected only the open Auth to see expiration, got %d and %d", expired, leaked)
+		}
+	})
+
+	t.Run("Refresh", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore())
+		pair, _ := auth.CreateSessionPair(ctx, "user")
+		kinds := record(auth)
+
+		var refreshed *knocknock.Session
+		auth.OnRefresh(func(ctx context.Context, session *knocknock.Session) {
+			refreshed = session
+		})
+
+		rotated, err := auth.Refresh(ctx, pair.Refresh.Token)
+		if err != nil {
+			t.Fatalf("Refresh failed: %v", err)
+		}
+		if refreshed == nil || refreshed.Token != rotated.Access.Token {
+			t.Error("OnRefresh should receive the new session")
+		}
+
+		expected := []knocknock.EventKind{knocknock.EventCreate, knocknock.EventRefresh}
+		if !slices.Equal(*kinds, expected) {
+			t.Errorf("Expected events %v, got %v", expected, *kinds)
+		}
+	})
+
+	t.Run("Signed tokens", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithJWT(knocknock.HS256Key([]byte("0123456789abcdef0123456789abcdef"))))
+		kinds := record(auth)
+
+		session, _ := auth.CreateSession(ctx, "user")
+		auth.GetSession(ctx, session.Token)
+		auth.DeleteSession(ctx, session.Token)
+		auth.DeleteSession(ctx, session.Token)
+
+		expected := []knocknock.EventKind{knocknock.EventCreate, knocknock.EventAccess, knocknock.EventDelete}
+		if !slices.Equal(*kinds, expected) {
+			t.Errorf("Expected events %v, got %v", expected, *kinds)
+		}
+	})
+
+	t.Run("Subscribe", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore())
+		events, unsubscribe := auth.Subscribe(1)
+
+		session, _ := auth.CreateSession(ctx, "user")
+		auth.GetSession(ctx, session.Token) // Буфер полон: событие отбрасывается, Auth не блокируется
+
+		event := <-events
+		if event.Kind != knocknock.EventCreate || event.Session.Token != session.Token || event.Time.IsZero() {
+			t.Errorf("Unexpected event %+v", event)
+		}
+
+		unsubscribe()
+		unsubscribe()
+		if _, open := <-events; open {
+			t.Error("Channel should be closed after unsubscribe")
+		}
+		auth.GetSession(ctx, session.Token)
+	})
+}
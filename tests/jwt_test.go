@@ -0,0 +1,186 @@
+package tests
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tolstovrob/knocknock"
+)
+
+func TestJWT(t *testing.T) {
+	ctx := context.Background()
+
+	edPublic, edPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	ecPrivate, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	keys := map[string]knocknock.JWTKey{
+		"HS256": knocknock.HS256Key([]byte("secret-0123456789abcdef0123456789")),
+		"EdDSA": knocknock.EdDSAKey(edPrivate),
+		"ES256": knocknock.ES256Key(ecPrivate),
+	}
+
+	for alg, key := range keys {
+		t.Run(alg+" round trip", func(t *testing.T) {
+			store := &countingStore{Store: knocknock.HandleMemoryStore()}
+			auth := knocknock.HandleAuth(store, knocknock.WithJWT(key))
+
+			session, err := auth.CreateSession(ctx, "test-user", knocknock.WithSubject("alice"))
+			if err != nil {
+				t.Fatalf("CreateSession failed: %v", err)
+			}
+			if strings.Count(session.Token, ".") != 2 {
+				t.Fatalf("Expected JWT, got %s", session.Token)
+			}
+
+			header, _ := base64.RawURLEncoding.DecodeString(strings.Split(session.Token, ".")[0])
+			if !strings.Contains(string(header), `"alg":"`+alg+`"`) {
+				t.Errorf("Expected alg %s in header %s", alg, header)
+			}
+
+			retrieved, err := auth.GetSession(ctx, session.Token)
+			if err != nil {
+				t.Fatalf("GetSession failed: %v", err)
+			}
+			if retrieved.UserData != "test-user" || retrieved.Subject != "alice" {
+				t.Errorf("Claims did not round trip: %+v", retrieved)
+			}
+			if !retrieved.CreatedAt.Equal(session.CreatedAt) || !retrieved.ExpiresAt.Equal(session.ExpiresAt) {
+				t.Errorf("Expected times %v/%v, got %v/%v", session.CreatedAt, session.ExpiresAt, retrieved.CreatedAt, retrieved.ExpiresAt)
+			}
+			if store.gets != 1 {
+				t.Errorf("Expected only a denylist lookup, got %d store reads", store.gets)
+			}
+		})
+	}
+
+	t.Run("Tampered token", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithJWT(keys["EdDSA"]))
+		session, _ := auth.CreateSession(ctx, "test-user")
+
+		parts := strings.Split(session.Token, ".")
+		forged := base64.RawURLEncoding.EncodeToString([]byte(`{"jti":"x","iat":0,"exp":9999999999,"data":"admin"}`))
+		none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+
+		for _, token := range []string{parts[0] + "." + forged + "." + parts[2], none + "." + parts[1] + ".", "a.b.c"} {
+			if _, err := auth.GetSession(ctx, token); !errors.Is(err, knocknock.InvalidTokenError) {
+				t.Errorf("Expected InvalidTokenError for %s, got %v", token, err)
+			}
+		}
+	})
+
+	t.Run("Verification-only key", func(t *testing.T) {
+		issuer := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithJWT(keys["ES256"]))
+		verifier := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithJWT(knocknock.ES256PublicKey(&ecPrivate.PublicKey)))
+
+		session, _ := issuer.CreateSession(ctx, "test-user")
+		if _, err := verifier.GetSession(ctx, session.Token); err != nil {
+			t.Errorf("Public key should verify: %v", err)
+		}
+		if _, err := verifier.CreateSession(ctx, "test-user"); !errors.Is(err, knocknock.JWTSigningUnsupportedError) {
+			t.Errorf("Expected JWTSigningUnsupportedError, got %v", err)
+		}
+
+		other := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithJWT(knocknock.EdDSAPublicKey(edPublic)))
+		if _, err := other.GetSession(ctx, session.Token); !errors.Is(err, knocknock.InvalidTokenError) {
+			t.Errorf("Expected InvalidTokenError for foreign algorithm, got %v", err)
+		}
+	})
+
+	t.Run("Short HS256 secret", func(t *testing.T) {
+		short := knocknock.WithJWT(knocknock.HS256Key([]byte("secret")))
+		if _, err := knocknock.HandleCheckedAuth(knocknock.HandleMemoryStore(), short); !errors.Is(err, knocknock.WeakJWTKeyError) {
+			t.Errorf("Expected WeakJWTKeyError, got %v", err)
+		}
+
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithLogger(slog.New(slog.DiscardHandler)))
+		if err := auth.UpdateCheckedAuthOptions(short); !errors.Is(err, knocknock.WeakJWTKeyError) {
+			t.Errorf("Expected WeakJWTKeyError from UpdateCheckedAuthOptions, got %v", err)
+		}
+		if auth.AuthOptions.JWTKey != nil {
+			t.Error("Rejected key should not be applied")
+		}
+	})
+
+	t.Run("Revocation", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithJWT(keys["HS256"]))
+		session, _ := auth.CreateSession(ctx, "test-user")
+
+		if err := auth.DeleteSession(ctx, session.Token); err != nil {
+			t.Fatalf("DeleteSession failed: %v", err)
+		}
+		if err := auth.DeleteSession(ctx, session.Token); err != nil {
+			t.Errorf("Repeated DeleteSession failed: %v", err)
+		}
+		if _, err := auth.GetSession(ctx, session.Token); !errors.Is(err, knocknock.SessionNotFoundError) {
+			t.Errorf("Expected SessionNotFoundError for revoked token, got %v", err)
+		}
+
+		// Запись списка отозванных не должна находиться по токену клиента, иначе её можно удалить через Logout
+		var claims struct {
+			ID string `json:"jti"`
+		}
+		raw, _ := base64.RawURLEncoding.DecodeString(strings.Split(session.Token, ".")[1])
+		json.Unmarshal(raw, &claims)
+		req := httptest.NewRequest("POST", "/logout", nil)
+		req.Header.Set("Authorization", "Bearer revoked:"+claims.ID)
+		auth.Logout(httptest.NewRecorder(), req)
+		if err := auth.DeleteSession(ctx, "revoked:"+claims.ID); err != nil {
+			t.Errorf("DeleteSession with reserved key failed: %v", err)
+		}
+		if _, err := auth.GetSession(ctx, session.Token); !errors.Is(err, knocknock.SessionNotFoundError) {
+			t.Errorf("Revoked token became valid again: %v", err)
+		}
+	})
+
+	t.Run("Expired token", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithJWT(keys["HS256"]), knocknock.WithDefaultExpiry(-time.Hour))
+		session, _ := auth.CreateSession(ctx, "test-user")
+
+		var expired int
+		auth.OnExpire(func(ctx context.Context, session *knocknock.Session) { expired++ })
+		events, cancel := auth.Subscribe(4)
+		defer cancel()
+
+		// Удалить подписанный токен нельзя, поэтому повторы не должны порождать событий
+		for range 3 {
+			if _, err := auth.GetSession(ctx, session.Token); !errors.Is(err, knocknock.SessionExpiredError) {
+				t.Errorf("Expected SessionExpiredError, got %v", err)
+			}
+		}
+		if expired != 0 {
+			t.Errorf("Expected no expire hooks for signed tokens, got %d", expired)
+		}
+		select {
+		case event := <-events:
+			t.Errorf("Expected no events for signed tokens, got %v", event.Kind)
+		default:
+		}
+	})
+
+	t.Run("Refresh issues signed access tokens", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithJWT(keys["HS256"]))
+		pair, err := auth.CreateSessionPair(ctx, "test-user")
+		if err != nil {
+			t.Fatalf("CreateSessionPair failed: %v", err)
+		}
+
+		rotated, err := auth.Refresh(ctx, pair.Refresh.Token)
+		if err != nil {
+			t.Fatalf("Refresh failed: %v", err)
+		}
+		if _, err := auth.GetSession(ctx, rotated.Access.Token); err != nil {
+			t.Errorf("New access token should authorize: %v", err)
+		}
+	})
+}
@@ -0,0 +1,235 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tolstovrob/knocknock"
+)
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+
+	// Возвращает текст эндпоинта метрик
+	scrape := func(t *testing.T, metrics *knocknock.Metrics) string {
+		rr := httptest.NewRecorder()
+		metrics.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+		if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+			t.Errorf("Unexpected content type %q", ct)
+		}
+		return rr.Body.String()
+	}
+
+	expectLines := func(t *testing.T, out string, lines ...string) {
+		for _, line := range lines {
+			if !strings.Contains(out, line+"\n") {
+				t.Errorf("Expected line %q in:\n%s", line, out)
+			}
+		}
+	}
+
+	t.Run("Auth and store", func(t *testing.T) {
+		metrics := knocknock.HandleMetrics()
+		store := knocknock.InstrumentStore(knocknock.HandleMemoryStore(), metrics)
+		auth := knocknock.HandleAuth(store, knocknock.WithMetrics(metrics), knocknock.WithIdleTimeout(time.Hour), knocknock.WithTouchInterval(0))
+		short := knocknock.HandleAuth(store, knocknock.WithMetrics(metrics), knocknock.WithDefaultExpiry(time.Millisecond))
+
+		session, _ := auth.CreateSession(ctx, "user", knocknock.WithSubject("alice"))
+		short.CreateSession(ctx, "user", knocknock.WithSubject("alice"))
+		time.Sleep(5 * time.Millisecond)
+
+		auth.GetSession(ctx, session.Token)
+		auth.GetSession(ctx, "unknown")
+		sessions, _ := auth.ListSessions(ctx, "alice")
+		if len(sessions) != 1 {
+			t.Fatalf("Wrapped store should keep SubjectIndexer, got %d sessions", len(sessions))
+		}
+
+		out := scrape(t, metrics)
+		expectLines(t, out,
+			"# TYPE knocknock_sessions_created_total counter",
+			"knocknock_sessions_created_total 2",
+			`knocknock_session_lookups_total{outcome="hit"} 1`,
+			`knocknock_session_lookups_total{outcome="miss"} 1`,
+			`knocknock_session_lookups_total{outcome="expired"} 0`,
+			"# TYPE knocknock_store_operation_duration_seconds histogram",
+			`knocknock_store_operation_duration_seconds_count{store="MemoryStore",method="Save"} 2`,
+			`knocknock_store_operation_duration_seconds_bucket{store="MemoryStore",method="Save",le="+Inf"} 2`,
+			`knocknock_store_operation_duration_seconds_count{store="MemoryStore",method="Update"} 1`,
+			`knocknock_store_operation_duration_seconds_count{store="MemoryStore",method="ListBySubject"} 1`,
+			"# TYPE knocknock_active_sessions gauge",
+			`knocknock_active_sessions{store="MemoryStore"} 1`,
+		)
+		if strings.Contains(out, "knocknock_store_errors_total{") {
+			t.Errorf("Not found should not count as store error:\n%s", out)
+		}
+	})
+
+	t.Run("Rejections", func(t *testing.T) {
+		metrics := knocknock.HandleMetrics(knocknock.WithMetricsNamespace("app"))
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithMetrics(metrics))
+		session, _ := auth.CreateSession(ctx, "user")
+		handler := auth.Middleware()(auth.Authorize(knocknock.AnyRole("admin"))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+		for _, token := range []string{"", "unknown", session.Token} {
+			req := httptest.NewRequest("GET", "/", nil)
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		expectLines(t, scrape(t, metrics),
+			`app_middleware_rejections_total{middleware="require",reason="forbidden"} 1`,
+			`app_middleware_rejections_total{middleware="require",reason="missing"} 1`,
+			`app_middleware_rejections_total{middleware="require",reason="not_found"} 1`,
+			`app_middleware_rejections_total{middleware="session",reason="not_found"} 1`,
+		)
+	})
+
+	t.Run("Store errors", func(t *testing.T) {
+		metrics := knocknock.HandleMetrics(knocknock.WithMetricsBuckets(0.5, 1))
+		store := knocknock.InstrumentStore(failingStore{knocknock.HandleMemoryStore()}, metrics)
+		auth := knocknock.HandleAuth(store, knocknock.WithMetrics(metrics))
+
+		session, _ := auth.CreateSession(ctx, "user")
+		if _, err := auth.GetSession(ctx, session.Token); err == nil {
+			t.Fatal("Expected store error")
+		}
+		// Перевыпуск ходит в хранилище, но обращением к сессии не считается
+		if _, err := auth.RegenerateSession(ctx, session.Token); err == nil {
+			t.Fatal("Expected store error")
+		}
+
+		out := scrape(t, metrics)
+		expectLines(t, out,
+			`knocknock_session_lookups_total{outcome="error"} 1`,
+			`knocknock_store_errors_total{store="failingStore",method="Get"} 2`,
+			`knocknock_store_operation_duration_seconds_bucket{store="failingStore",method="Get",le="0.5"} 2`,
+		)
+		if strings.Contains(out, "active_sessions") {
+			t.Error("Store without SessionCounter should not export active sessions")
+		}
+	})
+
+	t.Run("Unsorted buckets", func(t *testing.T) {
+		metrics := knocknock.HandleMetrics(knocknock.WithMetricsBuckets(1, 0.5, 1, math.Inf(1)))
+		store := knocknock.InstrumentStore(knocknock.HandleMemoryStore(), metrics)
+		store.Get(ctx, "missing")
+
+		out := scrape(t, metrics)
+		expectLines(t, out,
+			`knocknock_store_operation_duration_seconds_bucket{store="MemoryStore",method="Get",le="0.5"} 1`,
+			`knocknock_store_operation_duration_seconds_bucket{store="MemoryStore",method="Get",le="1"} 1`,
+		)
+		if n := strings.Count(out, `le="1"`); n != 1 {
+			t.Errorf("Expected deduplicated buckets, got %d series for le=\"1\"", n)
+		}
+		if n := strings.Count(out, `le="+Inf"`); n != 1 {
+			t.Errorf("Expected a single +Inf bucket, got %d", n)
+		}
+	})
+
+	t.Run("Nil metrics", func(t *testing.T) {
+		var metrics *knocknock.Metrics
+		if out := scrape(t, metrics); out != "" {
+			t.Errorf("Expected empty output, got %q", out)
+		}
+	})
+
+	t.Run("Regenerations", func(t *testing.T) {
+		metrics := knocknock.HandleMetrics()
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithMetrics(metrics))
+
+		session, _ := auth.CreateSession(ctx, "user")
+		if _, err := auth.RegenerateSession(ctx, session.Token); err != nil {
+			t.Fatalf("RegenerateSession failed: %v", err)
+		}
+
+		expectLines(t, scrape(t, metrics),
+			"knocknock_sessions_created_total 1",
+			"# TYPE knocknock_sessions_regenerated_total counter",
+			"knocknock_sessions_regenerated_total 1",
+		)
+	})
+
+	t.Run("Active sessions by store", func(t *testing.T) {
+		metrics := knocknock.HandleMetrics()
+		memory := knocknock.HandleMemoryStore()
+		first := knocknock.HandleAuth(knocknock.InstrumentStore(memory, metrics))
+		// То же хранилище, обёрнутое ещё раз, не должно считаться дважды
+		knocknock.InstrumentStore(knocknock.InstrumentStore(memory, metrics), metrics)
+		second := knocknock.HandleAuth(knocknock.InstrumentStore(knocknock.HandleMemoryStore(), metrics))
+
+		first.CreateSession(ctx, "user")
+		second.CreateSession(ctx, "user")
+		second.CreateSession(ctx, "user")
+
+		out := scrape(t, metrics)
+		expectLines(t, out, `knocknock_active_sessions{store="MemoryStore"} 3`)
+		if n := strings.Count(out, "knocknock_active_sessions{"); n != 1 {
+			t.Errorf("Expected one active_sessions series, got %d:\n%s", n, out)
+		}
+	})
+
+	t.Run("Slow scrape does not block", func(t *testing.T) {
+		// Вывод больше любого буфера записи, чтобы клиент застрял посреди него
+		buckets := make([]float64, 1000)
+		for i := range buckets {
+			buckets[i] = float64(i+1) / 1000
+		}
+		metrics := knocknock.HandleMetrics(knocknock.WithMetricsBuckets(buckets...))
+		auth := knocknock.HandleAuth(knocknock.InstrumentStore(knocknock.HandleMemoryStore(), metrics), knocknock.WithMetrics(metrics))
+		auth.CreateSession(ctx, "user")
+
+		release := make(chan struct{})
+		writing := make(chan struct{})
+		go metrics.ServeHTTP(&stalledWriter{ResponseRecorder: httptest.NewRecorder(), writing: writing, release: release}, httptest.NewRequest("GET", "/metrics", nil))
+		defer close(release)
+		<-writing
+
+		done := make(chan struct{})
+		go func() {
+			auth.CreateSession(ctx, "user")
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Error("CreateSession blocked while the metrics client was stalled")
+		}
+	})
+
+	t.Run("Wrapper keeps capabilities", func(t *testing.T) {
+		store := knocknock.InstrumentStore(&countingStore{Store: knocknock.HandleMemoryStore()}, knocknock.HandleMetrics())
+		if _, err := store.(knocknock.SubjectIndexer).ListBySubject(ctx, "alice"); !errors.Is(err, knocknock.StoreUnsupportedError) {
+			t.Errorf("Expected StoreUnsupportedError, got %v", err)
+		}
+
+		// Без Updater у исходного хранилища Auth перезаписывает сессию через Delete и Save
+		auth := knocknock.HandleAuth(store, knocknock.WithIdleTimeout(time.Hour), knocknock.WithTouchInterval(0))
+		session, _ := auth.CreateSession(ctx, "user")
+		if _, err := auth.GetSession(ctx, session.Token); err != nil {
+			t.Errorf("GetSession failed: %v", err)
+		}
+	})
+}
+
+// Клиент эндпоинта метрик, который не читает ответ, пока его не отпустят
+type stalledWriter struct {
+	*httptest.ResponseRecorder
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (w *stalledWriter) Write(data []byte) (int, error) {
+	close(w.writing)
+	<-w.release
+	return w.ResponseRecorder.Write(data)
+}
@@ -2,9 +2,12 @@ package tests
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/tolstovrob/knocknock"
 )
@@ -147,3 +150,131 @@ func TestMiddleware(t *testing.T) {
 		}
 	})
 }
+
+func TestRequireAuth(t *testing.T) {
+	auth := knocknock.HandleAuth(knocknock.HandleMemoryStore())
+	ctx := context.Background()
+
+	handler := auth.RequireAuth(knocknock.WithRealm("api"))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if knocknock.GetSession(r.Context()) == nil {
+			t.Error("RequireAuth should put session into context")
+		}
+	}))
+
+	t.Run("Valid token", func(t *testing.T) {
+		session, _ := auth.CreateSession(ctx, "test-user")
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+session.Token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("Expected 200, got %d", rr.Code)
+		}
+	})
+
+	t.Run("Missing token", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401, got %d", rr.Code)
+		}
+		if challenge := rr.Header().Get("WWW-Authenticate"); challenge != `Bearer realm="api"` {
+			t.Errorf("Expected challenge without error code, got %q", challenge)
+		}
+	})
+
+	t.Run("Expired token", func(t *testing.T) {
+		auth.UpdateAuthOptions(knocknock.WithDefaultExpiry(-time.Hour))
+		session, _ := auth.CreateSession(ctx, "test-user")
+		auth.UpdateAuthOptions(knocknock.WithDefaultExpiry(24 * time.Hour))
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+session.Token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		expected := `Bearer realm="api", error="invalid_token", error_description="The access token expired"`
+		if challenge := rr.Header().Get("WWW-Authenticate"); challenge != expected {
+			t.Errorf("Expected %q, got %q", expected, challenge)
+		}
+	})
+
+	t.Run("Expired token behind Middleware", func(t *testing.T) {
+		store := &countingStore{Store: knocknock.HandleMemoryStore()}
+		metrics := knocknock.HandleMetrics()
+		auth := knocknock.HandleAuth(store, knocknock.WithDefaultExpiry(-time.Hour), knocknock.WithMetrics(metrics))
+		session, _ := auth.CreateSession(ctx, "test-user")
+		chain := auth.Middleware()(auth.RequireAuth()(http.NotFoundHandler()))
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+session.Token)
+		rr := httptest.NewRecorder()
+		chain.ServeHTTP(rr, req)
+
+		if challenge := rr.Header().Get("WWW-Authenticate"); !strings.Contains(challenge, "The access token expired") {
+			t.Errorf("Expected expired challenge, got %q", challenge)
+		}
+		if store.gets != 1 {
+			t.Errorf("Expected one store lookup, got %d", store.gets)
+		}
+		scrape := httptest.NewRecorder()
+		metrics.ServeHTTP(scrape, httptest.NewRequest("GET", "/metrics", nil))
+		if !strings.Contains(scrape.Body.String(), `knocknock_session_lookups_total{outcome="expired"} 1`+"\n") {
+			t.Errorf("Expected a single expired lookup:\n%s", scrape.Body.String())
+		}
+	})
+
+	t.Run("Unknown token", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer unknown")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if challenge := rr.Header().Get("WWW-Authenticate"); !strings.Contains(challenge, `error="invalid_token"`) {
+			t.Errorf("Expected invalid_token challenge, got %q", challenge)
+		}
+	})
+
+	t.Run("Custom handler", func(t *testing.T) {
+		var cause error
+		custom := auth.RequireAuth(knocknock.WithUnauthorizedHandler(func(w http.ResponseWriter, r *http.Request, err error) {
+			cause = err
+			w.WriteHeader(http.StatusTeapot)
+		}))(http.NotFoundHandler())
+
+		rr := httptest.NewRecorder()
+		custom.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+
+		if rr.Code != http.StatusTeapot || !errors.Is(cause, knocknock.TokenMissingError) {
+			t.Errorf("Expected custom handler with TokenMissingError, got %d and %v", rr.Code, cause)
+		}
+	})
+
+	t.Run("Login redirect", func(t *testing.T) {
+		redirecting := auth.RequireAuth(knocknock.WithLoginRedirect("/login"))(http.NotFoundHandler())
+
+		req := httptest.NewRequest("GET", "/account?tab=1", nil)
+		req.Header.Set("Accept", "text/html,application/xhtml+xml")
+		rr := httptest.NewRecorder()
+		redirecting.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusSeeOther {
+			t.Errorf("Expected 303, got %d", rr.Code)
+		}
+		if location := rr.Header().Get("Location"); location != "/login?next=%2Faccount%3Ftab%3D1" {
+			t.Errorf("Unexpected redirect location %q", location)
+		}
+
+		req = httptest.NewRequest("GET", "/account", nil)
+		req.Header.Set("Accept", "application/json")
+		rr = httptest.NewRecorder()
+		redirecting.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("API requests should get 401, got %d", rr.Code)
+		}
+	})
+}
@@ -0,0 +1,116 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tolstovrob/knocknock"
+)
+
+func TestPolicyRouter(t *testing.T) {
+	ctx := context.Background()
+	auth := knocknock.HandleAuth(knocknock.HandleMemoryStore())
+
+	admin, _ := auth.CreateSession(ctx, "admin", knocknock.WithSubject("root"), knocknock.WithRoles("admin"))
+	writer, _ := auth.CreateSession(ctx, "writer", knocknock.WithSubject("bob"), knocknock.WithScopes("orders:write"))
+
+	policies := []knocknock.Policy{
+		{Pattern: "GET /admin/", Rule: knocknock.AllRoles("admin")},
+		{Pattern: "POST /orders", Rule: knocknock.AllScopes("orders:write")},
+		{Pattern: "/orders/", Public: true},
+		{Pattern: "/profile"},
+	}
+
+	serve := func(router *knocknock.PolicyRouter, method, path string, session *knocknock.Session) int {
+		req := httptest.NewRequest(method, path, nil)
+		if session != nil {
+			req.Header.Set("Authorization", "Bearer "+session.Token)
+		}
+		rr := httptest.NewRecorder()
+		auth.Middleware()(router.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))).ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	t.Run("Enforce", func(t *testing.T) {
+		router, err := auth.PolicyRouter(policies)
+		if err != nil {
+			t.Fatalf("PolicyRouter failed: %v", err)
+		}
+
+		cases := []struct {
+			method, path string
+			session      *knocknock.Session
+			code         int
+		}{
+			{"GET", "/admin/users", admin, http.StatusOK},
+			{"GET", "/admin/users", writer, http.StatusForbidden},
+			{"GET", "/admin/users", nil, http.StatusUnauthorized},
+			{"POST", "/orders", writer, http.StatusOK},
+			{"POST", "/orders", admin, http.StatusForbidden},
+			{"GET", "/orders/42", nil, http.StatusOK},
+			{"GET", "/profile", nil, http.StatusUnauthorized},
+			{"GET", "/profile", writer, http.StatusOK},
+			{"GET", "/unlisted", nil, http.StatusOK},
+			// Неочищенные пути и путь без завершающего "/" не должны обходить правило
+			{"GET", "/admin//users", nil, http.StatusUnauthorized},
+			{"GET", "/x/../admin/users", nil, http.StatusUnauthorized},
+			{"GET", "/admin/./users", writer, http.StatusForbidden},
+			{"GET", "/admin", nil, http.StatusUnauthorized},
+			{"GET", "/admin//users", admin, http.StatusOK},
+		}
+		for _, c := range cases {
+			if code := serve(router, c.method, c.path, c.session); code != c.code {
+				t.Errorf("%s %s: expected %d, got %d", c.method, c.path, c.code, code)
+			}
+		}
+	})
+
+	t.Run("Dry run", func(t *testing.T) {
+		var logs bytes.Buffer
+		router, _ := auth.PolicyRouter(policies,
+			knocknock.WithPolicyDryRun(),
+			knocknock.WithPolicyLogger(slog.New(slog.NewTextHandler(&logs, nil))),
+		)
+
+		if code := serve(router, "GET", "/admin/users", writer); code != http.StatusOK {
+			t.Errorf("Dry run should not deny, got %d", code)
+		}
+		if code := serve(router, "GET", "/admin/users", admin); code != http.StatusOK {
+			t.Errorf("Expected 200, got %d", code)
+		}
+
+		output := logs.String()
+		if strings.Count(output, "would deny") != 1 {
+			t.Fatalf("Expected one report, got %q", output)
+		}
+		for _, expected := range []string{`pattern="GET /admin/"`, "subject=bob", "path=/admin/users"} {
+			if !strings.Contains(output, expected) {
+				t.Errorf("Report should contain %s: %q", expected, output)
+			}
+		}
+
+		// Без своего лога отчёты идут в лог Auth
+		var authLogs bytes.Buffer
+		router, _ = auth.PolicyRouter(policies, knocknock.WithPolicyDryRun())
+		auth.UpdateAuthOptions(knocknock.WithLogger(slog.New(slog.NewTextHandler(&authLogs, nil))))
+		defer auth.UpdateAuthOptions(knocknock.WithLogger(nil))
+		serve(router, "GET", "/admin/users", writer)
+		if strings.Count(authLogs.String(), "would deny") != 1 {
+			t.Errorf("Expected report in Auth logger, got %q", authLogs.String())
+		}
+	})
+
+	t.Run("Conflicting patterns", func(t *testing.T) {
+		if _, err := auth.PolicyRouter([]knocknock.Policy{{Pattern: "/a"}, {Pattern: "/a"}}); err == nil {
+			t.Error("Expected error for duplicate pattern")
+		}
+		if _, err := auth.PolicyRouter([]knocknock.Policy{{Pattern: "GET /{bad"}}); err == nil {
+			t.Error("Expected error for invalid pattern")
+		}
+	})
+}
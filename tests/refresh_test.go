@@ -0,0 +1,257 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tolstovrob/knocknock"
+)
+
+// Хранилище, которое задерживает ответ первых parties вызовов Get, пока их не наберётся parties. Так одновременные
+// запросы гарантированно прочитают сессию до того, как любой из них её изменит
+type barrierStore struct {
+	*knocknock.MemoryStore
+	parties int32
+	arrived atomic.Int32
+	ready   chan struct{}
+}
+
+func (s *barrierStore) Get(ctx context.Context, token string) (*knocknock.Session, error) {
+	session, err := s.MemoryStore.Get(ctx, token)
+	if n := s.arrived.Add(1); n <= s.parties {
+		if n == s.parties {
+			close(s.ready)
+		}
+		<-s.ready
+	}
+	return session, err
+}
+
+func TestRefresh(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("CreateSessionPair", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(),
+			knocknock.WithAccessExpiry(5*time.Minute),
+			knocknock.WithRefreshExpiry(time.Hour),
+		)
+
+		pair, err := auth.CreateSessionPair(ctx, "test-user")
+		if err != nil {
+			t.Fatalf("CreateSessionPair failed: %v", err)
+		}
+
+		if pair.Access.Token == pair.Refresh.Token {
+			t.Error("Access and refresh tokens should differ")
+		}
+		if expected := pair.Access.CreatedAt.Add(5 * time.Minute); !pair.Access.ExpiresAt.Equal(expected) {
+			t.Errorf("Expected access expiry %v, got %v", expected, pair.Access.ExpiresAt)
+		}
+		if expected := pair.Refresh.CreatedAt.Add(time.Hour); !pair.Refresh.ExpiresAt.Equal(expected) {
+			t.Errorf("Expected refresh expiry %v, got %v", expected, pair.Refresh.ExpiresAt)
+		}
+
+		if _, err := auth.GetSession(ctx, pair.Access.Token); err != nil {
+			t.Errorf("Access token should authorize: %v", err)
+		}
+		if _, err := auth.GetSession(ctx, pair.Refresh.Token); err == nil {
+			t.Error("Refresh token should not authorize requests")
+		}
+	})
+
+	t.Run("Refresh rotates both tokens", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore())
+		pair, _ := auth.CreateSessionPair(ctx, "test-user")
+
+		rotated, err := auth.Refresh(ctx, pair.Refresh.Token)
+		if err != nil {
+			t.Fatalf("Refresh failed: %v", err)
+		}
+
+		if rotated.Access.Token == pair.Access.Token || rotated.Refresh.Token == pair.Refresh.Token {
+			t.Error("Refresh should issue new tokens")
+		}
+		if rotated.Access.UserData != "test-user" {
+			t.Errorf("Expected userData to carry over, got %v", rotated.Access.UserData)
+		}
+
+		if _, err := auth.GetSession(ctx, pair.Access.Token); err == nil {
+			t.Error("Old access token should be revoked after refresh")
+		}
+		if _, err := auth.GetSession(ctx, rotated.Access.Token); err != nil {
+			t.Errorf("New access token should authorize: %v", err)
+		}
+	})
+
+	t.Run("Reuse revokes the family", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore())
+		pair, _ := auth.CreateSessionPair(ctx, "test-user")
+
+		second, _ := auth.Refresh(ctx, pair.Refresh.Token)
+		third, _ := auth.Refresh(ctx, second.Refresh.Token)
+
+		if _, err := auth.Refresh(ctx, pair.Refresh.Token); !errors.Is(err, knocknock.RefreshTokenReusedError) {
+			t.Fatalf("Expected RefreshTokenReusedError, got %v", err)
+		}
+
+		if _, err := auth.GetSession(ctx, third.Access.Token); err == nil {
+			t.Error("Latest access token should be revoked after reuse")
+		}
+		if _, err := auth.Refresh(ctx, third.Refresh.Token); err == nil {
+			t.Error("Latest refresh token should be revoked after reuse")
+		}
+	})
+
+	t.Run("Concurrent refresh", func(t *testing.T) {
+		const workers = 16
+		store := &barrierStore{MemoryStore: knocknock.HandleMemoryStore(), parties: workers, ready: make(chan struct{})}
+		auth := knocknock.HandleAuth(store)
+		pair, _ := auth.CreateSessionPair(ctx, "test-user")
+
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		pairs := make([]*knocknock.SessionPair, workers)
+		errs := make([]error, workers)
+		for i := range workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				pairs[i], errs[i] = auth.Refresh(ctx, pair.Refresh.Token)
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		// Запросы, пришедшие после отзыва семейства, токена уже не находят
+		succeeded, reused := 0, 0
+		for i, err := range errs {
+			if err == nil {
+				succeeded++
+				if _, err := auth.GetSession(ctx, pairs[i].Access.Token); err == nil {
+					t.Error("Access token from a raced refresh should be revoked")
+				}
+				if _, err := auth.Refresh(ctx, pairs[i].Refresh.Token); err == nil {
+					t.Error("Refresh token from a raced refresh should be revoked")
+				}
+			} else if errors.Is(err, knocknock.RefreshTokenReusedError) {
+				reused++
+			} else if !errors.Is(err, knocknock.SessionNotFoundError) {
+				t.Errorf("Expected RefreshTokenReusedError, got %v", err)
+			}
+		}
+		if succeeded > 1 || reused == 0 {
+			t.Errorf("Expected at most one refresh to succeed and reuse to be detected, got %d and %d", succeeded, reused)
+		}
+	})
+
+	t.Run("Refresh with access token", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore())
+		pair, _ := auth.CreateSessionPair(ctx, "test-user")
+
+		if _, err := auth.Refresh(ctx, pair.Access.Token); !errors.Is(err, knocknock.InvalidRefreshTokenError) {
+			t.Errorf("Expected InvalidRefreshTokenError, got %v", err)
+		}
+	})
+
+	t.Run("Refresh expired", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithRefreshExpiry(-time.Hour))
+		pair, _ := auth.CreateSessionPair(ctx, "test-user")
+
+		if _, err := auth.Refresh(ctx, pair.Refresh.Token); !errors.Is(err, knocknock.SessionExpiredError) {
+			t.Errorf("Expected SessionExpiredError, got %v", err)
+		}
+	})
+
+	t.Run("DeleteSession with refresh token", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore())
+		pair, _ := auth.CreateSessionPair(ctx, "test-user")
+
+		if err := auth.DeleteSession(ctx, pair.Refresh.Token); err != nil {
+			t.Fatalf("DeleteSession failed: %v", err)
+		}
+
+		if _, err := auth.GetSession(ctx, pair.Access.Token); err == nil {
+			t.Error("Paired access token should be revoked together with refresh token")
+		}
+	})
+
+	t.Run("Logout revokes refresh", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore())
+		pair, _ := auth.CreateSessionPair(ctx, "test-user")
+
+		req := httptest.NewRequest("POST", "/logout", nil)
+		req.Header.Set("Authorization", "Bearer "+pair.Access.Token)
+		if err := auth.Logout(httptest.NewRecorder(), req); err != nil {
+			t.Fatalf("Logout failed: %v", err)
+		}
+		if _, err := auth.Refresh(ctx, pair.Refresh.Token); !errors.Is(err, knocknock.SessionNotFoundError) {
+			t.Errorf("Refresh token should be revoked on logout, got %v", err)
+		}
+
+		// Истёкшая сессия пары не уносит с собой refresh-токен: ради него пара и нужна
+		expiring := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithAccessExpiry(-time.Minute))
+		pair, _ = expiring.CreateSessionPair(ctx, "test-user")
+		if _, err := expiring.GetSession(ctx, pair.Access.Token); !errors.Is(err, knocknock.SessionExpiredError) {
+			t.Fatalf("Expected SessionExpiredError, got %v", err)
+		}
+		if _, err := expiring.Refresh(ctx, pair.Refresh.Token); err != nil {
+			t.Errorf("Refresh after access expiry failed: %v", err)
+		}
+	})
+
+	t.Run("Idle timeout keeps access sessions short", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(),
+			knocknock.WithAccessExpiry(time.Minute),
+			knocknock.WithIdleTimeout(24*time.Hour),
+		)
+		pair, _ := auth.CreateSessionPair(ctx, "test-user")
+
+		session, err := auth.GetSession(ctx, pair.Access.Token)
+		if err != nil {
+			t.Fatalf("GetSession failed: %v", err)
+		}
+		if limit := pair.Access.CreatedAt.Add(time.Minute); session.ExpiresAt.After(limit) {
+			t.Errorf("Sliding should not extend access session past %v, got %v", limit, session.ExpiresAt)
+		}
+
+		// Обычная сессия по-прежнему продлевается
+		plain, _ := auth.CreateSession(ctx, "test-user")
+		if session, _ := auth.GetSession(ctx, plain.Token); session.ExpiresAt.Before(time.Now().Add(23 * time.Hour)) {
+			t.Errorf("Expected plain session to slide by idle timeout, got %v", session.ExpiresAt)
+		}
+	})
+
+	t.Run("Refresh after regeneration", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithTokenHashing([]byte("secret")))
+		pair, _ := auth.CreateSessionPair(ctx, "test-user")
+
+		regenerated, err := auth.RegenerateSession(ctx, pair.Access.Token)
+		if err != nil {
+			t.Fatalf("RegenerateSession failed: %v", err)
+		}
+		if _, err := auth.Refresh(ctx, pair.Refresh.Token); err != nil {
+			t.Fatalf("Refresh failed: %v", err)
+		}
+		if _, err := auth.GetSession(ctx, regenerated.Token); !errors.Is(err, knocknock.SessionNotFoundError) {
+			t.Errorf("Refresh should revoke the regenerated session, got %v", err)
+		}
+	})
+
+	t.Run("Cookie store", func(t *testing.T) {
+		store, _ := knocknock.HandleCookieStore([]byte("0123456789abcdef0123456789abcdef"))
+		auth := knocknock.HandleAuth(store)
+
+		if _, err := auth.CreateSessionPair(ctx, "test-user"); !errors.Is(err, knocknock.StoreUnsupportedError) {
+			t.Errorf("Expected StoreUnsupportedError from CreateSessionPair, got %v", err)
+		}
+		if _, err := auth.Refresh(ctx, "token"); !errors.Is(err, knocknock.StoreUnsupportedError) {
+			t.Errorf("Expected StoreUnsupportedError from Refresh, got %v", err)
+		}
+	})
+}
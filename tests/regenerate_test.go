@@ -0,0 +1,194 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/tolstovrob/knocknock"
+)
+
+func TestRegenerateSession(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Keeps data and revokes old token", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithTokenHashing([]byte("secret")))
+		old, _ := auth.CreateSession(ctx, "user", knocknock.WithSubject("alice"), knocknock.WithRoles("viewer"))
+
+		session, err := auth.RegenerateSession(ctx, old.Token, knocknock.WithRoles("viewer", "admin"))
+		if err != nil {
+			t.Fatalf("RegenerateSession failed: %v", err)
+		}
+		if session.Token == old.Token {
+			t.Fatal("Expected new token")
+		}
+		if session.UserData != "user" || session.Subject != "alice" || !session.ExpiresAt.Equal(old.ExpiresAt) {
+			t.Errorf("Expected session data to be kept, got %+v", session)
+		}
+		if !slices.Equal(session.Roles, []string{"viewer", "admin"}) {
+			t.Errorf("Expected options to apply, got roles %v", session.Roles)
+		}
+
+		if _, err := auth.GetSession(ctx, old.Token); !errors.Is(err, knocknock.SessionNotFoundError) {
+			t.Errorf("Old token should be invalid, got %v", err)
+		}
+		if _, err := auth.GetSession(ctx, session.Token); err != nil {
+			t.Errorf("New token should be valid, got %v", err)
+		}
+
+		if _, err := auth.RegenerateSession(ctx, old.Token); !errors.Is(err, knocknock.SessionNotFoundError) {
+			t.Errorf("Second regeneration of the same token should fail, got %v", err)
+		}
+	})
+
+	t.Run("Store without Replacer", func(t *testing.T) {
+		store := &countingStore{Store: knocknock.HandleMemoryStore()}
+		auth := knocknock.HandleAuth(store)
+		old, _ := auth.CreateSession(ctx, "user")
+
+		session, err := auth.RegenerateSession(ctx, old.Token)
+		if err != nil {
+			t.Fatalf("RegenerateSession failed: %v", err)
+		}
+		if _, err := auth.GetSession(ctx, old.Token); !errors.Is(err, knocknock.SessionNotFoundError) {
+			t.Errorf("Old token should be invalid, got %v", err)
+		}
+		if _, err := auth.GetSession(ctx, session.Token); err != nil {
+			t.Errorf("New token should be valid, got %v", err)
+		}
+	})
+
+	t.Run("Signed tokens", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithJWT(knocknock.HS256Key([]byte("0123456789abcdef0123456789abcdef"))))
+		old, _ := auth.CreateSession(ctx, "user", knocknock.WithSubject("alice"))
+
+		session, err := auth.RegenerateSession(ctx, old.Token)
+		if err != nil {
+			t.Fatalf("RegenerateSession failed: %v", err)
+		}
+		if session.Subject != "alice" {
+			t.Errorf("Expected subject to be kept, got %q", session.Subject)
+		}
+		if _, err := auth.GetSession(ctx, old.Token); err == nil {
+			t.Error("Old token should be revoked")
+		}
+		if _, err := auth.RegenerateSession(ctx, old.Token); err == nil {
+			t.Error("Revoked token should not regenerate")
+		}
+	})
+
+	t.Run("Regenerate rewrites cookie", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore())
+		old, _ := auth.CreateSession(ctx, "user")
+
+		var regenerated, seen *knocknock.Session
+		handler := auth.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			previous := knocknock.GetSession(r.Context())
+			session, next, err := auth.Regenerate(w, r)
+			if err != nil {
+				t.Fatalf("Regenerate failed: %v", err)
+			}
+			if previous != nil && previous.Token == session.Token {
+				t.Error("Session in the original request should stay untouched")
+			}
+			regenerated, seen = session, knocknock.GetSession(next.Context())
+		}))
+
+		req := httptest.NewRequest("POST", "/sudo", nil)
+		req.AddCookie(&http.Cookie{Name: "session_token", Value: old.Token})
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		cookies := rr.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Value != regenerated.Token {
+			t.Errorf("Expected cookie with new token, got %v", cookies)
+		}
+		if seen.Token != regenerated.Token {
+			t.Error("Session in returned request should carry the new token")
+		}
+
+		// Токен из заголовка cookie не трогает
+		fresh, _ := auth.CreateSession(ctx, "user")
+		req = httptest.NewRequest("POST", "/sudo", nil)
+		req.Header.Set("Authorization", "Bearer "+fresh.Token)
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if len(rr.Result().Cookies()) != 0 {
+			t.Error("Header-authenticated request should not get a cookie")
+		}
+	})
+
+	t.Run("Keeps creation time", func(t *testing.T) {
+		cookieStore, _ := knocknock.HandleCookieStore([]byte("0123456789abcdef0123456789abcdef"))
+		modes := map[string]*knocknock.Auth{
+			"store":  knocknock.HandleAuth(knocknock.HandleMemoryStore()),
+			"jwt":    knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithJWT(knocknock.HS256Key([]byte("0123456789abcdef0123456789abcdef")))),
+			"cookie": knocknock.HandleAuth(cookieStore),
+		}
+		olds := map[string]*knocknock.Session{}
+		for name, auth := range modes {
+			olds[name], _ = auth.CreateSession(ctx, "user")
+		}
+		// Подписанный токен хранит время с точностью до секунды
+		time.Sleep(1100 * time.Millisecond)
+
+		for name, auth := range modes {
+			session, err := auth.RegenerateSession(ctx, olds[name].Token)
+			if err != nil {
+				t.Fatalf("%s: RegenerateSession failed: %v", name, err)
+			}
+			if !session.CreatedAt.Equal(olds[name].CreatedAt) {
+				t.Errorf("%s: expected creation time %v, got %v", name, olds[name].CreatedAt, session.CreatedAt)
+			}
+		}
+	})
+
+	t.Run("Not an access", func(t *testing.T) {
+		store := &countingStore{Store: knocknock.HandleMemoryStore()}
+		auth := knocknock.HandleAuth(store, knocknock.WithIdleTimeout(time.Hour), knocknock.WithTouchInterval(0))
+		old, _ := auth.CreateSession(ctx, "user")
+
+		var accessed int
+		auth.OnAccess(func(ctx context.Context, session *knocknock.Session) { accessed++ })
+		store.gets = 0
+		session, err := auth.RegenerateSession(ctx, old.Token)
+		if err != nil {
+			t.Fatalf("RegenerateSession failed: %v", err)
+		}
+		if accessed != 0 || store.gets != 1 {
+			t.Errorf("Expected one lookup without access event, got %d accesses and %d gets", accessed, store.gets)
+		}
+		if !session.ExpiresAt.Equal(old.ExpiresAt) {
+			t.Errorf("Regeneration should not extend expiry: %v, was %v", session.ExpiresAt, old.ExpiresAt)
+		}
+	})
+
+	t.Run("Middleware keeps regenerated sealed cookie", func(t *testing.T) {
+		oldKey := []byte("0123456789abcdef0123456789abcdef")
+		oldStore, _ := knocknock.HandleCookieStore(oldKey)
+		old, _ := knocknock.HandleAuth(oldStore).CreateSession(ctx, "user")
+
+		// Старая cookie запечатана прежним ключом: без Regenerate Middleware перезапечатал бы её
+		store, _ := knocknock.HandleCookieStore([]byte("fedcba9876543210fedcba9876543210"), knocknock.WithCookiePreviousKeys(oldKey))
+		auth := knocknock.HandleAuth(store)
+		var regenerated *knocknock.Session
+		handler := auth.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			regenerated, _, _ = auth.Regenerate(w, r)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+		req := httptest.NewRequest("POST", "/sudo", nil)
+		req.AddCookie(&http.Cookie{Name: "session_token", Value: old.Token})
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		cookies := rr.Result().Cookies()
+		if regenerated == nil || len(cookies) != 1 || cookies[0].Value != regenerated.Token {
+			t.Errorf("Expected only the regenerated cookie, got %v", cookies)
+		}
+	})
+}
@@ -0,0 +1,160 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/tolstovrob/knocknock"
+)
+
+func TestTokenSources(t *testing.T) {
+	ctx := context.Background()
+
+	// Возвращает данные сессии, найденной Middleware, или пустую строку
+	authorized := func(auth *knocknock.Auth, req *http.Request) string {
+		var userData string
+		handler := auth.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if session := knocknock.GetSession(r.Context()); session != nil {
+				userData = session.UserData.(string)
+			}
+		}))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		return userData
+	}
+
+	t.Run("Disable query", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithTokenSources(
+			knocknock.HeaderSource("Authorization"),
+			knocknock.CookieSource("session_token"),
+		))
+		session, _ := auth.CreateSession(ctx, "user")
+
+		if got := authorized(auth, httptest.NewRequest("GET", "/?token="+session.Token, nil)); got != "" {
+			t.Error("Query token should be ignored")
+		}
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: "session_token", Value: session.Token})
+		if got := authorized(auth, req); got != "user" {
+			t.Error("Cookie token should authorize")
+		}
+	})
+
+	t.Run("Order", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithTokenSources(
+			knocknock.CookieSource("session_token"),
+			knocknock.HeaderSource("Authorization"),
+		))
+		fromCookie, _ := auth.CreateSession(ctx, "cookie")
+		fromHeader, _ := auth.CreateSession(ctx, "header")
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+fromHeader.Token)
+		req.AddCookie(&http.Cookie{Name: "session_token", Value: fromCookie.Token})
+		if got := authorized(auth, req); got != "cookie" {
+			t.Errorf("Expected cookie to take precedence, got %q", got)
+		}
+	})
+
+	t.Run("Form and custom", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithTokenSources(
+			knocknock.FormSource("access_token"),
+			knocknock.TokenSourceFunc(func(r *http.Request) string {
+				return r.Header.Get("X-Api-Key")
+			}),
+		))
+		session, _ := auth.CreateSession(ctx, "user")
+
+		form := url.Values{"access_token": {session.Token}}
+		req := httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if got := authorized(auth, req); got != "user" {
+			t.Error("Form token should authorize")
+		}
+
+		req = httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Api-Key", session.Token)
+		if got := authorized(auth, req); got != "user" {
+			t.Error("Custom source should authorize")
+		}
+
+		// Другие тела не читаются: загрузка файла дойдёт до обработчика целой
+		body := "access_token=" + session.Token
+		req = httptest.NewRequest("POST", "/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "text/plain")
+		if got := authorized(auth, req); got != "" {
+			t.Error("Token from non-form body should not authorize")
+		}
+		if rest, _ := io.ReadAll(req.Body); string(rest) != body {
+			t.Errorf("Non-form body should stay unread, got %q", rest)
+		}
+
+		form.Set("padding", strings.Repeat("x", 1<<20))
+		req = httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if got := authorized(auth, req); got != "" {
+			t.Error("Oversized form should not authorize")
+		}
+
+		// Большая форма доходит до обработчика целой, а не пустой после неудачного разбора
+		var padding string
+		handler := auth.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			padding = r.PostFormValue("padding")
+		}))
+		req = httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if len(padding) != 1<<20 {
+			t.Errorf("Handler should see fields of a form over 64 KiB, got %d bytes", len(padding))
+		}
+
+		// Тело без Content-Length тоже не читается
+		req = httptest.NewRequest("POST", "/", io.NopCloser(strings.NewReader(form.Encode())))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.ContentLength = -1
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if len(padding) != 1<<20 {
+			t.Errorf("Handler should see fields of a form of unknown length, got %d bytes", len(padding))
+		}
+	})
+
+	t.Run("Strict", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithStrictTokenSources())
+		first, _ := auth.CreateSession(ctx, "first")
+		second, _ := auth.CreateSession(ctx, "second")
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+first.Token)
+		req.AddCookie(&http.Cookie{Name: "session_token", Value: first.Token})
+		if got := authorized(auth, req); got != "first" {
+			t.Error("Matching tokens from several sources should authorize")
+		}
+
+		req = httptest.NewRequest("GET", "/?token="+second.Token, nil)
+		req.Header.Set("Authorization", "Bearer "+first.Token)
+		if got := authorized(auth, req); got != "" {
+			t.Error("Conflicting tokens should not authorize")
+		}
+
+		var reason error
+		rr := httptest.NewRecorder()
+		auth.RequireAuth()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Header().Get("WWW-Authenticate"), `error="invalid_request"`) {
+			t.Errorf("Expected 400 with invalid_request, got %d %q", rr.Code, rr.Header().Get("WWW-Authenticate"))
+		}
+
+		handler := auth.RequireAuth(knocknock.WithUnauthorizedHandler(func(w http.ResponseWriter, r *http.Request, err error) {
+			reason = err
+		}))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if !errors.Is(reason, knocknock.TokenConflictError) {
+			t.Errorf("Expected TokenConflictError, got %v", reason)
+		}
+	})
+}
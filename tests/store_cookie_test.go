@@ -0,0 +1,184 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tolstovrob/knocknock"
+)
+
+// Переносит cookie из ответа в новый запрос
+func requestWithCookies(cookies []*http.Cookie) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range cookies {
+		if cookie.Value != "" {
+			req.AddCookie(cookie)
+		}
+	}
+	return req
+}
+
+func TestCookieStore(t *testing.T) {
+	ctx := context.Background()
+	oldKey := []byte("0123456789abcdef0123456789abcdef")
+	newKey := []byte("fedcba9876543210fedcba9876543210")
+
+	t.Run("Seal and open", func(t *testing.T) {
+		store, err := knocknock.HandleCookieStore(oldKey)
+		if err != nil {
+			t.Fatalf("HandleCookieStore failed: %v", err)
+		}
+		auth := knocknock.HandleAuth(store)
+
+		session, err := auth.CreateSession(ctx, "test-user", knocknock.WithSubject("alice"))
+		if err != nil {
+			t.Fatalf("CreateSession failed: %v", err)
+		}
+		if strings.Contains(session.Token, "test-user") {
+			t.Error("Session data should be encrypted")
+		}
+
+		retrieved, err := auth.GetSession(ctx, session.Token)
+		if err != nil {
+			t.Fatalf("GetSession failed: %v", err)
+		}
+		if retrieved.UserData != "test-user" || retrieved.Subject != "alice" {
+			t.Errorf("Session did not round trip: %+v", retrieved)
+		}
+
+		tampered := []byte(session.Token)
+		tampered[len(tampered)-5] ^= 1
+		if _, err := auth.GetSession(ctx, string(tampered)); !errors.Is(err, knocknock.SessionNotFoundError) {
+			t.Errorf("Expected SessionNotFoundError for tampered token, got %v", err)
+		}
+	})
+
+	t.Run("Invalid key", func(t *testing.T) {
+		if _, err := knocknock.HandleCookieStore([]byte("short")); err == nil {
+			t.Error("Expected error for invalid key size")
+		}
+	})
+
+	t.Run("Key rotation reseals", func(t *testing.T) {
+		oldStore, _ := knocknock.HandleCookieStore(oldKey)
+		session, _ := knocknock.HandleAuth(oldStore).CreateSession(ctx, "test-user")
+
+		newStore, _ := knocknock.HandleCookieStore(newKey, knocknock.WithCookiePreviousKeys(oldKey))
+		auth := knocknock.HandleAuth(newStore)
+		handler := auth.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if knocknock.GetSession(r.Context()) == nil {
+				t.Error("Session under previous key should authorize")
+			}
+		}))
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: "session_token", Value: session.Token})
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		cookies := rr.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("Expected resealed cookie, got %v", cookies)
+		}
+		if _, err := knocknock.HandleAuth(oldStore).GetSession(ctx, cookies[0].Value); err == nil {
+			t.Error("Resealed cookie should use the new key")
+		}
+		if _, err := auth.GetSession(ctx, cookies[0].Value); err != nil {
+			t.Errorf("Resealed cookie should open: %v", err)
+		}
+	})
+
+	t.Run("Modified session is resealed", func(t *testing.T) {
+		store, _ := knocknock.HandleCookieStore(oldKey)
+		auth := knocknock.HandleAuth(store)
+		session, _ := auth.CreateSession(ctx, "test-user")
+
+		handler := auth.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/modify" {
+				knocknock.GetSession(r.Context()).UserData = "changed"
+			}
+			w.Write([]byte("ok"))
+		}))
+
+		for path, expected := range map[string]string{"/": "", "/modify": "changed"} {
+			req := httptest.NewRequest("GET", path, nil)
+			req.AddCookie(&http.Cookie{Name: "session_token", Value: session.Token})
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			cookies := rr.Result().Cookies()
+			if expected == "" {
+				if len(cookies) != 0 {
+					t.Errorf("Unmodified session should not be resealed, got %v", cookies)
+				}
+				continue
+			}
+
+			if len(cookies) != 1 {
+				t.Fatalf("Expected resealed cookie, got %v", cookies)
+			}
+			resealed, _ := auth.GetSession(ctx, cookies[0].Value)
+			if resealed == nil || resealed.UserData != expected {
+				t.Errorf("Expected resealed userData %q, got %+v", expected, resealed)
+			}
+		}
+	})
+
+	t.Run("Chunked cookies", func(t *testing.T) {
+		store, _ := knocknock.HandleCookieStore(oldKey)
+		auth := knocknock.HandleAuth(store)
+		session, _ := auth.CreateSession(ctx, strings.Repeat("x", 10000))
+
+		rr := httptest.NewRecorder()
+		if err := auth.SetSessionCookie(rr, httptest.NewRequest("GET", "/", nil), session); err != nil {
+			t.Fatalf("SetSessionCookie failed: %v", err)
+		}
+
+		cookies := rr.Result().Cookies()
+		if len(cookies) < 3 {
+			t.Fatalf("Expected token split across cookies, got %d", len(cookies))
+		}
+		for _, cookie := range cookies {
+			if len(cookie.String()) > 4096 {
+				t.Errorf("Cookie %s exceeds 4KB", cookie.Name)
+			}
+		}
+
+		var authorized bool
+		handler := auth.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authorized = knocknock.GetSession(r.Context()) != nil
+		}))
+		handler.ServeHTTP(httptest.NewRecorder(), requestWithCookies(cookies))
+		if !authorized {
+			t.Error("Chunked cookie should authorize")
+		}
+
+		small, _ := auth.CreateSession(ctx, "test-user")
+		rr = httptest.NewRecorder()
+		auth.SetSessionCookie(rr, requestWithCookies(cookies), small)
+		expired := 0
+		for _, cookie := range rr.Result().Cookies() {
+			if cookie.Value == "" {
+				expired++
+			}
+		}
+		if expired != len(cookies)-1 {
+			t.Errorf("Expected %d stale chunks to be removed, got %d", len(cookies)-1, expired)
+		}
+	})
+
+	t.Run("Too large", func(t *testing.T) {
+		store, _ := knocknock.HandleCookieStore(oldKey, knocknock.WithCookieMaxChunks(1))
+		auth := knocknock.HandleAuth(store)
+		session, _ := auth.CreateSession(ctx, strings.Repeat("x", 10000))
+
+		err := auth.SetSessionCookie(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), session)
+		if !errors.Is(err, knocknock.CookieTooLargeError) {
+			t.Errorf("Expected CookieTooLargeError, got %v", err)
+		}
+	})
+}
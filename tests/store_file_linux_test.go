@@ -0,0 +1,72 @@
+//go:build linux
+
+package tests
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tolstovrob/knocknock"
+)
+
+// Запись, оборванная нехваткой места, не должна оставлять обрывок строки посреди лога. Нехватку места изображает
+// предел размера файла RLIMIT_FSIZE: write пишет сколько помещается и возвращает EFBIG
+func TestFileStoreFailedWrite(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "sessions.log")
+
+	store, err := knocknock.HandleFileStore(path)
+	if err != nil {
+		t.Fatalf("HandleFileStore failed: %v", err)
+	}
+	session := func(token string, userData string) *knocknock.Session {
+		return &knocknock.Session{Token: token, UserData: userData, CreatedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}
+	}
+	if err := store.Save(ctx, session("before", "user")); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	info, _ := os.Stat(path)
+	var limit syscall.Rlimit
+	syscall.Getrlimit(syscall.RLIMIT_FSIZE, &limit)
+	signal.Ignore(syscall.SIGXFSZ)
+	defer signal.Reset(syscall.SIGXFSZ)
+	if err := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &syscall.Rlimit{Cur: uint64(info.Size()) + 64, Max: limit.Max}); err != nil {
+		t.Skipf("Cannot limit file size: %v", err)
+	}
+
+	err = store.Save(ctx, session("failed", strings.Repeat("x", 4096)))
+	syscall.Setrlimit(syscall.RLIMIT_FSIZE, &limit)
+	if err == nil {
+		t.Fatal("Expected Save to fail past the file size limit")
+	}
+	if _, err := store.Get(ctx, "failed"); err == nil {
+		t.Error("Failed save should not be applied in memory")
+	}
+
+	if err := store.Save(ctx, session("after", "user")); err != nil {
+		t.Fatalf("Save after failed write failed: %v", err)
+	}
+	store.Close()
+
+	store, err = knocknock.HandleFileStore(path)
+	if err != nil {
+		t.Fatalf("Reopen after failed write failed: %v", err)
+	}
+	defer store.Close()
+
+	for _, token := range []string{"before", "after"} {
+		if _, err := store.Get(ctx, token); err != nil {
+			t.Errorf("Session %q should survive reopen: %v", token, err)
+		}
+	}
+	if _, err := store.Get(ctx, "failed"); err == nil {
+		t.Error("Failed save should not reappear after reopen")
+	}
+}
@@ -0,0 +1,307 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tolstovrob/knocknock"
+)
+
+func TestFileStore(t *testing.T) {
+	ctx := context.Background()
+
+	session := &knocknock.Session{
+		Token:     "test-token",
+		UserData:  "test-user",
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+
+	t.Run("Save and Get", func(t *testing.T) {
+		store, err := knocknock.HandleFileStore(filepath.Join(t.TempDir(), "sessions.log"))
+		if err != nil {
+			t.Fatalf("HandleFileStore failed: %v", err)
+		}
+		defer store.Close()
+
+		if err := store.Save(ctx, session); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+
+		retrieved, err := store.Get(ctx, "test-token")
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+
+		if retrieved.Token != session.Token {
+			t.Errorf("Expected token %s, got %s", session.Token, retrieved.Token)
+		}
+	})
+
+	t.Run("Save duplicate", func(t *testing.T) {
+		store, err := knocknock.HandleFileStore(filepath.Join(t.TempDir(), "sessions.log"))
+		if err != nil {
+			t.Fatalf("HandleFileStore failed: %v", err)
+		}
+		defer store.Close()
+
+		store.Save(ctx, session)
+		if err := store.Save(ctx, session); !errors.Is(err, knocknock.SessionExistsError) {
+			t.Errorf("Expected SessionExistsError, got %v", err)
+		}
+	})
+
+	t.Run("Get non-existent", func(t *testing.T) {
+		store, err := knocknock.HandleFileStore(filepath.Join(t.TempDir(), "sessions.log"))
+		if err != nil {
+			t.Fatalf("HandleFileStore failed: %v", err)
+		}
+		defer store.Close()
+
+		if _, err := store.Get(ctx, "non-existent"); !errors.Is(err, knocknock.SessionNotFoundError) {
+			t.Errorf("Expected SessionNotFoundError, got %v", err)
+		}
+	})
+
+	t.Run("Survives reopen", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "sessions.log")
+
+		store, err := knocknock.HandleFileStore(path)
+		if err != nil {
+			t.Fatalf("HandleFileStore failed: %v", err)
+		}
+		store.Save(ctx, session)
+		store.Save(ctx, &knocknock.Session{Token: "deleted", ExpiresAt: time.Now().Add(time.Hour)})
+		store.Delete(ctx, "deleted")
+		store.Close()
+
+		store, err = knocknock.HandleFileStore(path)
+		if err != nil {
+			t.Fatalf("Reopen failed: %v", err)
+		}
+		defer store.Close()
+
+		retrieved, err := store.Get(ctx, session.Token)
+		if err != nil {
+			t.Fatalf("Get after reopen failed: %v", err)
+		}
+		if retrieved.UserData != session.UserData {
+			t.Errorf("Expected userData %v, got %v", session.UserData, retrieved.UserData)
+		}
+
+		if _, err := store.Get(ctx, "deleted"); err == nil {
+			t.Error("Deleted session should stay deleted after reopen")
+		}
+	})
+
+	t.Run("Update survives reopen", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "sessions.log")
+
+		store, _ := knocknock.HandleFileStore(path)
+		store.Save(ctx, session)
+
+		updated := *session
+		updated.ExpiresAt = time.Now().Add(2 * time.Hour)
+		if err := store.Update(ctx, &updated); err != nil {
+			t.Fatalf("Update failed: %v", err)
+		}
+		if err := store.Update(ctx, &knocknock.Session{Token: "non-existent"}); !errors.Is(err, knocknock.SessionNotFoundError) {
+			t.Errorf("Expected SessionNotFoundError, got %v", err)
+		}
+		store.Close()
+
+		store, _ = knocknock.HandleFileStore(path)
+		defer store.Close()
+
+		retrieved, _ := store.Get(ctx, session.Token)
+		if !retrieved.ExpiresAt.Equal(updated.ExpiresAt) {
+			t.Errorf("Expected ExpiresAt %v, got %v", updated.ExpiresAt, retrieved.ExpiresAt)
+		}
+	})
+
+	t.Run("Replace survives reopen", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "sessions.log")
+
+		store, _ := knocknock.HandleFileStore(path)
+		store.Save(ctx, session)
+
+		replacement := *session
+		replacement.Token = "new-token"
+		if err := store.Replace(ctx, session.Token, &replacement); err != nil {
+			t.Fatalf("Replace failed: %v", err)
+		}
+		if err := store.Replace(ctx, session.Token, &knocknock.Session{Token: "other"}); !errors.Is(err, knocknock.SessionNotFoundError) {
+			t.Errorf("Expected SessionNotFoundError, got %v", err)
+		}
+		store.Close()
+
+		store, _ = knocknock.HandleFileStore(path)
+		defer store.Close()
+
+		if _, err := store.Get(ctx, session.Token); !errors.Is(err, knocknock.SessionNotFoundError) {
+			t.Error("Old session should be removed")
+		}
+		if _, err := store.Get(ctx, replacement.Token); err != nil {
+			t.Errorf("New session should be saved, got %v", err)
+		}
+	})
+
+	t.Run("Torn replace keeps old session", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "sessions.log")
+
+		store, _ := knocknock.HandleFileStore(path)
+		store.Save(ctx, session)
+		info, _ := os.Stat(path)
+		replacement := *session
+		replacement.Token = "new-token"
+		store.Replace(ctx, session.Token, &replacement)
+		store.Close()
+
+		// Падение посреди записи замены: от неё осталась только часть
+		replaced, _ := os.Stat(path)
+		os.Truncate(path, info.Size()+(replaced.Size()-info.Size())/2)
+
+		store, err := knocknock.HandleFileStore(path)
+		if err != nil {
+			t.Fatalf("Reopen with torn replace failed: %v", err)
+		}
+		defer store.Close()
+
+		if _, err := store.Get(ctx, session.Token); err != nil {
+			t.Errorf("Old session should survive torn replace: %v", err)
+		}
+		if _, err := store.Get(ctx, replacement.Token); !errors.Is(err, knocknock.SessionNotFoundError) {
+			t.Errorf("New session should not be applied from torn replace, got %v", err)
+		}
+	})
+
+	t.Run("ListBySubject survives reopen", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "sessions.log")
+
+		store, _ := knocknock.HandleFileStore(path)
+		store.Save(ctx, &knocknock.Session{Token: "a1", Subject: "alice", ExpiresAt: time.Now().Add(time.Hour)})
+		store.Save(ctx, &knocknock.Session{Token: "a2", Subject: "alice", ExpiresAt: time.Now().Add(time.Hour)})
+		store.Delete(ctx, "a2")
+		store.Close()
+
+		store, _ = knocknock.HandleFileStore(path)
+		defer store.Close()
+
+		sessions, err := store.ListBySubject(ctx, "alice")
+		if err != nil {
+			t.Fatalf("ListBySubject failed: %v", err)
+		}
+		if len(sessions) != 1 || sessions[0].Token != "a1" {
+			t.Errorf("Expected only a1, got %v", sessions)
+		}
+	})
+
+	t.Run("Recovers from torn record", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "sessions.log")
+
+		store, _ := knocknock.HandleFileStore(path)
+		store.Save(ctx, session)
+		store.Close()
+
+		file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+		file.WriteString(`{"op":"save","session":{"token":"torn`)
+		file.Close()
+
+		store, err := knocknock.HandleFileStore(path)
+		if err != nil {
+			t.Fatalf("Reopen with torn record failed: %v", err)
+		}
+
+		if _, err := store.Get(ctx, session.Token); err != nil {
+			t.Errorf("Session before torn record should survive: %v", err)
+		}
+
+		if err := store.Save(ctx, &knocknock.Session{Token: "after", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+			t.Fatalf("Save after recovery failed: %v", err)
+		}
+		store.Close()
+
+		store, err = knocknock.HandleFileStore(path)
+		if err != nil {
+			t.Fatalf("Reopen after recovery failed: %v", err)
+		}
+		defer store.Close()
+
+		if _, err := store.Get(ctx, "after"); err != nil {
+			t.Errorf("Session written after recovery should survive: %v", err)
+		}
+	})
+
+	t.Run("Corrupted record in the middle", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "sessions.log")
+		os.WriteFile(path, []byte("garbage\n{\"op\":\"delete\",\"token\":\"x\"}\n"), 0o600)
+
+		if _, err := knocknock.HandleFileStore(path); !errors.Is(err, knocknock.FileStoreCorruptedError) {
+			t.Errorf("Expected FileStoreCorruptedError, got %v", err)
+		}
+	})
+
+	t.Run("Compact", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "sessions.log")
+
+		store, _ := knocknock.HandleFileStore(path, knocknock.WithCompactInterval(0))
+		store.Save(ctx, session)
+		store.Save(ctx, &knocknock.Session{Token: "expired", ExpiresAt: time.Now().Add(-time.Hour)})
+		for i := 0; i < 10; i++ {
+			store.Save(ctx, &knocknock.Session{Token: "tmp", ExpiresAt: time.Now().Add(time.Hour)})
+			store.Delete(ctx, "tmp")
+		}
+
+		before, _ := os.Stat(path)
+		if err := store.Compact(); err != nil {
+			t.Fatalf("Compact failed: %v", err)
+		}
+		after, _ := os.Stat(path)
+
+		if after.Size() >= before.Size() {
+			t.Errorf("Expected log to shrink, got %d -> %d bytes", before.Size(), after.Size())
+		}
+
+		if _, err := store.Get(ctx, "expired"); err == nil {
+			t.Error("Expired session should be dropped by compaction")
+		}
+
+		store.Save(ctx, &knocknock.Session{Token: "after-compact", ExpiresAt: time.Now().Add(time.Hour)})
+		store.Close()
+
+		store, err := knocknock.HandleFileStore(path)
+		if err != nil {
+			t.Fatalf("Reopen after compaction failed: %v", err)
+		}
+		defer store.Close()
+
+		for _, token := range []string{session.Token, "after-compact"} {
+			if _, err := store.Get(ctx, token); err != nil {
+				t.Errorf("Session %s should survive compaction: %v", token, err)
+			}
+		}
+	})
+
+	t.Run("Concurrent Close", func(t *testing.T) {
+		store, _ := knocknock.HandleFileStore(filepath.Join(t.TempDir(), "sessions.log"))
+
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Go(func() {
+				if err := store.Close(); err != nil {
+					t.Errorf("Close failed: %v", err)
+				}
+			})
+		}
+		wg.Wait()
+
+		if err := store.Save(ctx, session); !errors.Is(err, os.ErrClosed) {
+			t.Errorf("Expected os.ErrClosed after Close, got %v", err)
+		}
+	})
+}
@@ -2,6 +2,7 @@ package tests
 
 import (
 	"context"
+	"errors"
 	"testing"
 	"time"
 
@@ -49,6 +50,62 @@ func TestMemoryStore(t *testing.T) {
 		}
 	})
 
+	t.Run("Update", func(t *testing.T) {
+		updated := *session
+		updated.ExpiresAt = time.Now().Add(2 * time.Hour)
+
+		if err := store.Update(ctx, &updated); err != nil {
+			t.Fatalf("Update failed: %v", err)
+		}
+
+		retrieved, _ := store.Get(ctx, session.Token)
+		if !retrieved.ExpiresAt.Equal(updated.ExpiresAt) {
+			t.Errorf("Expected ExpiresAt %v, got %v", updated.ExpiresAt, retrieved.ExpiresAt)
+		}
+
+		if err := store.Update(ctx, &knocknock.Session{Token: "non-existent"}); err == nil {
+			t.Error("Expected error when updating non-existent session")
+		}
+	})
+
+	t.Run("Replace", func(t *testing.T) {
+		store := knocknock.HandleMemoryStore()
+		store.Save(ctx, &knocknock.Session{Token: "old", Subject: "alice"})
+
+		if err := store.Replace(ctx, "old", &knocknock.Session{Token: "new", Subject: "alice"}); err != nil {
+			t.Fatalf("Replace failed: %v", err)
+		}
+		if _, err := store.Get(ctx, "old"); !errors.Is(err, knocknock.SessionNotFoundError) {
+			t.Error("Old session should be removed")
+		}
+		if sessions, _ := store.ListBySubject(ctx, "alice"); len(sessions) != 1 || sessions[0].Token != "new" {
+			t.Errorf("Expected only the new session in subject index, got %v", sessions)
+		}
+
+		if err := store.Replace(ctx, "old", &knocknock.Session{Token: "other"}); !errors.Is(err, knocknock.SessionNotFoundError) {
+			t.Errorf("Expected SessionNotFoundError, got %v", err)
+		}
+		if _, err := store.Get(ctx, "other"); err == nil {
+			t.Error("Failed Replace should not save the session")
+		}
+	})
+
+	t.Run("ListBySubject", func(t *testing.T) {
+		store := knocknock.HandleMemoryStore()
+		store.Save(ctx, &knocknock.Session{Token: "a1", Subject: "alice"})
+		store.Save(ctx, &knocknock.Session{Token: "a2", Subject: "alice"})
+		store.Save(ctx, &knocknock.Session{Token: "b1", Subject: "bob"})
+		store.Delete(ctx, "a2")
+
+		sessions, err := store.ListBySubject(ctx, "alice")
+		if err != nil {
+			t.Fatalf("ListBySubject failed: %v", err)
+		}
+		if len(sessions) != 1 || sessions[0].Token != "a1" {
+			t.Errorf("Expected only a1, got %v", sessions)
+		}
+	})
+
 	t.Run("Delete", func(t *testing.T) {
 		err := store.Delete(ctx, "test-token")
 		if err != nil {
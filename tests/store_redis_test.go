@@ -0,0 +1,538 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tolstovrob/knocknock"
+)
+
+/*
+ * Встроенный фейковый сервер Redis. Понимает подмножество команд, которые шлёт RedisStore, и отвечает в RESP2 или
+ * RESP3 в зависимости от того, прислал ли клиент HELLO 3
+ */
+
+type fakeRedis struct {
+	mu       sync.Mutex
+	listener net.Listener
+	strings  map[string]string
+	expires  map[string]time.Time
+	sets     map[string]map[string]bool
+	delay    time.Duration
+	noHello  bool
+	commands []string
+}
+
+func startFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	srv := &fakeRedis{
+		listener: listener,
+		strings:  make(map[string]string),
+		expires:  make(map[string]time.Time),
+		sets:     make(map[string]map[string]bool),
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(conn)
+		}
+	}()
+	return srv
+}
+
+func (s *fakeRedis) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	resp3 := false
+	var queued [][]string // Команды внутри MULTI
+	inMulti := false
+
+	for {
+		args, err := readFakeRedisCommand(r)
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		delay := s.delay
+		s.commands = append(s.commands, strings.ToUpper(args[0]))
+		s.mu.Unlock()
+		time.Sleep(delay)
+
+		var reply any
+		switch command := strings.ToUpper(args[0]); {
+		case command == "MULTI":
+			inMulti, queued = true, nil
+			reply = fakeRedisStatus("OK")
+		case command == "EXEC":
+			replies := make([]any, len(queued))
+			s.mu.Lock()
+			for i, queuedArgs := range queued {
+				replies[i] = s.execLocked(queuedArgs)
+			}
+			s.mu.Unlock()
+			inMulti, reply = false, replies
+		case inMulti:
+			queued = append(queued, args)
+			reply = fakeRedisStatus("QUEUED")
+		default:
+			reply = s.exec(args)
+		}
+		if _, failed := reply.(fakeRedisError); strings.EqualFold(args[0], "HELLO") && !failed {
+			resp3 = args[1] == "3"
+		}
+
+		writeFakeRedisReply(w, reply, resp3)
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func readFakeRedisCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+type fakeRedisStatus string
+type fakeRedisError string
+
+func writeFakeRedisReply(w *bufio.Writer, reply any, resp3 bool) {
+	switch v := reply.(type) {
+	case nil:
+		if resp3 {
+			w.WriteString("_\r\n")
+		} else {
+			w.WriteString("$-1\r\n")
+		}
+	case fakeRedisStatus:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case fakeRedisError:
+		fmt.Fprintf(w, "-%s\r\n", v)
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case []string:
+		if resp3 {
+			fmt.Fprintf(w, "~%d\r\n", len(v))
+		} else {
+			fmt.Fprintf(w, "*%d\r\n", len(v))
+		}
+		for _, item := range v {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(item), item)
+		}
+	case []any:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeFakeRedisReply(w, item, resp3)
+		}
+	case map[string]string:
+		if resp3 {
+			fmt.Fprintf(w, "%%%d\r\n", len(v))
+		} else {
+			fmt.Fprintf(w, "*%d\r\n", 2*len(v))
+		}
+		for key, value := range v {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n$%d\r\n%s\r\n", len(key), key, len(value), value)
+		}
+	}
+}
+
+func (s *fakeRedis) alive(key string) bool {
+	if expiresAt, ok := s.expires[key]; ok && !time.Now().Before(expiresAt) {
+		delete(s.strings, key)
+		delete(s.expires, key)
+		return false
+	}
+	_, ok := s.strings[key]
+	return ok
+}
+
+func (s *fakeRedis) exec(args []string) any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.execLocked(args)
+}
+
+func (s *fakeRedis) execLocked(args []string) any {
+	switch strings.ToUpper(args[0]) {
+	case "HELLO":
+		if s.noHello {
+			return fakeRedisError("ERR unknown command 'HELLO'")
+		}
+		return map[string]string{"server": "fake", "proto": args[1]}
+	case "PING":
+		return fakeRedisStatus("PONG")
+	case "SET":
+		key, value := args[1], args[2]
+		var expiresAt time.Time
+		nx, xx := false, false
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				nx = true
+			case "XX":
+				xx = true
+			case "PXAT":
+				ms, _ := strconv.ParseInt(args[i+1], 10, 64)
+				expiresAt = time.UnixMilli(ms)
+				i++
+			}
+		}
+		exists := s.alive(key)
+		if (nx && exists) || (xx && !exists) {
+			return nil
+		}
+		s.strings[key] = value
+		if expiresAt.IsZero() {
+			delete(s.expires, key)
+		} else {
+			s.expires[key] = expiresAt
+		}
+		return fakeRedisStatus("OK")
+	case "GET":
+		if !s.alive(args[1]) {
+			return nil
+		}
+		return s.strings[args[1]]
+	case "GETDEL":
+		if !s.alive(args[1]) {
+			return nil
+		}
+		value := s.strings[args[1]]
+		delete(s.strings, args[1])
+		delete(s.expires, args[1])
+		return value
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			if s.alive(key) || s.sets[key] != nil {
+				deleted++
+			}
+			delete(s.strings, key)
+			delete(s.expires, key)
+			delete(s.sets, key)
+		}
+		return deleted
+	case "SADD":
+		if s.sets[args[1]] == nil {
+			s.sets[args[1]] = make(map[string]bool)
+		}
+		added := 0
+		for _, member := range args[2:] {
+			if !s.sets[args[1]][member] {
+				s.sets[args[1]][member] = true
+				added++
+			}
+		}
+		return added
+	case "SREM":
+		removed := 0
+		for _, member := range args[2:] {
+			if s.sets[args[1]][member] {
+				delete(s.sets[args[1]], member)
+				removed++
+			}
+		}
+		return removed
+	case "PEXPIREAT":
+		if s.sets[args[1]] == nil && !s.alive(args[1]) {
+			return 0
+		}
+		ms, _ := strconv.ParseInt(args[2], 10, 64)
+		expiresAt := time.UnixMilli(ms)
+		current, volatile := s.expires[args[1]]
+		if len(args) > 3 {
+			switch strings.ToUpper(args[3]) {
+			case "NX":
+				if volatile {
+					return 0
+				}
+			case "GT":
+				if !volatile || !expiresAt.After(current) {
+					return 0
+				}
+			}
+		}
+		s.expires[args[1]] = expiresAt
+		return 1
+	case "SMEMBERS":
+		members := []string{}
+		for member := range s.sets[args[1]] {
+			members = append(members, member)
+		}
+		return members
+	}
+
+	return fakeRedisError("ERR unknown command '" + args[0] + "'")
+}
+
+func TestRedisStore(t *testing.T) {
+	ctx := context.Background()
+
+	session := &knocknock.Session{
+		Token:     "test-token",
+		UserData:  "test-user",
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+
+	t.Run("Save and Get", func(t *testing.T) {
+		srv := startFakeRedis(t)
+		store := knocknock.HandleRedisStore(srv.addr())
+		defer store.Close()
+
+		if err := store.Save(ctx, session); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+
+		retrieved, err := store.Get(ctx, session.Token)
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+
+		if retrieved.Token != session.Token {
+			t.Errorf("Expected token %s, got %s", session.Token, retrieved.Token)
+		}
+		if retrieved.UserData != session.UserData {
+			t.Errorf("Expected userData %v, got %v", session.UserData, retrieved.UserData)
+		}
+	})
+
+	t.Run("Save duplicate", func(t *testing.T) {
+		srv := startFakeRedis(t)
+		store := knocknock.HandleRedisStore(srv.addr())
+		defer store.Close()
+
+		store.Save(ctx, session)
+		if err := store.Save(ctx, session); !errors.Is(err, knocknock.SessionExistsError) {
+			t.Errorf("Expected SessionExistsError, got %v", err)
+		}
+	})
+
+	t.Run("Get non-existent", func(t *testing.T) {
+		srv := startFakeRedis(t)
+		store := knocknock.HandleRedisStore(srv.addr())
+		defer store.Close()
+
+		if _, err := store.Get(ctx, "non-existent"); !errors.Is(err, knocknock.SessionNotFoundError) {
+			t.Errorf("Expected SessionNotFoundError, got %v", err)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		srv := startFakeRedis(t)
+		store := knocknock.HandleRedisStore(srv.addr())
+		defer store.Close()
+
+		store.Save(ctx, session)
+		if err := store.Delete(ctx, session.Token); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+
+		if _, err := store.Get(ctx, session.Token); err == nil {
+			t.Error("Session should be deleted")
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		srv := startFakeRedis(t)
+		store := knocknock.HandleRedisStore(srv.addr())
+		defer store.Close()
+
+		store.Save(ctx, session)
+		updated := *session
+		updated.ExpiresAt = time.Now().Add(2 * time.Hour).Truncate(time.Millisecond)
+
+		if err := store.Update(ctx, &updated); err != nil {
+			t.Fatalf("Update failed: %v", err)
+		}
+
+		retrieved, _ := store.Get(ctx, session.Token)
+		if !retrieved.ExpiresAt.Equal(updated.ExpiresAt) {
+			t.Errorf("Expected ExpiresAt %v, got %v", updated.ExpiresAt, retrieved.ExpiresAt)
+		}
+
+		if err := store.Update(ctx, &knocknock.Session{Token: "non-existent"}); !errors.Is(err, knocknock.SessionNotFoundError) {
+			t.Errorf("Expected SessionNotFoundError, got %v", err)
+		}
+	})
+
+	t.Run("Replace", func(t *testing.T) {
+		srv := startFakeRedis(t)
+		store := knocknock.HandleRedisStore(srv.addr())
+		defer store.Close()
+
+		store.Save(ctx, session)
+		replacement := *session
+		replacement.Token = "new-token"
+
+		if err := store.Replace(ctx, session.Token, &replacement); err != nil {
+			t.Fatalf("Replace failed: %v", err)
+		}
+		if _, err := store.Get(ctx, session.Token); !errors.Is(err, knocknock.SessionNotFoundError) {
+			t.Error("Old session should be removed")
+		}
+		if _, err := store.Get(ctx, replacement.Token); err != nil {
+			t.Errorf("New session should be saved, got %v", err)
+		}
+
+		if err := store.Replace(ctx, session.Token, &knocknock.Session{Token: "other"}); !errors.Is(err, knocknock.SessionNotFoundError) {
+			t.Errorf("Expected SessionNotFoundError, got %v", err)
+		}
+	})
+
+	t.Run("ListBySubject", func(t *testing.T) {
+		srv := startFakeRedis(t)
+		store := knocknock.HandleRedisStore(srv.addr())
+		defer store.Close()
+
+		store.Save(ctx, &knocknock.Session{Token: "a1", Subject: "alice", ExpiresAt: time.Now().Add(time.Hour)})
+		store.Save(ctx, &knocknock.Session{Token: "a2", Subject: "alice", ExpiresAt: time.Now().Add(time.Hour)})
+		store.Delete(ctx, "a2")
+
+		sessions, err := store.ListBySubject(ctx, "alice")
+		if err != nil {
+			t.Fatalf("ListBySubject failed: %v", err)
+		}
+		if len(sessions) != 1 || sessions[0].Token != "a1" {
+			t.Errorf("Expected only a1, got %v", sessions)
+		}
+
+		srv.mu.Lock()
+		_, stale := srv.sets["knocknock:subject:alice"]["a2"]
+		srv.mu.Unlock()
+		if stale {
+			t.Error("Deleted token should be pruned from subject index")
+		}
+	})
+
+	t.Run("Subject index cleanup", func(t *testing.T) {
+		srv := startFakeRedis(t)
+		store := knocknock.HandleRedisStore(srv.addr())
+		defer store.Close()
+
+		later := time.Now().Add(2 * time.Hour).Truncate(time.Millisecond)
+		store.Save(ctx, &knocknock.Session{Token: "b1", Subject: "bob", ExpiresAt: later})
+		store.Save(ctx, &knocknock.Session{Token: "b2", Subject: "bob", ExpiresAt: time.Now().Add(time.Hour)})
+		store.Save(ctx, &knocknock.Session{Token: "b3", Subject: "bob", ExpiresAt: time.Now().Add(time.Hour)})
+
+		// Множество чистится без ListBySubject
+		store.Delete(ctx, "b2")
+		if err := store.Replace(ctx, "b3", &knocknock.Session{Token: "b4", Subject: "bob", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+			t.Fatalf("Replace failed: %v", err)
+		}
+
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		members := srv.sets["knocknock:subject:bob"]
+		if len(members) != 2 || !members["b1"] || !members["b4"] {
+			t.Errorf("Expected b1 and b4 in subject index, got %v", members)
+		}
+		if expiresAt := srv.expires["knocknock:subject:bob"]; !expiresAt.Equal(later) {
+			t.Errorf("Subject index should expire with the latest session at %v, got %v", later, expiresAt)
+		}
+	})
+
+	t.Run("TTL follows ExpiresAt", func(t *testing.T) {
+		srv := startFakeRedis(t)
+		store := knocknock.HandleRedisStore(srv.addr())
+		defer store.Close()
+
+		store.Save(ctx, &knocknock.Session{Token: "short", ExpiresAt: time.Now().Add(50 * time.Millisecond)})
+		time.Sleep(100 * time.Millisecond)
+
+		if _, err := store.Get(ctx, "short"); !errors.Is(err, knocknock.SessionNotFoundError) {
+			t.Errorf("Expected session to expire via TTL, got %v", err)
+		}
+	})
+
+	t.Run("RESP2 fallback", func(t *testing.T) {
+		srv := startFakeRedis(t)
+		srv.mu.Lock()
+		srv.noHello = true
+		srv.mu.Unlock()
+		store := knocknock.HandleRedisStore(srv.addr())
+		defer store.Close()
+
+		if err := store.Save(ctx, session); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+		if _, err := store.Get(ctx, "non-existent"); !errors.Is(err, knocknock.SessionNotFoundError) {
+			t.Errorf("Expected SessionNotFoundError over RESP2, got %v", err)
+		}
+	})
+
+	t.Run("Context cancellation", func(t *testing.T) {
+		srv := startFakeRedis(t)
+		store := knocknock.HandleRedisStore(srv.addr(), knocknock.WithRedisPoolSize(1))
+		defer store.Close()
+
+		store.Save(ctx, session)
+		srv.mu.Lock()
+		srv.delay = time.Second
+		srv.mu.Unlock()
+
+		timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, err := store.Get(timeoutCtx, session.Token)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("Get should return on context deadline, took %v", elapsed)
+		}
+
+		srv.mu.Lock()
+		srv.delay = 0
+		srv.mu.Unlock()
+
+		if _, err := store.Get(ctx, session.Token); err != nil {
+			t.Errorf("Pool should recover after cancelled command: %v", err)
+		}
+	})
+}
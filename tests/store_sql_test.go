@@ -0,0 +1,436 @@
+package tests
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tolstovrob/knocknock"
+)
+
+/*
+ * Минимальный database/sql драйвер, который понимает ровно те запросы, что шлёт SQLStore. Таблицы хранятся в памяти,
+ * первичным ключом считается первая колонка INSERT
+ */
+
+type fakeSQLDB struct {
+	mu         sync.Mutex
+	tables     map[string]map[any]map[string]any
+	statements []string
+}
+
+var (
+	fakeSQLInsert       = regexp.MustCompile(`^INSERT INTO (\w+) \(([^)]*)\) VALUES`)
+	fakeSQLSelectMax    = regexp.MustCompile(`^SELECT MAX\((\w+)\) FROM (\w+)$`)
+	fakeSQLSelect       = regexp.MustCompile(`^SELECT (.+) FROM (\w+) WHERE (\w+) = \?$`)
+	fakeSQLUpdate       = regexp.MustCompile(`^UPDATE (\w+) SET (.+) WHERE (\w+) = \?$`)
+	fakeSQLDelete       = regexp.MustCompile(`^DELETE FROM (\w+) WHERE (\w+) = \?$`)
+	fakeSQLDeleteBefore = regexp.MustCompile(`^DELETE FROM (\w+) WHERE token IN \(SELECT token FROM \w+ WHERE (\w+) < \? LIMIT (\d+)\)$`)
+)
+
+func openFakeSQL(t *testing.T) (*sql.DB, *fakeSQLDB) {
+	db := &fakeSQLDB{tables: make(map[string]map[any]map[string]any)}
+	sqlDB := sql.OpenDB(fakeSQLConnector{db})
+	t.Cleanup(func() { sqlDB.Close() })
+	return sqlDB, db
+}
+
+func (db *fakeSQLDB) table(name string) map[any]map[string]any {
+	if db.tables[name] == nil {
+		db.tables[name] = make(map[any]map[string]any)
+	}
+	return db.tables[name]
+}
+
+func splitColumns(list string) []string {
+	columns := strings.Split(list, ",")
+	for i := range columns {
+		columns[i] = strings.TrimSpace(columns[i])
+	}
+	return columns
+}
+
+func (db *fakeSQLDB) exec(query string, args []driver.NamedValue) (int64, [][]driver.Value, []string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	query = strings.Join(strings.Fields(query), " ")
+	db.statements = append(db.statements, query)
+
+	switch {
+	case strings.HasPrefix(query, "CREATE "), strings.HasPrefix(query, "ALTER "):
+		return 0, nil, nil, nil
+
+	case fakeSQLInsert.MatchString(query):
+		m := fakeSQLInsert.FindStringSubmatch(query)
+		table, columns := db.table(m[1]), splitColumns(m[2])
+		if _, exists := table[args[0].Value]; exists {
+			return 0, nil, nil, errors.New("UNIQUE constraint failed: " + m[1] + "." + columns[0])
+		}
+		row := make(map[string]any)
+		for i, column := range columns {
+			row[column] = args[i].Value
+		}
+		table[args[0].Value] = row
+		return 1, nil, nil, nil
+
+	case fakeSQLSelectMax.MatchString(query):
+		m := fakeSQLSelectMax.FindStringSubmatch(query)
+		var max driver.Value
+		for _, row := range db.table(m[2]) {
+			if v := row[m[1]].(int64); max == nil || v > max.(int64) {
+				max = v
+			}
+		}
+		return 0, [][]driver.Value{{max}}, []string{"max"}, nil
+
+	case fakeSQLSelect.MatchString(query):
+		m := fakeSQLSelect.FindStringSubmatch(query)
+		columns := splitColumns(m[1])
+		var rows [][]driver.Value
+		for _, row := range db.table(m[2]) {
+			if row[m[3]] != args[0].Value {
+				continue
+			}
+			values := make([]driver.Value, len(columns))
+			for i, column := range columns {
+				values[i] = row[column]
+			}
+			rows = append(rows, values)
+		}
+		return 0, rows, columns, nil
+
+	case fakeSQLUpdate.MatchString(query):
+		m := fakeSQLUpdate.FindStringSubmatch(query)
+		assignments := splitColumns(m[2])
+		var affected int64
+		for _, row := range db.table(m[1]) {
+			if row[m[3]] != args[len(args)-1].Value {
+				continue
+			}
+			for i, assignment := range assignments {
+				row[strings.TrimSuffix(assignment, " = ?")] = args[i].Value
+			}
+			affected++
+		}
+		return affected, nil, nil, nil
+
+	case fakeSQLDelete.MatchString(query):
+		m := fakeSQLDelete.FindStringSubmatch(query)
+		table := db.table(m[1])
+		var affected int64
+		for key, row := range table {
+			if row[m[2]] == args[0].Value {
+				delete(table, key)
+				affected++
+			}
+		}
+		return affected, nil, nil, nil
+
+	case fakeSQLDeleteBefore.MatchString(query):
+		m := fakeSQLDeleteBefore.FindStringSubmatch(query)
+		table := db.table(m[1])
+		limit, _ := strconv.Atoi(m[3])
+		var affected int64
+		for key, row := range table {
+			if int(affected) < limit && row[m[2]].(int64) < args[0].Value.(int64) {
+				delete(table, key)
+				affected++
+			}
+		}
+		return affected, nil, nil, nil
+	}
+
+	return 0, nil, nil, fmt.Errorf("fake sql: unsupported query %q", query)
+}
+
+type fakeSQLConnector struct{ db *fakeSQLDB }
+
+func (c fakeSQLConnector) Connect(context.Context) (driver.Conn, error) { return fakeSQLConn(c), nil }
+func (c fakeSQLConnector) Driver() driver.Driver                        { return nil }
+
+type fakeSQLConn struct{ db *fakeSQLDB }
+
+func (c fakeSQLConn) Prepare(query string) (driver.Stmt, error) { return fakeSQLStmt{c.db, query}, nil }
+func (c fakeSQLConn) Close() error                              { return nil }
+func (c fakeSQLConn) Begin() (driver.Tx, error)                 { return fakeSQLTx{}, nil }
+
+type fakeSQLTx struct{}
+
+func (fakeSQLTx) Commit() error   { return nil }
+func (fakeSQLTx) Rollback() error { return nil }
+
+type fakeSQLStmt struct {
+	db    *fakeSQLDB
+	query string
+}
+
+func (s fakeSQLStmt) Close() error  { return nil }
+func (s fakeSQLStmt) NumInput() int { return -1 }
+
+func (s fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+func (s fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s fakeSQLStmt) ExecContext(_ context.Context, args []driver.NamedValue) (driver.Result, error) {
+	affected, _, _, err := s.db.exec(s.query, args)
+	return driver.RowsAffected(affected), err
+}
+
+func (s fakeSQLStmt) QueryContext(_ context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	_, rows, columns, err := s.db.exec(s.query, args)
+	return &fakeSQLRows{columns: columns, rows: rows}, err
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return named
+}
+
+type fakeSQLRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeSQLRows) Columns() []string { return r.columns }
+func (r *fakeSQLRows) Close() error      { return nil }
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func TestSQLStore(t *testing.T) {
+	ctx := context.Background()
+
+	newStore := func(t *testing.T, opts ...knocknock.SQLStoreOption) (*knocknock.SQLStore, *fakeSQLDB) {
+		sqlDB, db := openFakeSQL(t)
+		store := knocknock.HandleSQLStore(sqlDB, knocknock.SQLiteDialect, opts...)
+		if err := store.Migrate(ctx); err != nil {
+			t.Fatalf("Migrate failed: %v", err)
+		}
+		return store, db
+	}
+
+	session := &knocknock.Session{
+		Token:     "test-token",
+		UserData:  map[string]any{"name": "test-user"},
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+
+	t.Run("Migrate is idempotent", func(t *testing.T) {
+		store, db := newStore(t)
+
+		applied := len(db.statements)
+		if err := store.Migrate(ctx); err != nil {
+			t.Fatalf("Second Migrate failed: %v", err)
+		}
+
+		for _, statement := range db.statements[applied:] {
+			if strings.HasPrefix(statement, "CREATE TABLE knocknock_sessions") {
+				t.Error("Second Migrate should not recreate the sessions table")
+			}
+		}
+
+		version, err := store.SchemaVersion(ctx)
+		if err != nil {
+			t.Fatalf("SchemaVersion failed: %v", err)
+		}
+		if version == 0 {
+			t.Error("Expected non-zero schema version after Migrate")
+		}
+	})
+
+	t.Run("Save and Get", func(t *testing.T) {
+		store, _ := newStore(t)
+
+		if err := store.Save(ctx, session); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+
+		retrieved, err := store.Get(ctx, session.Token)
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+
+		if retrieved.Token != session.Token {
+			t.Errorf("Expected token %s, got %s", session.Token, retrieved.Token)
+		}
+		if !retrieved.ExpiresAt.Equal(session.ExpiresAt) {
+			t.Errorf("Expected ExpiresAt %v, got %v", session.ExpiresAt, retrieved.ExpiresAt)
+		}
+		if data, ok := retrieved.UserData.(map[string]any); !ok || data["name"] != "test-user" {
+			t.Errorf("Unexpected userData %v", retrieved.UserData)
+		}
+	})
+
+	t.Run("Metadata round trip", func(t *testing.T) {
+		store, _ := newStore(t)
+
+		refresh := *session
+		refresh.Kind = knocknock.SessionKindRefresh
+		refresh.Pair = "access-token"
+		store.Save(ctx, &refresh)
+
+		retrieved, err := store.Get(ctx, refresh.Token)
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		if retrieved.Kind != knocknock.SessionKindRefresh || retrieved.Pair != "access-token" {
+			t.Errorf("Expected metadata to survive, got kind %q pair %q", retrieved.Kind, retrieved.Pair)
+		}
+	})
+
+	t.Run("Save duplicate", func(t *testing.T) {
+		store, _ := newStore(t)
+
+		store.Save(ctx, session)
+		if err := store.Save(ctx, session); !errors.Is(err, knocknock.SessionExistsError) {
+			t.Errorf("Expected SessionExistsError, got %v", err)
+		}
+	})
+
+	t.Run("Get non-existent", func(t *testing.T) {
+		store, _ := newStore(t)
+
+		if _, err := store.Get(ctx, "non-existent"); !errors.Is(err, knocknock.SessionNotFoundError) {
+			t.Errorf("Expected SessionNotFoundError, got %v", err)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		store, _ := newStore(t)
+
+		store.Save(ctx, session)
+		if err := store.Delete(ctx, session.Token); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+
+		if _, err := store.Get(ctx, session.Token); err == nil {
+			t.Error("Session should be deleted")
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		store, _ := newStore(t)
+
+		store.Save(ctx, session)
+		updated := *session
+		updated.ExpiresAt = time.Now().Add(2 * time.Hour)
+
+		if err := store.Update(ctx, &updated); err != nil {
+			t.Fatalf("Update failed: %v", err)
+		}
+
+		retrieved, _ := store.Get(ctx, session.Token)
+		if !retrieved.ExpiresAt.Equal(updated.ExpiresAt) {
+			t.Errorf("Expected ExpiresAt %v, got %v", updated.ExpiresAt, retrieved.ExpiresAt)
+		}
+
+		if err := store.Update(ctx, &knocknock.Session{Token: "non-existent"}); !errors.Is(err, knocknock.SessionNotFoundError) {
+			t.Errorf("Expected SessionNotFoundError, got %v", err)
+		}
+	})
+
+	t.Run("Replace", func(t *testing.T) {
+		store, _ := newStore(t)
+
+		store.Save(ctx, session)
+		replacement := *session
+		replacement.Token = "new-token"
+
+		if err := store.Replace(ctx, session.Token, &replacement); err != nil {
+			t.Fatalf("Replace failed: %v", err)
+		}
+		if _, err := store.Get(ctx, session.Token); !errors.Is(err, knocknock.SessionNotFoundError) {
+			t.Error("Old session should be removed")
+		}
+		if _, err := store.Get(ctx, replacement.Token); err != nil {
+			t.Errorf("New session should be saved, got %v", err)
+		}
+
+		if err := store.Replace(ctx, session.Token, &knocknock.Session{Token: "other"}); !errors.Is(err, knocknock.SessionNotFoundError) {
+			t.Errorf("Expected SessionNotFoundError, got %v", err)
+		}
+	})
+
+	t.Run("ListBySubject", func(t *testing.T) {
+		store, _ := newStore(t)
+
+		store.Save(ctx, &knocknock.Session{Token: "a1", Subject: "alice", ExpiresAt: time.Now().Add(time.Hour)})
+		store.Save(ctx, &knocknock.Session{Token: "a2", Subject: "alice", ExpiresAt: time.Now().Add(time.Hour)})
+		store.Save(ctx, &knocknock.Session{Token: "b1", Subject: "bob", ExpiresAt: time.Now().Add(time.Hour)})
+
+		sessions, err := store.ListBySubject(ctx, "alice")
+		if err != nil {
+			t.Fatalf("ListBySubject failed: %v", err)
+		}
+		if len(sessions) != 2 {
+			t.Errorf("Expected 2 sessions, got %d", len(sessions))
+		}
+		for _, session := range sessions {
+			if session.Subject != "alice" {
+				t.Errorf("Expected subject alice, got %q", session.Subject)
+			}
+		}
+	})
+
+	t.Run("Cleanup in batches", func(t *testing.T) {
+		store, _ := newStore(t, knocknock.WithSQLCleanupBatch(2))
+
+		store.Save(ctx, session)
+		for i := 0; i < 5; i++ {
+			store.Save(ctx, &knocknock.Session{
+				Token:     fmt.Sprintf("expired-%d", i),
+				CreatedAt: time.Now().Add(-2 * time.Hour),
+				ExpiresAt: time.Now().Add(-time.Hour),
+			})
+		}
+
+		deleted, err := store.Cleanup(ctx)
+		if err != nil {
+			t.Fatalf("Cleanup failed: %v", err)
+		}
+		if deleted != 5 {
+			t.Errorf("Expected 5 deleted sessions, got %d", deleted)
+		}
+
+		if _, err := store.Get(ctx, session.Token); err != nil {
+			t.Error("Valid session should not be cleaned up")
+		}
+	})
+
+	t.Run("Dialect placeholders", func(t *testing.T) {
+		cases := map[knocknock.SQLDialect]string{
+			knocknock.PostgresDialect: "$3",
+			knocknock.MySQLDialect:    "?",
+			knocknock.SQLiteDialect:   "?",
+		}
+		for dialect, expected := range cases {
+			if got := dialect.Placeholder(3); got != expected {
+				t.Errorf("Expected placeholder %s, got %s", expected, got)
+			}
+		}
+	})
+}
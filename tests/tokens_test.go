@@ -0,0 +1,168 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/tolstovrob/knocknock"
+)
+
+func TestSplitTokens(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Selector and verifier", func(t *testing.T) {
+		store := knocknock.HandleMemoryStore()
+		auth := knocknock.HandleAuth(store, knocknock.WithSplitTokens())
+
+		session, err := auth.CreateSession(ctx, "test-user")
+		if err != nil {
+			t.Fatalf("CreateSession failed: %v", err)
+		}
+
+		selector, verifier, ok := strings.Cut(session.Token, ".")
+		if !ok || selector == "" || verifier == "" {
+			t.Fatalf("Expected selector.verifier token, got %s", session.Token)
+		}
+
+		stored, err := store.Get(ctx, selector)
+		if err != nil {
+			t.Fatalf("Session should be stored under selector: %v", err)
+		}
+		if strings.Contains(stored.Verifier, verifier) {
+			t.Error("Verifier should be stored hashed")
+		}
+
+		if _, err := auth.GetSession(ctx, session.Token); err != nil {
+			t.Errorf("GetSession failed: %v", err)
+		}
+	})
+
+	t.Run("Wrong verifier", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithSplitTokens())
+		session, _ := auth.CreateSession(ctx, "test-user")
+		selector, _, _ := strings.Cut(session.Token, ".")
+
+		for _, token := range []string{selector, selector + ".", selector + ".deadbeef"} {
+			if _, err := auth.GetSession(ctx, token); !errors.Is(err, knocknock.SessionNotFoundError) {
+				t.Errorf("Expected SessionNotFoundError for %q, got %v", token, err)
+			}
+		}
+
+		auth.DeleteSession(ctx, selector+".deadbeef")
+		if _, err := auth.GetSession(ctx, session.Token); err != nil {
+			t.Errorf("Session should survive deletion with wrong verifier: %v", err)
+		}
+	})
+
+	t.Run("Plain tokens keep working", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore())
+		plain, _ := auth.CreateSession(ctx, "test-user")
+
+		auth.UpdateAuthOptions(knocknock.WithSplitTokens())
+		if _, err := auth.GetSession(ctx, plain.Token); err != nil {
+			t.Errorf("Plain token should still authorize: %v", err)
+		}
+	})
+
+	t.Run("Refresh with split tokens", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithSplitTokens())
+		pair, _ := auth.CreateSessionPair(ctx, "test-user")
+
+		rotated, err := auth.Refresh(ctx, pair.Refresh.Token)
+		if err != nil {
+			t.Fatalf("Refresh failed: %v", err)
+		}
+		if _, err := auth.GetSession(ctx, rotated.Access.Token); err != nil {
+			t.Errorf("New access token should authorize: %v", err)
+		}
+		if _, err := auth.GetSession(ctx, pair.Access.Token); err == nil {
+			t.Error("Old access token should be revoked after refresh")
+		}
+	})
+}
+
+// Хранилище, считающее обращения к Get
+type countingStore struct {
+	knocknock.Store
+	gets int
+}
+
+func (s *countingStore) Get(ctx context.Context, token string) (*knocknock.Session, error) {
+	s.gets++
+	return s.Store.Get(ctx, token)
+}
+
+func TestTokenGenerator(t *testing.T) {
+	ctx := context.Background()
+	generator := knocknock.PrefixedTokenGenerator{Prefix: "kn_live_"}
+
+	t.Run("Prefixed token format", func(t *testing.T) {
+		token, err := generator.Generate()
+		if err != nil {
+			t.Fatalf("Generate failed: %v", err)
+		}
+
+		if !regexp.MustCompile(`^kn_live_[0-9A-Za-z]{36}$`).MatchString(token) {
+			t.Errorf("Unexpected token format: %s", token)
+		}
+		if !generator.Valid(token) {
+			t.Error("Generated token should be valid")
+		}
+
+		tampered := []byte(token)
+		tampered[10] ^= 1
+		for _, bad := range []string{string(tampered), "kn_test_" + token[8:], token[:len(token)-1], token + "0"} {
+			if generator.Valid(bad) {
+				t.Errorf("Token %q should be invalid", bad)
+			}
+		}
+	})
+
+	t.Run("Auth issues generator tokens", func(t *testing.T) {
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithTokenGenerator(generator))
+
+		session, _ := auth.CreateSession(ctx, "test-user")
+		if !generator.Valid(session.Token) {
+			t.Errorf("Expected prefixed token, got %s", session.Token)
+		}
+
+		auth.UpdateAuthOptions(knocknock.WithSplitTokens())
+		split, _ := auth.CreateSession(ctx, "test-user")
+		if _, verifier, _ := strings.Cut(split.Token, "."); !generator.Valid(verifier) {
+			t.Errorf("Expected prefixed verifier, got %s", split.Token)
+		}
+		if _, err := auth.GetSession(ctx, split.Token); err != nil {
+			t.Errorf("GetSession failed: %v", err)
+		}
+	})
+
+	t.Run("Middleware rejects malformed tokens", func(t *testing.T) {
+		store := &countingStore{Store: knocknock.HandleMemoryStore()}
+		auth := knocknock.HandleAuth(store, knocknock.WithTokenGenerator(generator))
+		session, _ := auth.CreateSession(ctx, "test-user")
+
+		var authorized bool
+		handler := auth.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authorized = knocknock.GetSession(r.Context()) != nil
+		}))
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer kn_live_garbage")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if authorized || store.gets != 0 {
+			t.Errorf("Malformed token should be rejected without store lookup, got %d lookups", store.gets)
+		}
+
+		req = httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+session.Token)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if !authorized {
+			t.Error("Valid token should authorize")
+		}
+	})
+}
@@ -0,0 +1,161 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/tolstovrob/knocknock"
+)
+
+// Записанный span
+type recordedSpan struct {
+	name   string
+	parent string
+	attrs  map[string]any
+	err    error
+	ended  bool
+}
+
+// Tracer, записывающий span-ы в память. Родитель span-а берётся из контекста
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type spanContextKey struct{}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, attrs ...knocknock.Attribute) (context.Context, knocknock.Span) {
+	span := &recordedSpan{name: name, attrs: make(map[string]any)}
+	if parent, ok := ctx.Value(spanContextKey{}).(*recordedSpan); ok {
+		span.parent = parent.name
+	}
+	span.SetAttributes(attrs...)
+
+	t.mu.Lock()
+	t.spans = append(t.spans, span)
+	t.mu.Unlock()
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// Находит первый span с именем name
+func (t *recordingTracer) find(name string) *recordedSpan {
+	for _, span := range t.spans {
+		if span.name == name {
+			return span
+		}
+	}
+	return nil
+}
+
+func (s *recordedSpan) SetAttributes(attrs ...knocknock.Attribute) {
+	for _, attr := range attrs {
+		s.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (s *recordedSpan) RecordError(err error) { s.err = err }
+func (s *recordedSpan) End()                  { s.ended = true }
+
+func TestTracing(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Auth and store spans", func(t *testing.T) {
+		tracer := &recordingTracer{}
+		store := knocknock.TraceStore(knocknock.HandleMemoryStore(), tracer)
+		auth := knocknock.HandleAuth(store, knocknock.WithTracer(tracer))
+
+		session, err := auth.CreateSession(ctx, "user")
+		if err != nil {
+			t.Fatalf("CreateSession failed: %v", err)
+		}
+		auth.GetSession(ctx, "unknown")
+
+		create := tracer.find("knocknock.CreateSession")
+		if create == nil || !create.ended || create.attrs["knocknock.outcome"] != "created" || create.attrs["knocknock.mode"] != "store" {
+			t.Errorf("Unexpected CreateSession span %+v", create)
+		}
+		save := tracer.find("knocknock.store.Save")
+		if save == nil || save.parent != "knocknock.CreateSession" || save.attrs["knocknock.store"] != "MemoryStore" || save.attrs["knocknock.outcome"] != "ok" {
+			t.Errorf("Unexpected Save span %+v", save)
+		}
+
+		get := tracer.find("knocknock.GetSession")
+		if get == nil || get.attrs["knocknock.outcome"] != "miss" || get.err != nil {
+			t.Errorf("Unexpected GetSession span %+v", get)
+		}
+		storeGet := tracer.find("knocknock.store.Get")
+		if storeGet == nil || storeGet.parent != "knocknock.GetSession" || storeGet.attrs["knocknock.outcome"] != "not_found" {
+			t.Errorf("Unexpected store Get span %+v", storeGet)
+		}
+
+		if session.Token == "" {
+			t.Error("Expected token")
+		}
+		for _, span := range tracer.spans {
+			for key, value := range span.attrs {
+				if value == session.Token {
+					t.Errorf("Span %s leaks token in %s", span.name, key)
+				}
+			}
+		}
+	})
+
+	t.Run("Middleware", func(t *testing.T) {
+		tracer := &recordingTracer{}
+		auth := knocknock.HandleAuth(knocknock.HandleMemoryStore(), knocknock.WithTracer(tracer))
+		session, _ := auth.CreateSession(ctx, "user")
+
+		var inner string
+		handler := auth.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, span := tracer.Start(r.Context(), "handler")
+			span.End()
+			inner = tracer.find("handler").parent
+		}))
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: "session_token", Value: session.Token})
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		middleware := tracer.find("knocknock.Middleware")
+		if middleware == nil || !middleware.ended {
+			t.Fatal("Expected ended Middleware span")
+		}
+		if middleware.attrs["knocknock.outcome"] != "authenticated" || middleware.attrs["knocknock.token.source"] != "cookie" {
+			t.Errorf("Unexpected Middleware attributes %v", middleware.attrs)
+		}
+		if inner != "knocknock.Middleware" {
+			t.Errorf("Handler span should be a child of Middleware span, got parent %q", inner)
+		}
+		if get := tracer.find("knocknock.GetSession"); get == nil || get.parent != "knocknock.Middleware" {
+			t.Error("GetSession span should be a child of Middleware span")
+		}
+
+		tracer.spans = nil
+		req = httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer unknown")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if middleware := tracer.find("knocknock.Middleware"); middleware.attrs["knocknock.outcome"] != "not_found" || middleware.attrs["knocknock.token.source"] != "header" {
+			t.Errorf("Unexpected Middleware attributes %v", middleware.attrs)
+		}
+	})
+
+	t.Run("Store errors", func(t *testing.T) {
+		tracer := &recordingTracer{}
+		store := knocknock.TraceStore(knocknock.InstrumentStore(failingStore{knocknock.HandleMemoryStore()}, knocknock.HandleMetrics()), tracer)
+		auth := knocknock.HandleAuth(store, knocknock.WithTracer(tracer))
+
+		session, _ := auth.CreateSession(ctx, "user")
+		auth.GetSession(ctx, session.Token)
+
+		get := tracer.find("knocknock.store.Get")
+		if get == nil || get.err == nil || get.attrs["knocknock.store"] != "failingStore" {
+			t.Errorf("Expected failed store span with unwrapped store name, got %+v", get)
+		}
+		if span := tracer.find("knocknock.GetSession"); span.err == nil || span.attrs["knocknock.outcome"] != "error" {
+			t.Errorf("Expected failed GetSession span, got %+v", span)
+		}
+	})
+}
@@ -0,0 +1,174 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/tolstovrob/knocknock"
+)
+
+type typedUser struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+}
+
+func TestTypedAuth(t *testing.T) {
+	ctx := context.Background()
+	user := typedUser{ID: 42, Username: "test-user"}
+
+	t.Run("CreateSession and GetSession", func(t *testing.T) {
+		auth := knocknock.HandleTypedAuth[typedUser](knocknock.HandleMemoryStore())
+
+		session, err := auth.CreateSession(ctx, user)
+		if err != nil {
+			t.Fatalf("CreateSession failed: %v", err)
+		}
+		if session.UserData != user {
+			t.Errorf("Expected userData %v, got %v", user, session.UserData)
+		}
+
+		retrieved, err := auth.GetSession(ctx, session.Token)
+		if err != nil {
+			t.Fatalf("GetSession failed: %v", err)
+		}
+		if retrieved.UserData.Username != user.Username {
+			t.Errorf("Expected username %s, got %s", user.Username, retrieved.UserData.Username)
+		}
+	})
+
+	t.Run("GetSession from serializing store", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "sessions.log")
+		store, _ := knocknock.HandleFileStore(path)
+		auth := knocknock.HandleTypedAuth[typedUser](store)
+
+		session, _ := auth.CreateSession(ctx, user)
+		store.Close()
+
+		store, _ = knocknock.HandleFileStore(path)
+		defer store.Close()
+		auth = knocknock.HandleTypedAuth[typedUser](store)
+
+		retrieved, err := auth.GetSession(ctx, session.Token)
+		if err != nil {
+			t.Fatalf("GetSession after reopen failed: %v", err)
+		}
+		if retrieved.UserData != user {
+			t.Errorf("Expected userData %v, got %v", user, retrieved.UserData)
+		}
+	})
+
+	t.Run("Non-struct types from serializing store", func(t *testing.T) {
+		type role string
+		path := filepath.Join(t.TempDir(), "sessions.log")
+		store, _ := knocknock.HandleFileStore(path)
+		ids := knocknock.HandleTypedAuth[int](store)
+		tags := knocknock.HandleTypedAuth[[]string](store)
+		roles := knocknock.HandleTypedAuth[role](store)
+		flags := knocknock.HandleTypedAuth[bool](store)
+
+		id, _ := ids.CreateSession(ctx, 42)
+		tag, _ := tags.CreateSession(ctx, []string{"a", "b"})
+		admin, _ := roles.CreateSession(ctx, "admin")
+		flag, _ := flags.CreateSession(ctx, true)
+		store.Close()
+
+		store, _ = knocknock.HandleFileStore(path)
+		defer store.Close()
+
+		if got, err := knocknock.HandleTypedAuth[int](store).GetSession(ctx, id.Token); err != nil || got.UserData != 42 {
+			t.Errorf("Expected int 42 after reopen, got %v (%v)", got, err)
+		}
+		if got, err := knocknock.HandleTypedAuth[[]string](store).GetSession(ctx, tag.Token); err != nil || !slices.Equal(got.UserData, []string{"a", "b"}) {
+			t.Errorf("Expected []string after reopen, got %v (%v)", got, err)
+		}
+		if got, err := knocknock.HandleTypedAuth[role](store).GetSession(ctx, admin.Token); err != nil || got.UserData != "admin" {
+			t.Errorf("Expected named string after reopen, got %v (%v)", got, err)
+		}
+		if got, err := knocknock.HandleTypedAuth[bool](store).GetSession(ctx, flag.Token); err != nil || !got.UserData {
+			t.Errorf("Expected bool after reopen, got %v (%v)", got, err)
+		}
+
+		// Число не перекодируется в структуру, строка -- в число
+		if _, err := knocknock.HandleTypedAuth[typedUser](store).GetSession(ctx, id.Token); !errors.Is(err, knocknock.UserDataTypeError) {
+			t.Errorf("Expected UserDataTypeError for number as struct, got %v", err)
+		}
+		if _, err := knocknock.HandleTypedAuth[int](store).GetSession(ctx, admin.Token); !errors.Is(err, knocknock.UserDataTypeError) {
+			t.Errorf("Expected UserDataTypeError for string as int, got %v", err)
+		}
+	})
+
+	t.Run("Untyped API keeps working", func(t *testing.T) {
+		auth := knocknock.HandleTypedAuth[typedUser](knocknock.HandleMemoryStore())
+
+		session, err := auth.Auth.CreateSession(ctx, user)
+		if err != nil {
+			t.Fatalf("CreateSession failed: %v", err)
+		}
+		if _, ok := session.UserData.(typedUser); !ok {
+			t.Errorf("Expected typedUser in untyped session, got %T", session.UserData)
+		}
+	})
+
+	t.Run("AsTypedSession with wrong type", func(t *testing.T) {
+		session := knocknock.MakeSession("token", "not-a-user", 0)
+
+		if _, err := knocknock.AsTypedSession[typedUser](session); !errors.Is(err, knocknock.UserDataTypeError) {
+			t.Errorf("Expected UserDataTypeError, got %v", err)
+		}
+
+		// Другая структура с теми же полями не должна молча перекодироваться
+		type otherUser struct {
+			ID       int    `json:"id"`
+			Username string `json:"username"`
+		}
+		session = knocknock.MakeSession("token", otherUser{ID: 1}, 0)
+		if _, err := knocknock.AsTypedSession[typedUser](session); !errors.Is(err, knocknock.UserDataTypeError) {
+			t.Errorf("Expected UserDataTypeError for other struct, got %v", err)
+		}
+
+		// Пустые данные не должны превращаться в нулевое значение T
+		session = knocknock.MakeSession("token", nil, 0)
+		if _, err := knocknock.AsTypedSession[typedUser](session); !errors.Is(err, knocknock.UserDataTypeError) {
+			t.Errorf("Expected UserDataTypeError for nil data, got %v", err)
+		}
+	})
+
+	t.Run("AsTypedSession keeps all fields", func(t *testing.T) {
+		session := knocknock.MakeSession("token", map[string]any{"id": 7.0}, 0)
+		session.Subject, session.Kind, session.Pair, session.ReplacedBy = "alice", knocknock.SessionKindRefresh, "pair", "next"
+		session.Verifier, session.CSRFToken, session.Roles = "verifier", "csrf", []string{"admin"}
+
+		typed, err := knocknock.AsTypedSession[typedUser](session)
+		if err != nil {
+			t.Fatalf("AsTypedSession failed: %v", err)
+		}
+		if typed.UserData.ID != 7 || typed.Subject != "alice" || typed.Kind != knocknock.SessionKindRefresh || typed.Pair != "pair" ||
+			typed.ReplacedBy != "next" || typed.Verifier != "verifier" || typed.CSRFToken != "csrf" || typed.Roles[0] != "admin" ||
+			!typed.ExpiresAt.Equal(session.ExpiresAt) {
+			t.Errorf("Fields lost in typed session: %+v", typed)
+		}
+	})
+
+	t.Run("GetSessionAs", func(t *testing.T) {
+		session := knocknock.MakeSession("token", user, 0)
+		ctx := context.WithValue(ctx, knocknock.SessionContextKey, session)
+
+		typed := knocknock.GetSessionAs[typedUser](ctx)
+		if typed == nil {
+			t.Fatal("Should retrieve typed session from context")
+		}
+		if typed.UserData.ID != user.ID {
+			t.Errorf("Expected ID %d, got %d", user.ID, typed.UserData.ID)
+		}
+
+		if knocknock.GetSessionAs[int](ctx) != nil {
+			t.Error("Should not retrieve session with mismatched type")
+		}
+		if knocknock.GetSessionAs[typedUser](context.Background()) != nil {
+			t.Error("Should not retrieve session from empty context")
+		}
+	})
+}
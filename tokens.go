@@ -0,0 +1,176 @@
+package knocknock
+
+/*
+ * tokens.go содержит генерацию токенов. Генератор задаётся интерфейсом TokenGenerator; встроенный PrefixedTokenGenerator
+ * выдаёт токены с префиксом и контрольной суммой, как у GitHub: по префиксу сканеры секретов узнают утёкший токен, а
+ * по контрольной сумме Auth отбрасывает опечатки и мусор, не обращаясь к хранилищу.
+ *
+ * Здесь же формат токенов "селектор.верификатор". Селектор -- публичная часть, по которой сессия ищется в
+ * хранилище (Session.Token). Верификатор -- секрет, который хранится только в виде SHA-256 (Session.Verifier) и
+ * сравнивается за постоянное время. Так время поиска в map или индексе БД зависит лишь от селектора и ничего не
+ * говорит о секрете.
+ *
+ * Формат определяется по самому токену, поэтому сессии с обычными hex-токенами продолжают работать и после
+ * включения WithSplitTokens
+ */
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"hash/crc32"
+	"strings"
+)
+
+// Длина селектора в байтах
+const selectorSize = 12
+
+// Интерфейс генератора токенов. Generate выдаёт новый криптографически стойкий токен, Valid проверяет формат токена
+// из запроса. Токен не должен содержать точку: она разделяет селектор и верификатор (см. WithSplitTokens)
+type TokenGenerator interface {
+	Generate() (string, error)
+	Valid(token string) bool
+}
+
+// Функциональная опция для установки генератора токенов. С генератором Middleware отбрасывает токены, не прошедшие
+// TokenGenerator.Valid, не обращаясь к хранилищу. Без него токены -- hex длиной TokenSize байт, а формат не
+// проверяется.
+//
+// Пример:
+//
+//	auth := knocknock.HandleAuth(store, knocknock.WithTokenGenerator(knocknock.PrefixedTokenGenerator{Prefix: "kn_live_"}))
+func WithTokenGenerator(generator TokenGenerator) AuthOption {
+	return func(o *AuthOptions) {
+		o.TokenGenerator = generator
+	}
+}
+
+const (
+	base62Alphabet       = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	base62ChecksumLength = 6  // 62^6 > 2^32, так что CRC32 помещается в 6 символов
+	defaultPrefixedSize  = 30 // ~178 бит энтропии
+)
+
+// Генератор токенов вида <Prefix><тело base62><CRC32 тела в base62>, например kn_live_2bXk...0Fh3aQ. Нулевой Size
+// означает 30 символов тела
+type PrefixedTokenGenerator struct {
+	Prefix string // Префикс, например "kn_live_" или "kn_test_"
+	Size   int    // Длина случайного тела в символах base62
+}
+
+// Реализация TokenGenerator.Generate
+func (g PrefixedTokenGenerator) Generate() (string, error) {
+	body, err := randomBase62(g.size())
+	if err != nil {
+		return "", err
+	}
+	return g.Prefix + body + base62Checksum(body), nil
+}
+
+// Реализация TokenGenerator.Valid. Проверяет префикс, длину, алфавит и контрольную сумму
+func (g PrefixedTokenGenerator) Valid(token string) bool {
+	rest, ok := strings.CutPrefix(token, g.Prefix)
+	if !ok || len(rest) != g.size()+base62ChecksumLength {
+		return false
+	}
+	for i := 0; i < len(rest); i++ {
+		if strings.IndexByte(base62Alphabet, rest[i]) < 0 {
+			return false
+		}
+	}
+
+	body, checksum := rest[:g.size()], rest[g.size():]
+	return subtle.ConstantTimeCompare([]byte(checksum), []byte(base62Checksum(body))) == 1
+}
+
+func (g PrefixedTokenGenerator) size() int {
+	if g.Size <= 0 {
+		return defaultPrefixedSize
+	}
+	return g.Size
+}
+
+// Генерирует n случайных символов base62 без смещения распределения: байты от 248 и выше отбрасываются
+func randomBase62(n int) (string, error) {
+	out := make([]byte, 0, n)
+	buf := make([]byte, n+n/4+1)
+	for len(out) < n {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			if b < 248 && len(out) < n {
+				out = append(out, base62Alphabet[b%62])
+			}
+		}
+	}
+	return string(out), nil
+}
+
+// Кодирует CRC32 тела в base62 фиксированной длины
+func base62Checksum(body string) string {
+	sum := uint64(crc32.ChecksumIEEE([]byte(body)))
+	out := make([]byte, base62ChecksumLength)
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = base62Alphabet[sum%62]
+		sum /= 62
+	}
+	return string(out)
+}
+
+// Функциональная опция для выдачи токенов вида "селектор.верификатор". Длина верификатора задаётся WithTokenSize
+func WithSplitTokens() AuthOption {
+	return func(o *AuthOptions) {
+		o.SplitTokens = true
+	}
+}
+
+// Генерирует токен в формате, выбранном в настройках. При WithSplitTokens генератор выдаёт верификатор
+func (a *Auth) newToken() (string, error) {
+	var secret string
+	var err error
+	if generator := a.AuthOptions.TokenGenerator; generator != nil {
+		secret, err = generator.Generate()
+	} else {
+		secret, err = generateToken(a.AuthOptions.TokenSize)
+	}
+	if err != nil || !a.AuthOptions.SplitTokens {
+		return secret, err
+	}
+
+	selector, err := generateToken(selectorSize)
+	if err != nil {
+		return "", err
+	}
+	return selector + "." + secret, nil
+}
+
+// Проверяет формат токена генератором. Для токена "селектор.верификатор" проверяется верификатор, подписанные токены
+// проверяются подписью, а запечатанные в cookie -- расшифровкой
+func (a *Auth) validToken(token string) bool {
+	generator := a.AuthOptions.TokenGenerator
+	if generator == nil || a.signedToken(token) || a.cookieStore() != nil {
+		return true
+	}
+	if _, secret, ok := strings.Cut(token, "."); ok {
+		token = secret
+	}
+	return generator.Valid(token)
+}
+
+// Хеш верификатора из токена. Для обычного токена -- пустая строка
+func verifierHash(token string) string {
+	_, verifier, ok := strings.Cut(token, ".")
+	if !ok {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return hex.EncodeToString(sum[:])
+}
+
+// Сверяет верификатор токена с сохранённым за постоянное время. Сессия, выданная с верификатором, не находится по
+// одному селектору, и наоборот
+func verifyToken(session *Session, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(session.Verifier), []byte(verifierHash(token))) == 1
+}
@@ -0,0 +1,178 @@
+package knocknock
+
+/*
+ * trace.go содержит трассировку в духе OpenTelemetry без зависимости от него. Auth (опция WithTracer) открывает
+ * span на CreateSession, GetSession и на каждый запрос в Middleware, а TraceStore -- на каждый вызов хранилища.
+ * Span передаётся дальше через ctx, который и так принимают методы Auth и Store, поэтому вызовы хранилища становятся
+ * дочерними span-ами операции Auth, а та -- span-а входящего HTTP-запроса.
+ *
+ * Интерфейсы Tracer и Span нарочно маленькие, чтобы их было легко реализовать поверх любой системы трассировки.
+ * Адаптер для OpenTelemetry -- отдельный модуль github.com/tolstovrob/knocknock/otel, чтобы основной модуль
+ * оставался без зависимостей.
+ *
+ * Атрибуты span-ов:
+ *   - knocknock.outcome -- исход: hit, miss, expired, error для GetSession; created, error для CreateSession;
+ *     authenticated, anonymous или причина отказа (см. metrics.go) для Middleware; ok, not_found, exists, error
+ *     для хранилища;
+ *   - knocknock.mode -- режим Auth: store, jwt или cookie;
+ *   - knocknock.token.source -- откуда Middleware взял токен: header, query, cookie, form или custom;
+ *   - knocknock.store, knocknock.store.method -- тип хранилища и вызванный метод.
+ *
+ * Токены и данные пользователя в атрибуты не попадают
+ */
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Атрибут span-а. Value -- string, bool, int, int64 или float64
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// Span -- одна операция в трассе
+type Span interface {
+	// Добавляет атрибуты span-у
+	SetAttributes(attrs ...Attribute)
+	// Отмечает span как завершившийся ошибкой
+	RecordError(err error)
+	// Завершает span. После End span не используется
+	End()
+}
+
+// Tracer открывает span-ы. Start возвращает контекст, несущий новый span, чтобы вложенные операции стали его
+// дочерними span-ами
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// Функциональная опция для подключения трассировки к Auth. Вызовы хранилища трассируются отдельно, через
+// TraceStore.
+//
+// Пример:
+//
+//	tracer := knockotel.HandleTracer(otel.Tracer("auth"))
+//	store := knocknock.TraceStore(knocknock.HandleMemoryStore(), tracer)
+//	auth := knocknock.HandleAuth(store, knocknock.WithTracer(tracer))
+func WithTracer(tracer Tracer) AuthOption {
+	return func(o *AuthOptions) {
+		o.Tracer = tracer
+	}
+}
+
+// Ключи атрибутов
+const (
+	attrOutcome     = "knocknock.outcome"
+	attrMode        = "knocknock.mode"
+	attrTokenSource = "knocknock.token.source"
+	attrStore       = "knocknock.store"
+	attrStoreMethod = "knocknock.store.method"
+)
+
+// Tracer, который ничего не делает. Используется без WithTracer
+type noopTracer struct{}
+
+type noopSpan struct{}
+
+func (noopTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+func (noopSpan) SetAttributes(attrs ...Attribute) {}
+func (noopSpan) RecordError(err error)            {}
+func (noopSpan) End()                             {}
+
+// Tracer, которым Auth открывает span-ы
+func (a *Auth) tracer() Tracer {
+	if a.AuthOptions.Tracer != nil {
+		return a.AuthOptions.Tracer
+	}
+	return noopTracer{}
+}
+
+// Открывает span операции Auth с режимом Auth в атрибутах
+func (a *Auth) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	return a.tracer().Start(ctx, "knocknock."+name, Attribute{attrMode, a.mode()})
+}
+
+// Завершает span с исходом outcome. Ошибки, которые означают лишь отсутствие сессии, ошибкой span-а не считаются
+func endSpan(span Span, outcome string, err error) {
+	span.SetAttributes(Attribute{attrOutcome, outcome})
+	if outcome == lookupError || outcome == storeError {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+// Режим, в котором работает Auth
+func (a *Auth) mode() string {
+	switch {
+	case a.AuthOptions.JWTKey != nil:
+		return "jwt"
+	case a.cookieStore() != nil:
+		return "cookie"
+	}
+	return "store"
+}
+
+// Имя источника токена для атрибута knocknock.token.source
+func sourceName(source TokenSource) string {
+	switch source.(type) {
+	case headerSource:
+		return "header"
+	case querySource:
+		return "query"
+	case cookieSource:
+		return "cookie"
+	case formSource:
+		return "form"
+	}
+	return "custom"
+}
+
+// Открывает span запроса в Middleware. Span завершается после обработчика, чтобы в трассе было видно время всего
+// запроса с проверкой сессии
+func (a *Auth) traceRequest(r *http.Request) (*http.Request, Span) {
+	ctx, span := a.startSpan(r.Context(), "Middleware")
+	return r.WithContext(ctx), span
+}
+
+// Исходы вызова хранилища
+const (
+	storeOK       = "ok"
+	storeNotFound = "not_found"
+	storeExists   = "exists"
+	storeError    = "error"
+)
+
+// Оборачивает хранилище так, что каждый его вызов открывает span с типом хранилища, методом и исходом в
+// атрибутах. Необязательные возможности сохраняются, как и в InstrumentStore. Обёртки можно вкладывать друг в друга.
+//
+// Пример:
+//
+//	store := knocknock.TraceStore(knocknock.InstrumentStore(redisStore, metrics), tracer)
+func TraceStore(store Store, tracer Tracer) Store {
+	name := storeName(store)
+	return &wrappedStore{store: store, name: name, around: func(ctx context.Context, method string, call func(context.Context) error) error {
+		ctx, span := tracer.Start(ctx, "knocknock.store."+method,
+			Attribute{attrStore, name},
+			Attribute{attrStoreMethod, method},
+		)
+		err := call(ctx)
+
+		outcome := storeError
+		switch {
+		case err == nil:
+			outcome = storeOK
+		case errors.Is(err, SessionNotFoundError):
+			outcome = storeNotFound
+		case errors.Is(err, SessionExistsError):
+			outcome = storeExists
+		}
+		endSpan(span, outcome, err)
+		return err
+	}}
+}
@@ -0,0 +1,132 @@
+package knocknock
+
+/*
+ * typed.go содержит типизированную обёртку над Auth. Хранилища по-прежнему работают с Session (данные типа any), а
+ * TypedAuth проверяет и приводит UserData к T на границе API, так что обработчикам не нужны ручные type assertion
+ */
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// Типизированный менеджер сессий. Встраивает Auth, поэтому Middleware, UpdateAuthOptions, DeleteSession и остальные
+// методы доступны как есть, а CreateSession, GetSession и Login работают с TypedSession[T]
+type TypedAuth[T any] struct {
+	*Auth
+}
+
+// Конструктор TypedAuth. Аргументы те же, что у HandleAuth.
+//
+// Пример:
+//
+//	auth := knocknock.HandleTypedAuth[User](knocknock.HandleMemoryStore())
+//	session, err := auth.CreateSession(ctx, User{ID: 1})
+//	fmt.Println(session.UserData.ID)
+func HandleTypedAuth[T any](store Store, authOptions ...AuthOption) *TypedAuth[T] {
+	return &TypedAuth[T]{HandleAuth(store, authOptions...)}
+}
+
+// Создаёт новую сессию с данными типа T. См. Auth.CreateSession
+func (a *TypedAuth[T]) CreateSession(ctx context.Context, userData T, sessionOptions ...SessionOption) (*TypedSession[T], error) {
+	session, err := a.Auth.CreateSession(ctx, userData, sessionOptions...)
+	if err != nil {
+		return nil, err
+	}
+	return AsTypedSession[T](session)
+}
+
+// Возвращает сессию по токену с данными, приведёнными к T. См. Auth.GetSession
+func (a *TypedAuth[T]) GetSession(ctx context.Context, token string) (*TypedSession[T], error) {
+	session, err := a.Auth.GetSession(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	return AsTypedSession[T](session)
+}
+
+// Создаёт сессию с данными типа T и ставит её cookie. См. Auth.Login
+func (a *TypedAuth[T]) Login(w http.ResponseWriter, r *http.Request, userData T, sessionOptions ...SessionOption) (*TypedSession[T], error) {
+	session, err := a.Auth.Login(w, r, userData, sessionOptions...)
+	if err != nil {
+		return nil, err
+	}
+	return AsTypedSession[T](session)
+}
+
+// Приводит сессию к TypedSession[T]. Если UserData уже имеет тип T, она используется как есть. Значения, которые
+// сериализующие хранилища (FileStore, SQLStore, RedisStore, CookieStore) возвращают вместо исходных данных
+// (map[string]any, []any, string, float64, bool), перекодируются в T через JSON. Пустые данные, данные любого
+// другого типа и не приводимые к T дают UserDataTypeError
+func AsTypedSession[T any](session *Session) (*TypedSession[T], error) {
+	userData, ok := session.UserData.(T)
+	if !ok {
+		if !jsonDecoded(session.UserData) {
+			return nil, UserDataTypeError
+		}
+		raw, err := json.Marshal(session.UserData)
+		if err != nil {
+			return nil, UserDataTypeError
+		}
+		if err := json.Unmarshal(raw, &userData); err != nil {
+			return nil, UserDataTypeError
+		}
+	}
+	return retypeSession(session, userData), nil
+}
+
+// Имеет ли значение один из типов, которые даёт json.Unmarshal в any. null (nil) сюда не входит: пустые данные
+// не должны становиться нулевым значением T
+func jsonDecoded(value any) bool {
+	switch value.(type) {
+	case map[string]any, []any, string, float64, bool:
+		return true
+	}
+	return false
+}
+
+// Копирует сессию в TypedSession[T] с данными userData. Новое поле сессии нужно добавить и сюда
+func retypeSession[T any](session *Session, userData T) *TypedSession[T] {
+	return &TypedSession[T]{
+		Token:          session.Token,
+		UserData:       userData,
+		Subject:        session.Subject,
+		Roles:          session.Roles,
+		Scopes:         session.Scopes,
+		CreatedAt:      session.CreatedAt,
+		ExpiresAt:      session.ExpiresAt,
+		LastAccessedAt: session.LastAccessedAt,
+		Kind:           session.Kind,
+		Pair:           session.Pair,
+		ReplacedBy:     session.ReplacedBy,
+		Verifier:       session.Verifier,
+		CSRFToken:      session.CSRFToken,
+	}
+}
+
+// Возвращает сессию из контекста запроса с данными типа T. Возвращает nil, если сессии в контексте нет или её данные
+// не приводятся к T.
+//
+// Пример:
+//
+//	func handler(w http.ResponseWriter, r *http.Request) {
+//	    session := knocknock.GetSessionAs[User](r.Context())
+//	    if session == nil {
+//	        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+//	        return
+//	    }
+//	    fmt.Fprintln(w, session.UserData.Username)
+//	}
+func GetSessionAs[T any](ctx context.Context) *TypedSession[T] {
+	session := GetSession(ctx)
+	if session == nil {
+		return nil
+	}
+
+	typed, err := AsTypedSession[T](session)
+	if err != nil {
+		return nil
+	}
+	return typed
+}